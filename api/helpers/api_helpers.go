@@ -2,9 +2,7 @@ package helpers
 
 import (
 	"errors"
-	"time"
 
-	"github.com/vova616/xxhash"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
 	"gitlab.uncharted.software/WM/wm-request-queue/config"
@@ -33,35 +31,23 @@ func CheckEnqueueParams(enqueueMsg pipeline.EnqueueRequestData) error {
 	return nil
 }
 
-// AddToQueue takes a given job and adds it to the queue
-func AddToQueue(enqueueMsg pipeline.EnqueueRequestData, cfg config.Config, requestQueue queue.RequestQueue, labels []string) (bool, error) {
-	// Create a hash from the request data
-	paramHash := xxhash.Checksum32(enqueueMsg.RequestData)
-
-	// Relevant info to run the request downstream
-	keyed := pipeline.KeyedEnqueueRequestData{
-		EnqueueRequestData: enqueueMsg,
-		RequestKey:         int32(paramHash),
-		StartTime:          time.Now(),
-		Labels:             labels,
-	}
+// AddToQueue takes a given job and adds it to the queue, notifying subscribers once it has
+// been added.  Returns true if the job was accepted, including when an identical job was already
+// queued, in which case subscribers aren't notified.
+func AddToQueue(enqueueMsg pipeline.EnqueueRequestData, cfg config.Config, requestQueue queue.RequestQueue, notifier pipeline.Notifier, labels []string) (bool, error) {
+	// Relevant info to run the request downstream, keyed by a hash of the request data
+	keyed := pipeline.NewKeyedEnqueueRequestData(enqueueMsg, labels)
 
 	// Enqueue the request if there's room, otherwise let the caller know that the service
 	// is unavailable.
-	if config.UseQueueIdempotency(cfg.Environment.DataPipelineIdempotencyChecks) {
-		result, err := requestQueue.EnqueueHashed(int(keyed.RequestKey), keyed)
-		if err != nil {
-			return result, err
-		} else if !result {
-			return result, errors.New("request queue full")
-		}
-	} else {
-		result, err := requestQueue.Enqueue(keyed)
-		if err != nil {
-			return result, err
-		} else if !result {
-			return result, errors.New("request queue full")
-		}
+	added, err := pipeline.EnqueueKeyed(&cfg, requestQueue, keyed)
+	if err != nil {
+		return false, err
+	}
+	if added {
+		event := pipeline.NewJobEvent(pipeline.EventEnqueued, enqueueMsg)
+		event.EnqueuedAt = keyed.StartTime
+		notifier.Notify(event)
 	}
 	return true, nil
 }
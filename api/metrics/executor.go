@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"time"
+
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+)
+
+// Executor operations that are timed.
+const (
+	operationSubmit         = "submit"
+	operationFlowRuns       = "flow_runs"
+	operationActiveFlowRuns = "active_flow_runs"
+	operationAgents         = "agents"
+	operationCancel         = "cancel"
+)
+
+// instrumentedExecutor records the duration and errors of each call to an executor.
+type instrumentedExecutor struct {
+	executor pipeline.Executor
+	metrics  *Metrics
+}
+
+// InstrumentExecutor wraps an executor so that its calls are recorded by operation.
+func (m *Metrics) InstrumentExecutor(executor pipeline.Executor) pipeline.Executor {
+	return &instrumentedExecutor{executor: executor, metrics: m}
+}
+
+func (e *instrumentedExecutor) Submit(request *pipeline.KeyedEnqueueRequestData, labels []string) (string, error) {
+	start := time.Now()
+	flowID, err := e.executor.Submit(request, labels)
+	e.metrics.observeCall(operationSubmit, start, err)
+	return flowID, err
+}
+
+func (e *instrumentedExecutor) FlowRuns(ids []string) ([]pipeline.FlowRun, error) {
+	start := time.Now()
+	runs, err := e.executor.FlowRuns(ids)
+	e.metrics.observeCall(operationFlowRuns, start, err)
+	return runs, err
+}
+
+func (e *instrumentedExecutor) ActiveFlowRuns() ([]pipeline.FlowRun, error) {
+	start := time.Now()
+	runs, err := e.executor.ActiveFlowRuns()
+	e.metrics.observeCall(operationActiveFlowRuns, start, err)
+	return runs, err
+}
+
+func (e *instrumentedExecutor) Agents() ([]pipeline.Agent, error) {
+	start := time.Now()
+	agents, err := e.executor.Agents()
+	e.metrics.observeCall(operationAgents, start, err)
+	return agents, err
+}
+
+func (e *instrumentedExecutor) Cancel(flowID string) error {
+	start := time.Now()
+	err := e.executor.Cancel(flowID)
+	e.metrics.observeCall(operationCancel, start, err)
+	return err
+}
@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+)
+
+// namespace prefixes the name of every metric.
+const namespace = "wm_request_queue"
+
+// Notification outcomes.
+const (
+	outcomeDelivered = "delivered"
+	outcomeFailed    = "failed"
+)
+
+// unmatchedRoute labels requests that didn't match a route, so that unknown paths don't each
+// create a new series.
+const unmatchedRoute = "unmatched"
+
+// Metrics collects the service's metrics and serves them in the Prometheus exposition format.
+// It is notified of job lifecycle events and notification outcomes, and observes the requests
+// handled by the logger middleware.
+type Metrics struct {
+	registry         *prometheus.Registry
+	enqueued         prometheus.Counter
+	dequeued         prometheus.Counter
+	dispatchLatency  prometheus.Histogram
+	executorDuration *prometheus.HistogramVec
+	executorErrors   *prometheus.CounterVec
+	notifications    *prometheus.CounterVec
+	httpDuration     *prometheus.HistogramVec
+}
+
+// NewMetrics creates and registers the service's metrics, along with the standard go runtime and
+// process metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		enqueued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "enqueued_total",
+			Help:      "Requests added to the queue, including retries but not duplicates.",
+		}),
+		dequeued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dequeued_total",
+			Help:      "Requests taken from the queue and dispatched to a flow run.",
+		}),
+		dispatchLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dispatch_latency_seconds",
+			Help:      "Time from a request being enqueued until its flow run was submitted.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		}),
+		executorDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "executor_request_duration_seconds",
+			Help:      "Duration of calls to the executor, ie. prefect graphql requests, by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		executorErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "executor_request_errors_total",
+			Help:      "Calls to the executor that returned an error, by operation.",
+		}, []string{"operation"}),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_total",
+			Help:      "Notifications that were delivered, or failed after using all of their attempts, by subscriber.",
+		}, []string{"subscriber", "endpoint", "outcome"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP requests by method, route and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.enqueued,
+		m.dequeued,
+		m.dispatchLatency,
+		m.executorDuration,
+		m.executorErrors,
+		m.notifications,
+		m.httpDuration,
+	)
+	return m
+}
+
+// WatchQueue reports the depth of a queue, and the number of duplicate enqueues if the queue
+// counts them.
+func (m *Metrics) WatchQueue(requestQueue queue.RequestQueue) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Requests waiting in the queue.",
+	}, func() float64 { return float64(requestQueue.Size()) }))
+
+	if counter, ok := requestQueue.(queue.DuplicateCounter); ok {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dedup_hits_total",
+			Help:      "Enqueues that were dropped because the request was already queued.",
+		}, func() float64 { return float64(counter.Duplicates()) }))
+	}
+}
+
+// WatchFlows reports the number of in-flight flow runs returned by `count`.
+func (m *Metrics) WatchFlows(count func() int) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_flows",
+		Help:      "Flow runs that have been submitted and have not yet finished.",
+	}, func() float64 { return float64(count()) }))
+}
+
+// Notify counts requests entering and leaving the queue.
+func (m *Metrics) Notify(event pipeline.JobEvent) {
+	switch event.Event {
+	case pipeline.EventEnqueued, pipeline.EventRetried:
+		m.enqueued.Inc()
+	case pipeline.EventDispatched:
+		m.dequeued.Inc()
+		if !event.EnqueuedAt.IsZero() {
+			m.dispatchLatency.Observe(event.Time.Sub(event.EnqueuedAt).Seconds())
+		}
+	}
+}
+
+// NotificationResult counts the outcome of a notification.
+func (m *Metrics) NotificationResult(entry pipeline.OutboxEntry, err error) {
+	outcome := outcomeDelivered
+	if err != nil {
+		outcome = outcomeFailed
+	}
+	m.notifications.WithLabelValues(entry.Subscriber, entry.Endpoint, outcome).Inc()
+}
+
+// ObserveRequest records the duration of an HTTP request, labelled with the route pattern it
+// matched rather than its path.
+func (m *Metrics) ObserveRequest(r *http.Request, status int, duration time.Duration) {
+	route := unmatchedRoute
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		route = rctx.RoutePattern()
+	}
+	m.httpDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(duration.Seconds())
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeCall records the duration and outcome of an executor call.
+func (m *Metrics) observeCall(operation string, start time.Time, err error) {
+	m.executorDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.executorErrors.WithLabelValues(operation).Inc()
+	}
+}
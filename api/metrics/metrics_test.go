@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	api_middleware "gitlab.uncharted.software/WM/wm-request-queue/api/middleware"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"go.uber.org/zap"
+)
+
+// stubExecutor fails to cancel, and succeeds at everything else.
+type stubExecutor struct{}
+
+func (stubExecutor) Submit(request *pipeline.KeyedEnqueueRequestData, labels []string) (string, error) {
+	return "flow", nil
+}
+
+func (stubExecutor) FlowRuns(ids []string) ([]pipeline.FlowRun, error) {
+	return nil, nil
+}
+
+func (stubExecutor) ActiveFlowRuns() ([]pipeline.FlowRun, error) {
+	return nil, nil
+}
+
+func (stubExecutor) Agents() ([]pipeline.Agent, error) {
+	return nil, nil
+}
+
+func (stubExecutor) Cancel(flowID string) error {
+	return errors.New("cancel failed")
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	body, err := io.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+
+	requestQueue := queue.NewNotifyingQueue(queue.NewListFIFOQueue(10))
+	_, _ = requestQueue.EnqueueHashed(1, 10)
+	_, _ = requestQueue.EnqueueHashed(1, 10)
+	_, _ = requestQueue.EnqueueHashed(2, 20)
+	m.WatchQueue(requestQueue)
+	m.WatchFlows(func() int { return 3 })
+
+	now := time.Now()
+	m.Notify(pipeline.JobEvent{Event: pipeline.EventEnqueued, Time: now})
+	m.Notify(pipeline.JobEvent{Event: pipeline.EventRetried, Time: now})
+	m.Notify(pipeline.JobEvent{Event: pipeline.EventDispatched, Time: now, EnqueuedAt: now.Add(-30 * time.Second)})
+	m.Notify(pipeline.JobEvent{Event: pipeline.EventSucceeded, Time: now})
+
+	m.NotificationResult(pipeline.OutboxEntry{Subscriber: "causemos", Endpoint: "processing-succeeded"}, nil)
+	m.NotificationResult(pipeline.OutboxEntry{Subscriber: "causemos", Endpoint: "processing-failed"}, errors.New("response 500"))
+
+	executor := m.InstrumentExecutor(stubExecutor{})
+	flowID, err := executor.Submit(&pipeline.KeyedEnqueueRequestData{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "flow", flowID)
+	assert.Error(t, executor.Cancel("flow"))
+
+	r := chi.NewRouter()
+	r.Use(api_middleware.Logger(zap.NewNop().Sugar(), m))
+	r.Get("/jobs/{run_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/jobs/abc", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	body := scrape(t, m)
+	assert.Contains(t, body, "wm_request_queue_queue_depth 2\n")
+	assert.Contains(t, body, "wm_request_queue_dedup_hits_total 1\n")
+	assert.Contains(t, body, "wm_request_queue_inflight_flows 3\n")
+	assert.Contains(t, body, "wm_request_queue_enqueued_total 2\n")
+	assert.Contains(t, body, "wm_request_queue_dequeued_total 1\n")
+	assert.Contains(t, body, "wm_request_queue_dispatch_latency_seconds_sum 30\n")
+	assert.Contains(t, body, `wm_request_queue_notifications_total{endpoint="processing-succeeded",outcome="delivered",subscriber="causemos"} 1`)
+	assert.Contains(t, body, `wm_request_queue_notifications_total{endpoint="processing-failed",outcome="failed",subscriber="causemos"} 1`)
+	assert.Contains(t, body, `wm_request_queue_executor_request_duration_seconds_count{operation="submit"} 1`)
+	assert.Contains(t, body, `wm_request_queue_executor_request_errors_total{operation="cancel"} 1`)
+	assert.NotContains(t, body, `wm_request_queue_executor_request_errors_total{operation="submit"}`)
+	assert.Contains(t, body, `wm_request_queue_http_request_duration_seconds_count{method="GET",route="/jobs/{run_id}",status="404"} 1`)
+	assert.Contains(t, body, `wm_request_queue_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`)
+}
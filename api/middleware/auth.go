@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// Role is the level of access granted to a caller.  Each role includes the access of the roles
+// below it.
+type Role int
+
+const (
+	// RoleNone is the role of callers without valid credentials
+	RoleNone Role = iota
+	// RoleSubmitter may enqueue requests and view jobs and status
+	RoleSubmitter
+	// RoleOperator may also control the runner and manage the queue
+	RoleOperator
+)
+
+// authChallenge is sent with 401 responses to tell callers which schemes are accepted.
+const authChallenge = `Bearer realm="wm-request-queue", Basic realm="wm-request-queue"`
+
+// credential is a secret and the role it grants.
+type credential struct {
+	secret string
+	role   Role
+}
+
+// authUsers is the contents of the basic auth users file, mapping each role's user names to their
+// passwords.
+type authUsers struct {
+	Submitters map[string]string `json:"submitters"`
+	Operators  map[string]string `json:"operators"`
+}
+
+// Authenticator checks the bearer token or basic auth credentials of requests against those
+// configured for each role.  Authentication is disabled when no credentials are configured.
+type Authenticator struct {
+	tokens []credential
+	users  map[string]credential
+}
+
+// NewAuthenticator creates an authenticator from the configured tokens and the users in the users
+// file, returning an error if the file can't be read, a token or user is given more than one role,
+// or a user has no password.
+func NewAuthenticator(env *config.Environment) (*Authenticator, error) {
+	a := &Authenticator{users: map[string]credential{}}
+	seen := map[string]bool{}
+	addTokens := func(tokens []string, role Role) error {
+		for _, token := range tokens {
+			if token == "" {
+				continue
+			}
+			if seen[token] {
+				return errors.New("auth token is configured more than once")
+			}
+			seen[token] = true
+			a.tokens = append(a.tokens, credential{secret: token, role: role})
+		}
+		return nil
+	}
+	addUsers := func(users map[string]string, role Role) error {
+		for user, password := range users {
+			if password == "" {
+				return errors.Errorf("auth user %s has no password", user)
+			}
+			if _, ok := a.users[user]; ok {
+				return errors.Errorf("auth user %s is configured more than once", user)
+			}
+			a.users[user] = credential{secret: password, role: role}
+		}
+		return nil
+	}
+	if err := addTokens(env.AuthSubmitterTokens, RoleSubmitter); err != nil {
+		return nil, err
+	}
+	if err := addTokens(env.AuthOperatorTokens, RoleOperator); err != nil {
+		return nil, err
+	}
+	if env.AuthUsersFile == "" {
+		return a, nil
+	}
+	data, err := os.ReadFile(env.AuthUsersFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read auth users file")
+	}
+	users := authUsers{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, errors.Wrap(err, "failed to parse auth users file")
+	}
+	if err := addUsers(users.Submitters, RoleSubmitter); err != nil {
+		return nil, err
+	}
+	if err := addUsers(users.Operators, RoleOperator); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Enabled returns true if any credentials are configured.
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0
+}
+
+// Authenticate returns the role granted by a request's bearer token or basic auth credentials,
+// or RoleNone if they aren't valid.
+func (a *Authenticator) Authenticate(r *http.Request) Role {
+	if user, password, ok := r.BasicAuth(); ok {
+		cred, found := a.users[user]
+		if found && secretsEqual(cred.secret, password) {
+			return cred.role
+		}
+		return RoleNone
+	}
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		token := strings.TrimSpace(header[len("Bearer "):])
+		// every token is compared so that the time taken doesn't reveal which one matched
+		role := RoleNone
+		for _, cred := range a.tokens {
+			if secretsEqual(cred.secret, token) {
+				role = cred.role
+			}
+		}
+		return role
+	}
+	return RoleNone
+}
+
+// Require creates a middleware that only lets through requests with at least the given role.
+// Requests without valid credentials get a 401, and those whose role is too low get a 403.  All
+// requests are let through when authentication is disabled.
+func (a *Authenticator) Require(role Role) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !a.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			granted := a.Authenticate(r)
+			if granted == RoleNone {
+				w.Header().Set("WWW-Authenticate", authChallenge)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if granted < role {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// secretsEqual compares secrets in constant time.
+func secretsEqual(expected string, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+func serveWithRole(auth *Authenticator, role Role, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	handler := auth.Require(role)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := httptest.NewRequest(http.MethodPut, "/data-pipeline/clear", nil)
+	setup(request)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func writeUsersFile(t *testing.T, name string, contents string) string {
+	dir := path.Join("test_data", name)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+	file := path.Join(dir, "users.json")
+	assert.NoError(t, os.WriteFile(file, []byte(contents), 0644))
+	return file
+}
+
+func TestAuthenticator(t *testing.T) {
+	// passwords can hold any character
+	auth, err := NewAuthenticator(&config.Environment{
+		AuthSubmitterTokens: []string{"submit-token"},
+		AuthOperatorTokens:  []string{"operate-token"},
+		AuthUsersFile:       writeUsersFile(t, "auth1", `{"submitters": {"causemos": "submit-pass"}, "operators": {"admin": "operate:pass,1"}}`),
+	})
+	assert.NoError(t, err)
+	assert.True(t, auth.Enabled())
+
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(user string, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	none := func(r *http.Request) {}
+
+	// missing or invalid credentials are challenged
+	for _, setup := range []func(r *http.Request){none, bearer("wrong"), basic("admin", "wrong"), basic("nobody", "operate:pass,1"), basic("admin", "operate")} {
+		recorder := serveWithRole(auth, RoleSubmitter, setup)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), "Bearer")
+	}
+
+	// submitters can't use operator routes
+	assert.Equal(t, http.StatusNoContent, serveWithRole(auth, RoleSubmitter, bearer("submit-token")).Code)
+	assert.Equal(t, http.StatusNoContent, serveWithRole(auth, RoleSubmitter, basic("causemos", "submit-pass")).Code)
+	assert.Equal(t, http.StatusForbidden, serveWithRole(auth, RoleOperator, bearer("submit-token")).Code)
+	assert.Equal(t, http.StatusForbidden, serveWithRole(auth, RoleOperator, basic("causemos", "submit-pass")).Code)
+
+	// operators can use every route
+	assert.Equal(t, http.StatusNoContent, serveWithRole(auth, RoleSubmitter, bearer("operate-token")).Code)
+	assert.Equal(t, http.StatusNoContent, serveWithRole(auth, RoleOperator, bearer("operate-token")).Code)
+	assert.Equal(t, http.StatusNoContent, serveWithRole(auth, RoleOperator, basic("admin", "operate:pass,1")).Code)
+}
+
+func TestAuthenticatorDisabled(t *testing.T) {
+	auth, err := NewAuthenticator(&config.Environment{})
+	assert.NoError(t, err)
+	assert.False(t, auth.Enabled())
+	assert.Equal(t, http.StatusNoContent, serveWithRole(auth, RoleOperator, func(r *http.Request) {}).Code)
+}
+
+func TestAuthenticatorInvalid(t *testing.T) {
+	_, err := NewAuthenticator(&config.Environment{AuthSubmitterTokens: []string{"token"}, AuthOperatorTokens: []string{"token"}})
+	assert.Error(t, err)
+	invalid := []string{
+		`{"submitters": {"admin": "a"}, "operators": {"admin": "b"}}`,
+		`{"operators": {"admin": ""}}`,
+		`admin:password`,
+	}
+	for i, contents := range invalid {
+		_, err = NewAuthenticator(&config.Environment{AuthUsersFile: writeUsersFile(t, "auth2", contents)})
+		assert.Error(t, err, i)
+	}
+	_, err = NewAuthenticator(&config.Environment{AuthUsersFile: path.Join("test_data", "missing.json")})
+	assert.Error(t, err)
+}
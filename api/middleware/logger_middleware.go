@@ -8,9 +8,14 @@ import (
 	"go.uber.org/zap"
 )
 
+// RequestObserver is told about each request handled by the logger.
+type RequestObserver interface {
+	ObserveRequest(r *http.Request, status int, duration time.Duration)
+}
+
 // Logger creates a middleware wrapper around a zap Sugared logger that logs
-// HTTP requests.
-func Logger(l *zap.SugaredLogger) func(next http.Handler) http.Handler {
+// HTTP requests.  Each request is also passed to the observer, if one is supplied.
+func Logger(l *zap.SugaredLogger, observer RequestObserver) func(next http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			lw := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
@@ -19,18 +24,22 @@ func Logger(l *zap.SugaredLogger) func(next http.Handler) http.Handler {
 			if lw.Status() == 0 {
 				lw.WriteHeader(http.StatusOK)
 			}
+			elapsed := time.Since(t1)
 			logString := newRequestLogger().
 				requestType(r.Method).
 				request(r.URL.String()).
 				params(r.URL.String()).
 				status(lw.Status()).
-				duration(time.Since(t1)).
+				duration(elapsed).
 				render()
 			if lw.Status() < 500 {
 				l.Info(logString)
 			} else {
 				l.Warn(logString)
 			}
+			if observer != nil {
+				observer.ObserveRequest(r, lw.Status(), elapsed)
+			}
 		}
 		return http.HandlerFunc(fn)
 	}
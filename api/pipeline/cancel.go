@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CancelResult reports what was cancelled for a run ID.
+type CancelResult struct {
+	RunID          string   `json:"run_id"`
+	Dequeued       int      `json:"dequeued"`
+	CancelledFlows []string `json:"cancelled_flows"`
+}
+
+// Found returns true if anything was cancelled.
+func (c *CancelResult) Found() bool {
+	return c.Dequeued > 0 || len(c.CancelledFlows) > 0
+}
+
+// Cancel stops a request given its run ID.  Queued requests and pending retries are removed, and
+// flow runs that have already been submitted are cancelled in prefect and reported to causemos as
+// cancelled.  A request that is being submitted is cancelled once its submission finishes.  An error
+// is returned if any of the request's flow runs couldn't be cancelled.
+func (d *DataPipelineRunner) Cancel(runID string) (*CancelResult, error) {
+	// leased requests can't be removed from the queue, so wait for any submission in progress to
+	// either track the request's flow run or return it to the queue
+	d.dispatchMutex.Lock()
+	defer d.dispatchMutex.Unlock()
+
+	result := &CancelResult{RunID: runID, CancelledFlows: []string{}}
+
+	removed, err := d.queue.Remove(func(x interface{}) bool {
+		request, ok := x.(KeyedEnqueueRequestData)
+		return ok && request.RunID == runID
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to remove run %s from queue", runID)
+	}
+	result.Dequeued = len(removed)
+
+	d.mutex.Lock()
+	_, retrying := d.pendingRetries[runID]
+	delete(d.pendingRetries, runID)
+	flows := map[string]FlowData{}
+	for flowID, flow := range d.currentFlowIDs {
+		if flow.Request.RunID == runID {
+			flows[flowID] = flow
+		}
+	}
+	d.mutex.Unlock()
+	if retrying {
+		d.savePendingRetries()
+		result.Dequeued++
+	}
+	if result.Dequeued > 0 && len(flows) == 0 {
+		d.transitionJob(EnqueueRequestData{RunID: runID}, JobCancelled, "", "cancelled while queued")
+	}
+
+	failed := []string{}
+	for flowID, flow := range flows {
+		if err := d.executor.Cancel(flowID); err != nil {
+			d.Logger.Error(err)
+			failed = append(failed, flowID)
+			continue
+		}
+
+		// stop tracking the flow so it isn't retried or reported again when its state updates
+		d.untrackFlow(flowID)
+		d.saveTrackedFlows()
+
+		d.notifyFailed(flowID, flow, "", StateCancelled)
+		result.CancelledFlows = append(result.CancelledFlows, flowID)
+	}
+
+	// a cancelled request's failures mustn't count against a later resubmission
+	if result.Found() && len(failed) == 0 {
+		if err := d.deadLetters.Discard(runID); err != nil {
+			d.Logger.Error(err)
+		}
+	}
+
+	// cancelled flows free up slots for queued requests
+	if len(result.CancelledFlows) > 0 {
+		d.wakeDispatcher()
+	}
+	if len(failed) > 0 {
+		return nil, errors.Errorf("failed to cancel flow runs %s of run %s", strings.Join(failed, ", "), runID)
+	}
+	return result, nil
+}
+
+// Clear removes every queued request and pending retry, cancelling their jobs and discarding their
+// failure histories, and returns the number of requests removed.  The queue is emptied in a single
+// step, so requests enqueued while clearing are either cancelled or left queued.  Requests that are
+// being submitted, and flow runs that have already been submitted, are left alone.
+func (d *DataPipelineRunner) Clear() (int, error) {
+	removed, err := d.queue.Remove(func(x interface{}) bool { return true })
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to clear queue")
+	}
+	requests := []EnqueueRequestData{}
+	for _, x := range removed {
+		if request, ok := x.(KeyedEnqueueRequestData); ok {
+			requests = append(requests, request.EnqueueRequestData)
+		}
+	}
+
+	d.mutex.Lock()
+	for _, retry := range d.pendingRetries {
+		requests = append(requests, retry.Request)
+	}
+	retrying := len(d.pendingRetries) > 0
+	d.pendingRetries = map[string]PendingRetry{}
+	d.mutex.Unlock()
+	if retrying {
+		d.savePendingRetries()
+	}
+
+	for _, request := range requests {
+		d.transitionJob(request, JobCancelled, "", "queue cleared")
+		if err := d.deadLetters.Discard(request.RunID); err != nil {
+			d.Logger.Error(err)
+		}
+	}
+	return len(requests), nil
+}
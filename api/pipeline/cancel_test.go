@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func TestCancel(t *testing.T) {
+	dir := path.Join("test_data", "cancel1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	var cancelled []string
+	prefect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(body.Query, "cancel_flow_run") {
+			if body.Variables["id"] == "flow2" {
+				_, _ = w.Write([]byte(`{"errors": [{"message": "flow run is locked"}]}`))
+				return
+			}
+			cancelled = append(cancelled, body.Variables["id"].(string))
+		}
+		_, _ = w.Write([]byte(`{"data": {"cancel_flow_run": {"state": "Cancelled"}}}`))
+	}))
+	defer prefect.Close()
+
+	var notifications []map[string]interface{}
+	causemos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/maas/pipeline-reporting/processing-failed", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		var payload map[string]interface{}
+		_ = json.Unmarshal(body, &payload)
+		notifications = append(notifications, payload)
+	}))
+	defer causemos.Close()
+
+	requestQueue := queue.NewListFIFOQueue(5)
+	cfg := config.Config{
+		Logger:      zap.NewNop().Sugar(),
+		Environment: &config.Environment{DataPipelineAddr: prefect.URL, CausemosAddr: causemos.URL, DataPipelineIdempotencyChecks: config.IdempotencyAll, DataPipelineQueueDir: dir, DataPipelineOutboxName: "outbox"},
+	}
+	notifier := newTestNotifier(t, &cfg)
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	_, err = deadLetters.RecordFailure(EnqueueRequestData{RunID: "run1"}, nil, "failed")
+	assert.NoError(t, err)
+	runner := &DataPipelineRunner{
+		Config:   cfg,
+		executor: NewPrefectExecutor(cfg.Environment),
+		queue:    requestQueue,
+		mutex:    &sync.RWMutex{},
+		currentFlowIDs: map[string]FlowData{
+			"flow1": {Request: EnqueueRequestData{ModelID: "model", RunID: "run1"}},
+			"flow2": {Request: EnqueueRequestData{ModelID: "model", RunID: "run2"}},
+		},
+		flowsPath:      path.Join(dir, "current_flows.json"),
+		pendingRetries: map[string]PendingRetry{},
+		retriesPath:    path.Join(dir, "pending_retries.json"),
+		notifier:       notifier,
+		deadLetters:    deadLetters,
+	}
+
+	for _, runID := range []string{"run1", "run3"} {
+		keyed := NewKeyedEnqueueRequestData(EnqueueRequestData{RunID: runID, RequestData: []byte(`{"run_id":"` + runID + `"}`)}, nil)
+		_, err := EnqueueKeyed(&cfg, requestQueue, keyed)
+		assert.NoError(t, err)
+	}
+
+	result, err := runner.Cancel("run1")
+	assert.NoError(t, err)
+	assert.True(t, result.Found())
+	assert.Equal(t, 1, result.Dequeued)
+	assert.Equal(t, []string{"flow1"}, result.CancelledFlows)
+	assert.Equal(t, []string{"flow1"}, cancelled)
+	assert.Equal(t, 1, requestQueue.Size())
+	assert.Equal(t, 1, runner.TrackedFlowCount())
+	assert.NotContains(t, deadLetters.entries, "run1")
+
+	// closing waits for the notification to be delivered
+	notifier.Close()
+	assert.Len(t, notifications, 1)
+	assert.Equal(t, "run1", notifications[0]["run_id"])
+	assert.Equal(t, "Cancelled", notifications[0]["state"])
+
+	result, err = runner.Cancel("run4")
+	assert.NoError(t, err)
+	assert.False(t, result.Found())
+
+	// a flow run that can't be cancelled is an error, and stays tracked
+	result, err = runner.Cancel("run2")
+	assert.Error(t, err)
+	assert.Nil(t, result)
+	assert.Equal(t, 1, runner.TrackedFlowCount())
+}
+
+func TestCancelDuringSubmission(t *testing.T) {
+	dir := path.Join("test_data", "cancel2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	env := &config.Environment{
+		DataPipelineParallelism:       1,
+		DataPipelinePollIntervalSec:   3600,
+		DataPipelineLeaseTimeoutSec:   60,
+		DataPipelineQueueDir:          dir,
+		DataPipelineFlowsName:         "current_flows",
+		DataPipelineRetriesName:       "pending_retries",
+		DataPipelineJobsName:          "jobs",
+		DataPipelineJobRetentionHours: 1,
+	}
+	cfg := &config.Config{Logger: zap.NewNop().Sugar(), Environment: env}
+
+	requestQueue := queue.NewListFIFOQueue(5)
+	request := newFakePrefectRequest(1, "run1")
+	_, err := requestQueue.EnqueueHashed(int(request.RequestKey), request)
+	assert.NoError(t, err)
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	executor := &blockingExecutor{submitted: make(chan string, 1), release: make(chan struct{})}
+	notifier := &recordingNotifier{}
+	runner, err := NewDataPipelineRunner(cfg, requestQueue, deadLetters, newTestJobStore(t, cfg), notifier, executor)
+	assert.NoError(t, err)
+
+	runner.Start()
+	defer runner.Stop()
+	assert.Equal(t, "run1", <-executor.submitted)
+
+	// the request is leased, so the cancellation waits for its submission to finish
+	cancelled := make(chan *CancelResult, 1)
+	go func() {
+		result, err := runner.Cancel("run1")
+		assert.NoError(t, err)
+		cancelled <- result
+	}()
+	assert.Never(t, func() bool { return len(cancelled) > 0 }, 50*time.Millisecond, time.Millisecond)
+	close(executor.release)
+
+	result := <-cancelled
+	assert.True(t, result.Found())
+	assert.Equal(t, []string{"flow-run1"}, result.CancelledFlows)
+	assert.Equal(t, 0, runner.TrackedFlowCount())
+	assert.Equal(t, 0, requestQueue.Size())
+}
+
+func TestClear(t *testing.T) {
+	dir := path.Join("test_data", "cancel3")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	requestQueue := queue.NewListFIFOQueue(5)
+	cfg := config.Config{
+		Logger:      zap.NewNop().Sugar(),
+		Environment: &config.Environment{DataPipelineIdempotencyChecks: config.IdempotencyAll, DataPipelineQueueDir: dir, DataPipelineJobsName: "jobs", DataPipelineJobRetentionHours: 1},
+	}
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	jobs := newTestJobStore(t, &cfg)
+	runner := &DataPipelineRunner{
+		Config:         cfg,
+		queue:          requestQueue,
+		mutex:          &sync.RWMutex{},
+		currentFlowIDs: map[string]FlowData{},
+		pendingRetries: map[string]PendingRetry{"run3": {Request: EnqueueRequestData{RunID: "run3"}, RetryAt: time.Now().Add(time.Hour)}},
+		retriesPath:    path.Join(dir, "pending_retries.json"),
+		deadLetters:    deadLetters,
+		jobs:           jobs,
+	}
+	for _, runID := range []string{"run1", "run2", "run3"} {
+		request := EnqueueRequestData{RunID: runID, RequestData: []byte(`{"run_id":"` + runID + `"}`)}
+		jobs.Notify(NewJobEvent(EventEnqueued, request))
+		if runID != "run3" {
+			_, err := EnqueueKeyed(&cfg, requestQueue, NewKeyedEnqueueRequestData(request, nil))
+			assert.NoError(t, err)
+		}
+	}
+	_, err = deadLetters.RecordFailure(EnqueueRequestData{RunID: "run3"}, nil, "failed")
+	assert.NoError(t, err)
+
+	// queued requests and pending retries are all cancelled
+	cleared, err := runner.Clear()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, cleared)
+	assert.Equal(t, 0, requestQueue.Size())
+	assert.Empty(t, runner.pendingRetries)
+	retries, err := loadPendingRetries(runner.retriesPath)
+	assert.NoError(t, err)
+	assert.Empty(t, retries)
+	for _, runID := range []string{"run1", "run2", "run3"} {
+		job, ok := jobs.Get(runID)
+		assert.True(t, ok)
+		assert.Equal(t, JobCancelled, job.State, runID)
+	}
+	assert.NotContains(t, deadLetters.entries, "run3")
+}
@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// CausemosSubscriberName identifies the built in causemos subscriber.
+const CausemosSubscriberName = "causemos"
+
+// Causemos pipeline reporting endpoints.
+const (
+	endpointQueueRuntime = "queue-runtime"
+	endpointSucceeded    = "processing-succeeded"
+	endpointFailed       = "processing-failed"
+)
+
+// CausemosSubscriber reports dispatched, succeeded and failed jobs to the causemos pipeline
+// reporting API.
+type CausemosSubscriber struct {
+	env        *config.Environment
+	httpClient http.Client
+}
+
+// NewCausemosSubscriber creates a subscriber for the causemos instance at the configured address.
+func NewCausemosSubscriber(env *config.Environment) *CausemosSubscriber {
+	return &CausemosSubscriber{
+		env: env,
+		// standard http client with our timeout
+		httpClient: http.Client{Timeout: time.Second * time.Duration(env.DataPipelineTimeoutSec)},
+	}
+}
+
+// Name identifies the subscriber.
+func (c *CausemosSubscriber) Name() string {
+	return CausemosSubscriberName
+}
+
+// Messages returns the pipeline reporting message for an event.  Enqueued and retried events are
+// not reported.  If causemos won't accept that a flow succeeded, it is told that it failed instead.
+func (c *CausemosSubscriber) Messages(event JobEvent) []Message {
+	request := event.Request
+	var message Message
+	switch event.Event {
+	case EventDispatched:
+		values := map[string]interface{}{"run_id": request.RunID,
+			"data_id":      request.ModelID,
+			"doc_ids":      request.DocIDs,
+			"is_indicator": request.IsIndicator,
+			"start_time":   event.EnqueuedAt.UnixMilli(),
+			"end_time":     event.Time.UnixMilli()}
+		message = Message{Endpoint: endpointQueueRuntime}
+		message.Payload, _ = json.Marshal(values)
+	case EventSucceeded:
+		values := map[string]interface{}{"flow_id": event.FlowID,
+			"run_id":       request.RunID,
+			"data_id":      request.ModelID,
+			"doc_ids":      request.DocIDs,
+			"is_indicator": request.IsIndicator,
+			"start_time":   event.SubmittedAt.UnixMilli(),
+			"end_time":     event.Time.UnixMilli()}
+		message = Message{Endpoint: endpointSucceeded, Fallback: endpointFailed}
+		message.Payload, _ = json.Marshal(values)
+	case EventFailed:
+		values := map[string]interface{}{"flow_id": event.FlowID,
+			"run_id":       request.RunID,
+			"data_id":      request.ModelID,
+			"doc_ids":      request.DocIDs,
+			"is_indicator": request.IsIndicator,
+			"state":        event.State}
+		message = Message{Endpoint: endpointFailed}
+		message.Payload, _ = json.Marshal(values)
+	default:
+		return nil
+	}
+	return []Message{message}
+}
+
+// Deliver sends a message to its causemos pipeline reporting endpoint.  An error is returned if
+// the request fails or causemos responds with a non-2xx status.
+func (c *CausemosSubscriber) Deliver(message Message) error {
+	req, err := http.NewRequest(http.MethodPut, c.env.CausemosAddr+"/api/maas/pipeline-reporting/"+message.Endpoint, bytes.NewBuffer(message.Payload))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.env.Username, c.env.Password)
+	req.Header.Set("Content-type", "application/json")
+	return doRequest(&c.httpClient, req)
+}
+
+// doRequest sends a request, returning an error if it fails or the response has a non-2xx status.
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("response %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -1,15 +1,262 @@
 package pipeline
 
 import (
+	"context"
+	"os"
+	"path"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline/fakeprefect"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
 )
 
+func newFakePrefectEnvironment(dir string, prefect *fakeprefect.Server, causemos *fakeprefect.Causemos) *config.Environment {
+	return &config.Environment{
+		DataPipelineAddr:              prefect.URL,
+		DataPipelineTimeoutSec:        5,
+		DataPipelinePollIntervalSec:   5,
+		DataPipelineProjectName:       "Development",
+		DataPipelineFlowName:          "Data Pipeline",
+		DataPipelineIdempotencyChecks: config.IdempotencyAll,
+		DataPipelineParallelism:       1,
+		DataPipelineLeaseTimeoutSec:   60,
+		DataPipelineQueueDir:          dir,
+		DataPipelineFlowsName:         "current_flows",
+		DataPipelineRetryMaxAttempts:  1,
+		DataPipelineRetriesName:       "pending_retries",
+		DataPipelineOutboxName:        "outbox",
+		DataPipelineJobsName:          "jobs",
+		DataPipelineJobRetentionHours: 1,
+		CausemosAddr:                  causemos.URL,
+		AgentLabelToIgnore:            "non-dask",
+		Username:                      "user",
+		Password:                      "password",
+	}
+}
+
+func newFakePrefectRequest(key int, runID string) KeyedEnqueueRequestData {
+	return KeyedEnqueueRequestData{
+		EnqueueRequestData: EnqueueRequestData{ModelID: "model", RunID: runID, RequestData: []byte(`{"model_id": "model", "run_id": "` + runID + `"}`)},
+		RequestKey:         int32(key),
+	}
+}
+
 func TestStart(t *testing.T) {
-	// config := config.Config{
-	// 	Logger:       sugar,
-	// 	Environment:  env,
-	// }
+	dir := path.Join("test_data", "start1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	prefect := fakeprefect.NewServer("Data Pipeline", "Development")
+	defer prefect.Close()
+	prefect.AddAgent("agent1", "dask agent", "dask")
+	prefect.AddAgent("agent2", "other agent", "non-dask")
+	prefect.Script("model:run2", "Scheduled", "Running", "Failed")
+
+	causemos := fakeprefect.NewCausemos()
+	defer causemos.Close()
+
+	env := newFakePrefectEnvironment(dir, prefect, causemos)
+	cfg := &config.Config{Logger: zap.NewNop().Sugar(), Environment: env}
+
+	requestQueue := queue.NewListFIFOQueue(5)
+	for i, runID := range []string{"run1", "run2"} {
+		request := newFakePrefectRequest(i+1, runID)
+		_, err := requestQueue.EnqueueHashed(int(request.RequestKey), request)
+		assert.NoError(t, err)
+	}
+
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	notifier := newTestNotifier(t, cfg)
+	jobs := newTestJobStore(t, cfg)
+	runner, err := NewDataPipelineRunner(cfg, requestQueue, deadLetters, jobs, Notifiers{jobs, notifier}, NewPrefectExecutor(env))
+	assert.NoError(t, err)
+
+	runner.pollInterval = 10 * time.Millisecond
+	runner.Start()
+	assert.True(t, runner.Running())
+
+	// the first request is submitted to the free agent, and the second waits for it to finish
+	assert.Eventually(t, func() bool { return len(prefect.FlowRuns()) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Never(t, func() bool { return len(prefect.FlowRuns()) > 1 }, 100*time.Millisecond, time.Millisecond)
+	run := prefect.FlowRuns()[0]
+	assert.Equal(t, "model:run1", run.Name)
+	assert.Equal(t, []string{"dask"}, run.Labels)
+	assert.JSONEq(t, `{"model_id": "model", "run_id": "run1"}`, string(run.Parameters))
+	assert.Equal(t, 1, requestQueue.Size())
+
+	prefect.Advance()
+	prefect.Advance()
+	assert.Eventually(t, func() bool { return len(prefect.FlowRuns()) == 2 }, 5*time.Second, time.Millisecond)
+
+	prefect.Advance()
+	prefect.Advance()
+	assert.Eventually(t, func() bool { return runner.TrackedFlowCount() == 0 }, 5*time.Second, time.Millisecond)
+
+	runner.Stop()
+	assert.False(t, runner.Running())
+
+	// closing waits for the notifications to be delivered
+	notifier.Close()
+
+	assert.Equal(t, 0, requestQueue.Size())
+	// the second run may be submitted before or after the first is reported, so each run's
+	// notifications are checked separately
+	assert.Equal(t, []string{"queue-runtime", "processing-succeeded"}, endpoints(causemos.NotificationsFor("run1")))
+	failed := causemos.NotificationsFor("run2")
+	assert.Equal(t, []string{"queue-runtime", "processing-failed"}, endpoints(failed))
+	assert.Equal(t, "Failed", failed[1].Payload["state"])
+	assert.Equal(t, "user", failed[1].Username)
+	assert.Equal(t, "password", failed[1].Password)
+
+	// each job is tracked from dispatch until its flow finishes
+	job, ok := jobs.Get("run1")
+	assert.True(t, ok)
+	assert.Equal(t, JobSucceeded, job.State)
+	assert.Equal(t, prefect.FlowRuns()[0].ID, job.FlowID)
+	assert.Equal(t, []string{JobDispatching, JobSubmitted}, jobStates(job)[:2])
+	job, ok = jobs.Get("run2")
+	assert.True(t, ok)
+	assert.Equal(t, JobFailed, job.State)
+	assert.Equal(t, "Failed", job.Transitions[len(job.Transitions)-1].Reason)
+}
+
+func endpoints(notifications []fakeprefect.Notification) []string {
+	endpoints := []string{}
+	for _, notification := range notifications {
+		endpoints = append(endpoints, notification.Endpoint)
+	}
+	return endpoints
+}
+
+func TestDispatchOnEnqueue(t *testing.T) {
+	dir := path.Join("test_data", "dispatch1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	prefect := fakeprefect.NewServer("Data Pipeline", "Development")
+	defer prefect.Close()
+	prefect.AddAgent("agent1", "first agent", "first")
+	prefect.AddAgent("agent2", "second agent", "second")
+
+	causemos := fakeprefect.NewCausemos()
+	defer causemos.Close()
+
+	env := newFakePrefectEnvironment(dir, prefect, causemos)
+	env.DataPipelineParallelism = 2
+	env.DataPipelinePollIntervalSec = 3600
+	cfg := &config.Config{Logger: zap.NewNop().Sugar(), Environment: env}
+
+	requestQueue := queue.NewNotifyingQueue(queue.NewListFIFOQueue(5))
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	notifier := newTestNotifier(t, cfg)
+	defer notifier.Close()
+	runner, err := NewDataPipelineRunner(cfg, requestQueue, deadLetters, newTestJobStore(t, cfg), notifier, NewPrefectExecutor(env))
+	assert.NoError(t, err)
+
+	runner.Start()
+	defer runner.Stop()
+
+	// requests enqueued into an idle runner are dispatched without waiting for a poll, filling
+	// both slots with one request per agent
+	for i, runID := range []string{"run1", "run2", "run3"} {
+		_, err := EnqueueKeyed(cfg, requestQueue, newFakePrefectRequest(i+1, runID))
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool { return len(prefect.FlowRuns()) == 2 }, 5*time.Second, time.Millisecond)
+	assert.Never(t, func() bool { return len(prefect.FlowRuns()) > 2 }, 100*time.Millisecond, time.Millisecond)
+	runs := prefect.FlowRuns()
+	assert.Equal(t, []string{"first"}, runs[0].Labels)
+	assert.Equal(t, []string{"second"}, runs[1].Labels)
+	assert.Equal(t, 1, requestQueue.Size())
+}
+
+// blockingExecutor holds each submission until it is released.
+type blockingExecutor struct {
+	submitted chan string
+	release   chan struct{}
+}
+
+func (b *blockingExecutor) Submit(request *KeyedEnqueueRequestData, labels []string) (string, error) {
+	b.submitted <- request.RunID
+	<-b.release
+	return "flow-" + request.RunID, nil
+}
+
+func (b *blockingExecutor) FlowRuns(ids []string) ([]FlowRun, error) {
+	return nil, nil
+}
+
+func (b *blockingExecutor) ActiveFlowRuns() ([]FlowRun, error) {
+	return nil, nil
+}
+
+func (b *blockingExecutor) Agents() ([]Agent, error) {
+	return nil, nil
+}
+
+func (b *blockingExecutor) Cancel(flowID string) error {
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	dir := path.Join("test_data", "shutdown1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	env := &config.Environment{
+		DataPipelineParallelism:       2,
+		DataPipelinePollIntervalSec:   3600,
+		DataPipelineLeaseTimeoutSec:   60,
+		DataPipelineQueueDir:          dir,
+		DataPipelineFlowsName:         "current_flows",
+		DataPipelineRetriesName:       "pending_retries",
+		DataPipelineJobsName:          "jobs",
+		DataPipelineJobRetentionHours: 1,
+	}
+	cfg := &config.Config{Logger: zap.NewNop().Sugar(), Environment: env}
+
+	requestQueue := queue.NewListFIFOQueue(5)
+	for i, runID := range []string{"run1", "run2"} {
+		request := newFakePrefectRequest(i+1, runID)
+		_, err := requestQueue.EnqueueHashed(int(request.RequestKey), request)
+		assert.NoError(t, err)
+	}
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	executor := &blockingExecutor{submitted: make(chan string, 2), release: make(chan struct{})}
+	runner, err := NewDataPipelineRunner(cfg, requestQueue, deadLetters, newTestJobStore(t, cfg), &recordingNotifier{}, executor)
+	assert.NoError(t, err)
+
+	runner.Start()
+	assert.Equal(t, "run1", <-executor.submitted)
+
+	// the submission in progress has until the deadline to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, runner.Shutdown(ctx))
+
+	// once it finishes, the dispatcher stops without submitting the next request
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- runner.Shutdown(context.Background()) }()
+	close(executor.release)
+	assert.NoError(t, <-shutdown)
+	assert.False(t, runner.Running())
+	assert.Empty(t, executor.submitted)
+	assert.Equal(t, 1, requestQueue.Size())
 
-	// queue := queue.NewListFIFOQueue(5)
-	// runner := NewDataPipelineRunner(&config.Config{}, queue)
+	flows, err := loadTrackedFlows(path.Join(dir, "current_flows.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, flows, "flow-run1")
 }
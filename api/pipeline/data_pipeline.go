@@ -1,43 +1,60 @@
 package pipeline
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"net/http"
+	"path"
 	"reflect"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/machinebox/graphql"
 	"github.com/pkg/errors"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
 	"gitlab.uncharted.software/WM/wm-request-queue/config"
 )
 
-// DataPipelineRunner services the request queue
+// DataPipelineRunner services the request queue.  Requests are dispatched, submitted flows are
+// monitored and subscribers are notified from separate goroutines, which only hold the mutex while
+// updating the runner's in-memory state.
 type DataPipelineRunner struct {
 	config.Config
-	client         *graphql.Client
+	executor       Executor
 	queue          queue.RequestQueue
-	done           chan bool
+	enqueued       <-chan struct{}
+	wake           chan struct{}
+	done           chan struct{}
+	workers        sync.WaitGroup
 	running        bool
 	mutex          *sync.RWMutex
+	dispatchMutex  sync.Mutex
+	persistMutex   sync.Mutex
+	pollInterval   time.Duration
 	currentFlowIDs map[string]FlowData
-	httpClient     http.Client
-	agents         prefectAgents
+	flowsPath      string
+	pendingRetries map[string]PendingRetry
+	retriesPath    string
+	retryPolicy    RetryPolicy
+	notifier       Notifier
+	agents         []Agent
+	deadLetters    *DeadLetterStore
+	jobs           *JobStore
 }
 
-// NewDataPipelineRunner creates a new instance of a data pipeline runner.
-func NewDataPipelineRunner(cfg *config.Config, requestQueue queue.RequestQueue) *DataPipelineRunner {
-	// standard http client with our timeout
-	httpClient := &http.Client{Timeout: time.Second * time.Duration(cfg.Environment.DataPipelineTimeoutSec)}
-
-	// graphql client that uses our http  client - our timeout is applied transitively
-	graphQLClient := graphql.NewClient(cfg.Environment.DataPipelineAddr, graphql.WithHTTPClient(httpClient))
+// NewDataPipelineRunner creates a new instance of a data pipeline runner that runs requests with the
+// supplied executor, tracks their progress in the job store, and publishes their lifecycle events to
+// the notifier.  Flows that were being
+// tracked or waiting to be retried when the service last stopped are reloaded from the queue
+// directory.
+func NewDataPipelineRunner(cfg *config.Config, requestQueue queue.RequestQueue, deadLetters *DeadLetterStore, jobs *JobStore, notifier Notifier, executor Executor) (*DataPipelineRunner, error) {
+	flowsPath := path.Join(cfg.Environment.DataPipelineQueueDir, cfg.Environment.DataPipelineFlowsName+".json")
+	currentFlowIDs, err := loadTrackedFlows(flowsPath)
+	if err != nil {
+		return nil, err
+	}
+	retriesPath := path.Join(cfg.Environment.DataPipelineQueueDir, cfg.Environment.DataPipelineRetriesName+".json")
+	pendingRetries, err := loadPendingRetries(retriesPath)
+	if err != nil {
+		return nil, err
+	}
 
 	dataPipeline := &DataPipelineRunner{
 		Config: config.Config{
@@ -45,323 +62,309 @@ func NewDataPipelineRunner(cfg *config.Config, requestQueue queue.RequestQueue)
 			Environment: cfg.Environment,
 		},
 		queue:          requestQueue,
-		client:         graphQLClient,
-		done:           make(chan bool),
+		executor:       executor,
+		wake:           make(chan struct{}, 1),
 		running:        false,
 		mutex:          &sync.RWMutex{},
-		currentFlowIDs: make(map[string]FlowData),
-		httpClient:     *httpClient,
+		pollInterval:   time.Duration(cfg.Environment.DataPipelinePollIntervalSec) * time.Second,
+		currentFlowIDs: currentFlowIDs,
+		flowsPath:      flowsPath,
+		pendingRetries: pendingRetries,
+		retriesPath:    retriesPath,
+		retryPolicy:    NewRetryPolicy(cfg.Environment),
+		notifier:       notifier,
+		deadLetters:    deadLetters,
+		jobs:           jobs,
 	}
 
-	dataPipeline.SetAgents()
-
-	return dataPipeline
-}
+	// queues that signal enqueues wake the dispatcher as soon as a request arrives
+	if enqueueNotifier, ok := requestQueue.(queue.EnqueueNotifier); ok {
+		dataPipeline.enqueued = enqueueNotifier.Enqueued()
+	}
 
-type agent struct {
-	ID     string
-	Name   string
-	Labels []string
-}
+	dataPipeline.SetAgents()
 
-// Current non-dask agents in prefect
-type prefectAgents struct {
-	Agents []agent `json:"agent"`
+	return dataPipeline, nil
 }
 
-// SetAgents Gets non-dask labelled agents to track
+// SetAgents Gets the executor's agents to track
 func (d *DataPipelineRunner) SetAgents() {
-	query := graphql.NewRequest(
-		`query {
-			agent(
-				where: {
-				  _not:{
-					labels:{_contains: "` + d.Environment.AgentLabelToIgnore + `"}
-				  }
-				}
-			  ) {
-				id
-				name
-				labels
-			  }
-		}`,
-	)
-
-	var respData prefectAgents
-	if err := d.client.Run(context.Background(), query, &respData); err != nil {
+	agents, err := d.executor.Agents()
+	if err != nil {
 		d.Logger.Error(err)
 	}
 
 	d.mutex.Lock()
-	d.agents = respData
+	d.agents = agents
 	d.mutex.Unlock()
 }
 
-type flowRunParameters struct {
-	FlowRun []struct {
-		ID         string                 `json:"id"`
-		Parameters map[string]interface{} `json:"parameters"`
-	} `json:"flow_run"`
-}
-
 // RetrieveByFlowRunID retrieves byte data given a run ID
 func (d *DataPipelineRunner) RetrieveByFlowRunID(runID string) []byte {
-	query := graphql.NewRequest(
-		`query {
-			flow_run(
-				where:{id: {_eq: "` + runID + `"}}
-			  ) {
-				id
-				parameters
-			  }
-		}`,
-	)
-	var respData flowRunParameters
-	if err := d.client.Run(context.Background(), query, &respData); err != nil {
-		d.Logger.Error(err)
-	}
-	requestData, err := json.Marshal(respData.FlowRun[0].Parameters)
+	runs, err := d.executor.FlowRuns([]string{runID})
 	if err != nil {
 		d.Logger.Error(err)
+		return nil
 	}
-	return requestData
+	if len(runs) == 0 {
+		d.Logger.Errorf("flow run %s not found", runID)
+		return nil
+	}
+	return runs[0].Parameters
 }
 
 // IsFlowDone returns whether or not a flow has status Failed/Succeeded
 func (d *DataPipelineRunner) IsFlowDone(runID string) bool {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	if _, ok := d.currentFlowIDs[runID]; ok {
 		return false
 	}
 	return true
 }
 
-// Start initiates request queue servicing.
+// Start initiates request queue servicing.  Queued requests are dispatched whenever a request is
+// enqueued or a flow finishes, and the status of submitted flows is polled on a fixed interval.
 func (d *DataPipelineRunner) Start() {
-	d.mutex.RLock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	if d.running {
-		d.mutex.RUnlock()
 		return
 	}
-	d.mutex.RUnlock()
+	d.running = true
+	d.done = make(chan struct{})
 
-	// Read from the queue until we get shut down.
-	go func() {
-		d.mutex.Lock()
-		d.running = true
-		d.mutex.Unlock()
-
-		for {
-			select {
-			case <-d.done:
-				// break out of the loop on shutdown
-				d.mutex.Lock()
-				d.running = false
-				d.mutex.Unlock()
-				return
-			default:
-				d.Submit(SubmitParams{Force: false})
-				time.Sleep(time.Duration(d.Environment.DataPipelinePollIntervalSec) * time.Second)
-			}
-		}
-	}()
+	d.workers.Add(2)
+	go d.dispatchLoop(d.done)
+	go d.pollLoop(d.done)
+
+	// pick up anything queued while the runner was stopped
+	d.wakeDispatcher()
 }
 
-// updateCurrentFlows notifies causemos for failed jobs, removes them from
-// currentFlowIDs if they failed or succeeded
-func (d *DataPipelineRunner) updateCurrentFlows() {
-	flowIds := d.getIDString()
-	if flowIds != "[]" {
-		currentFlows, err := d.getFlowRunsByIds(flowIds)
-		if err != nil {
-			d.Logger.Error(err)
+// dispatchLoop dispatches queued requests each time the dispatcher is woken, until shut down.
+func (d *DataPipelineRunner) dispatchLoop(done <-chan struct{}) {
+	defer d.workers.Done()
+	for {
+		select {
+		case <-done:
 			return
+		case <-d.wake:
+		case <-d.enqueued:
 		}
-		d.mutex.Lock()
-		for i := 0; i < len(currentFlows.FlowRun); i++ {
-			// check if a flow we're tracking has failed
-			if currentFlows.FlowRun[i].State == "Failed" || currentFlows.FlowRun[i].State == "Cancelled" {
-				values := map[string]interface{}{"flow_id": currentFlows.FlowRun[i].ID,
-					"run_id":       d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.RunID,
-					"data_id":      d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.ModelID,
-					"doc_ids":      d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.DocIDs,
-					"is_indicator": d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.IsIndicator}
-				payload, _ := json.Marshal(values)
-
-				resp, err := d.notifyFailure(&payload)
-				if err != nil {
-					d.Logger.Error(err)
-				} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
-					d.Logger.Errorf("Flow %s failed, failed to notify Causemos. Response %d", currentFlows.FlowRun[i].ID, resp.StatusCode)
-					resp.Body.Close()
-				} else {
-					d.Logger.Infof("Flow %s failed, notified causemos", currentFlows.FlowRun[i].ID)
-					resp.Body.Close()
-				}
-				delete(d.currentFlowIDs, currentFlows.FlowRun[i].ID)
-			} else if currentFlows.FlowRun[i].State == "Success" {
-				values := map[string]interface{}{"flow_id": currentFlows.FlowRun[i].ID,
-					"run_id":       d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.RunID,
-					"data_id":      d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.ModelID,
-					"doc_ids":      d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.DocIDs,
-					"is_indicator": d.currentFlowIDs[currentFlows.FlowRun[i].ID].Request.IsIndicator,
-					"start_time":   d.currentFlowIDs[currentFlows.FlowRun[i].ID].StartTime.UnixMilli(),
-					"end_time":     time.Now().UnixMilli()}
-				payload, _ := json.Marshal(values)
-
-				req, err := http.NewRequest(http.MethodPut, d.Config.Environment.CausemosAddr+"/api/maas/pipeline-reporting/processing-succeeded", bytes.NewBuffer(payload))
-				if err != nil {
-					d.Logger.Error(err)
-					continue
-				}
-				req.SetBasicAuth(d.Environment.Username, d.Environment.Password)
-				req.Header.Set("Content-type", "application/json")
-				resp, err := d.httpClient.Do(req)
-				if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
-					if err != nil {
-						d.Logger.Error(err)
-					} else {
-						d.Logger.Warnf("Error notifying Causemos. Response %d", resp.StatusCode)
-						resp.Body.Close()
-					}
-					resp, err = d.notifyFailure(&payload)
-					if err != nil {
-						d.Logger.Error(err)
-					} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
-						d.Logger.Errorf("Failed to notify Causemos. Response %d", resp.StatusCode)
-						resp.Body.Close()
-					} else {
-						d.Logger.Infof("Flow %s failed to notify processing-succeeded, notified causemos as fail", currentFlows.FlowRun[i].ID)
-						resp.Body.Close()
-					}
-				} else {
-					d.Logger.Infof("Flow %s succeeded, notified causemos", currentFlows.FlowRun[i].ID)
-					resp.Body.Close()
-				}
-				delete(d.currentFlowIDs, currentFlows.FlowRun[i].ID)
-			}
-		}
-		d.mutex.Unlock()
+		d.dispatch(done)
 	}
 }
 
-func (d *DataPipelineRunner) notifyFailure(payload *[]byte) (*http.Response, error) {
-
-	req, err := http.NewRequest(http.MethodPut, d.Config.Environment.CausemosAddr+"/api/maas/pipeline-reporting/processing-failed", bytes.NewBuffer(*payload))
-	if err != nil {
-		d.Logger.Error(err)
-		return nil, err
+// wakeDispatcher signals the dispatcher to fill any free parallelism slots.  Signals are
+// coalesced, so it never blocks.
+func (d *DataPipelineRunner) wakeDispatcher() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+		// a dispatch is already pending
 	}
-	req.SetBasicAuth(d.Environment.Username, d.Environment.Password)
-	req.Header.Set("Content-type", "application/json")
-	resp, err := d.httpClient.Do(req)
-	return resp, err
 }
 
-// Submit submits the next item in the queue
-func (d *DataPipelineRunner) Submit(params SubmitParams) { //force bool, providedLabels []string) {
+// Submit submits the next item in the queue.  A forced submission ignores the parallelism limit,
+// and uses the provided labels if there are any.  Otherwise a single dispatch and status update
+// pass is run.
+func (d *DataPipelineRunner) Submit(params SubmitParams) {
+	d.enqueueDueRetries()
 
-	running, err := d.getActiveFlowRuns()
-	labels := d.getLabelsToRunFlow(running)
 	if params.Force {
-		if len(params.ProvidedLabels) > 0 {
-			d.submit(params.ProvidedLabels)
-		} else {
-			d.submit(labels)
+		d.dispatchMutex.Lock()
+		defer d.dispatchMutex.Unlock()
+
+		labels := params.ProvidedLabels
+		if len(labels) == 0 {
+			running, err := d.executor.ActiveFlowRuns()
+			if err != nil {
+				d.Logger.Error(err)
+			}
+			if agent, ok := d.freeAgent(busyAgents(running)); ok {
+				labels = agent.Labels
+			}
 		}
+		d.submit(labels)
 		return
 	}
-	// Check to see if prefect is busy.  If not run the next flow request in the
-	// queue.
-	if err != nil {
-		d.Logger.Error(err)
-	} else {
-		activeFlowRuns := len(running.FlowRun)
-		if activeFlowRuns < d.Config.Environment.DataPipelineParallelism {
-			d.submit(labels)
-		}
-	}
+	d.dispatch(nil)
 	d.updateCurrentFlows()
 }
 
-func (d *DataPipelineRunner) getLabelsToRunFlow(flowRuns *flowRuns) []string {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	for _, trackedAgent := range d.agents.Agents {
-		found := true
-		for _, flowRun := range flowRuns.FlowRun {
-			// if agent is occupied, then we don't want to use it
-			if trackedAgent.ID == flowRun.Agent.ID {
-				found = false
-				break
-			}
+// dispatch submits queued requests until the queue is empty or there are as many active flow runs
+// as the configured parallelism.  Each request is sent to a different free agent while there are any.
+// Dispatch ends early, between submissions, once `done` is closed.
+func (d *DataPipelineRunner) dispatch(done <-chan struct{}) {
+	d.dispatchMutex.Lock()
+	defer d.dispatchMutex.Unlock()
+
+	// Check to see how busy the executor is, and run the next flow requests in the queue
+	// until it is full.
+	running, err := d.executor.ActiveFlowRuns()
+	if err != nil {
+		d.Logger.Error(err)
+		return
+	}
+	busy := busyAgents(running)
+	for free := d.Config.Environment.DataPipelineParallelism - len(running); free > 0; free-- {
+		select {
+		case <-done:
+			return
+		default:
 		}
-		if found {
-			return trackedAgent.Labels
+		labels := []string{}
+		if agent, ok := d.freeAgent(busy); ok {
+			labels = agent.Labels
+			// mark the agent as occupied so the next request goes elsewhere
+			busy[agent.ID] = true
+		}
+		if !d.submit(labels) {
+			return
 		}
 	}
-	return []string{}
 }
 
-func (d *DataPipelineRunner) submit(labels []string) {
+// busyAgents returns the IDs of the agents that are running the supplied flow runs.
+func busyAgents(flowRuns []FlowRun) map[string]bool {
+	busy := map[string]bool{}
+	for _, flowRun := range flowRuns {
+		busy[flowRun.AgentID] = true
+	}
+	return busy
+}
 
-	if d.queue.Size() == 0 {
-		return
+// freeAgent returns the first tracked agent that isn't busy.
+func (d *DataPipelineRunner) freeAgent(busy map[string]bool) (Agent, bool) {
+	for _, trackedAgent := range d.getAgents() {
+		// if agent is occupied, then we don't want to use it
+		if !busy[trackedAgent.ID] {
+			return trackedAgent, true
+		}
 	}
-	data, err := d.queue.Dequeue()
+	return Agent{}, false
+}
 
+func (d *DataPipelineRunner) getAgents() []Agent {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.agents
+}
+
+// submit runs the request at the head of the queue with the supplied labels, returning true if a
+// flow run was started.
+func (d *DataPipelineRunner) submit(labels []string) bool {
+	// Reserve the next request rather than dequeuing it, so that it is only removed from the queue
+	// once the executor has accepted it.
+	leaseTimeout := time.Duration(d.Environment.DataPipelineLeaseTimeoutSec) * time.Second
+	lease, err := d.queue.Reserve(leaseTimeout)
 	if err != nil {
 		d.Logger.Error(err)
+		return false
 	}
-	request, ok := data.(KeyedEnqueueRequestData)
-	if !ok {
-		d.Logger.Error(errors.Errorf("unhandled request type %s", reflect.TypeOf(request)))
+	if lease == nil {
+		return false
 	}
 
-	values := map[string]interface{}{"run_id": request.RunID,
-		"data_id":      request.ModelID,
-		"doc_ids":      request.DocIDs,
-		"is_indicator": request.IsIndicator,
-		"start_time":   request.StartTime.UnixMilli(),
-		"end_time":     time.Now().UnixMilli()}
-	payload, _ := json.Marshal(values)
+	request, ok := lease.Value.(KeyedEnqueueRequestData)
+	if !ok {
+		d.Logger.Error(errors.Errorf("unhandled request type %s", reflect.TypeOf(lease.Value)))
+		// an unexpected entry can never be submitted, so drop it rather than retrying it forever
+		if err := d.queue.Ack(lease.ID); err != nil {
+			d.Logger.Error(err)
+		}
+		return false
+	}
 
-	req, err := http.NewRequest(http.MethodPut, d.Config.Environment.CausemosAddr+"/api/maas/pipeline-reporting/queue-runtime", bytes.NewBuffer(payload))
-	if err != nil {
-		d.Logger.Error(err)
-	} else {
-		req.SetBasicAuth(d.Environment.Username, d.Environment.Password)
-		req.Header.Set("Content-type", "application/json")
-		resp, err := d.httpClient.Do(req)
+	d.transitionJob(request.EnqueueRequestData, JobDispatching, "", "")
+	flowID, err := d.executor.Submit(&request, labels)
+	if err != nil || flowID == "" {
+		reason := "executor did not return a flow run id"
 		if err != nil {
 			d.Logger.Error(err)
-		} else {
-			resp.Body.Close()
+			reason = err.Error()
 		}
+		d.submitFailed(lease, request, reason)
+		return false
+	}
+
+	// track flow
+	flow := FlowData{
+		Request:    request.EnqueueRequestData,
+		StartTime:  time.Now(),
+		EnqueuedAt: request.StartTime,
+		Labels:     request.Labels,
+		Retries:    request.Retries,
+	}
+	d.mutex.Lock()
+	d.currentFlowIDs[flowID] = flow
+	d.mutex.Unlock()
+	d.saveTrackedFlows()
+
+	if err := d.queue.Ack(lease.ID); err != nil {
+		d.Logger.Error(err)
 	}
 
-	flowID, err := d.submitFlowRunRequest(&request, labels)
+	d.notifier.Notify(flowEvent(EventDispatched, flowID, flow))
+	return true
+}
 
+// submitFailed records a failed submission.  The request is returned to the head of the queue to be
+// retried, unless it has failed too many times, in which case it is moved to the dead letter store.
+func (d *DataPipelineRunner) submitFailed(lease *queue.Lease, request KeyedEnqueueRequestData, reason string) {
+	dead, err := d.deadLetters.RecordFailure(request.EnqueueRequestData, request.Labels, reason)
 	if err != nil {
 		d.Logger.Error(err)
 	}
+	if !dead {
+		if err := d.queue.Nack(lease.ID); err != nil {
+			d.Logger.Error(err)
+		}
+		d.transitionJob(request.EnqueueRequestData, JobQueued, "", reason)
+		return
+	}
 
-	// track flow
-	if flowID != "" {
-		d.mutex.Lock()
-		d.currentFlowIDs[flowID] = FlowData{Request: request.EnqueueRequestData, StartTime: time.Now()}
-		d.mutex.Unlock()
+	d.Logger.Warnf("Run %s failed submission too many times, moved to dead letter store", request.RunID)
+	if err := d.queue.Ack(lease.ID); err != nil {
+		d.Logger.Error(err)
 	}
+	d.notifyFailed("", FlowData{Request: request.EnqueueRequestData, EnqueuedAt: request.StartTime, Labels: request.Labels, Retries: request.Retries}, "", "Failed")
 }
 
-// Stop ends request servicing.
+// Stop ends request servicing, returning once any dispatch or status update in progress has
+// finished, including when the runner was already being stopped.
 func (d *DataPipelineRunner) Stop() {
-	d.mutex.RLock()
-	defer d.mutex.RUnlock()
+	d.mutex.Lock()
 	if d.running {
-		d.done <- true
+		d.running = false
+		close(d.done)
 	}
+	d.mutex.Unlock()
+
+	// the lock isn't held while waiting, as the workers may need it to finish
+	d.workers.Wait()
+}
+
+// Shutdown stops request servicing once any submission in progress has finished, and flushes the
+// tracked flows and pending retries to disk.  State is flushed even if the runner hasn't stopped
+// by the context's deadline, in which case an error is returned.
+func (d *DataPipelineRunner) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "data pipeline runner did not stop")
+	}
+	d.saveTrackedFlows()
+	d.savePendingRetries()
+	return err
 }
 
 // Running indicates whether or not the pipeline runner routine has been stopped,
@@ -372,199 +375,18 @@ func (d *DataPipelineRunner) Running() bool {
 	return d.running
 }
 
-// Status of prefect flow runs.
-type flowRuns struct {
-	FlowRun []struct {
-		ID    string
-		State string
-		Flow  struct {
-			ID             string
-			Name           string
-			VersionGroupID string `json:"version_group_id"`
-		}
-		Agent agent
-	} `json:"flow_run"`
-}
-
 // GetAmountOfRunningFlows returns the number of running/scheduled flows
 func (d *DataPipelineRunner) GetAmountOfRunningFlows() (int, error) {
-	running, err := d.getActiveFlowRuns()
+	running, err := d.executor.ActiveFlowRuns()
 	if err != nil {
 		return 0, err
 	}
-	return len(running.FlowRun), nil
+	return len(running), nil
 }
 
-// Fetches the scheduled/running tasks from prefect.
-func (d *DataPipelineRunner) getActiveFlowRuns() (*flowRuns, error) {
-	queryString := fmt.Sprintf(
-		`query {
-			flow_run(where: {
-			  _and: [{
-				_or: [
-					{state: {_eq: "Submitted"}}
-					{state: {_eq: "Scheduled"}}
-					{state: {_eq: "Running"}}
-				]
-			  }, {
-					flow: { _and: [{ name: {_eq: "%s"}}, { project: { name: {_eq: "%s"}}}]}
-			  }
-			  ]
-			}) {
-			  id
-			  state
-			  flow {
-				id
-				name
-				version_group_id
-			  }
-			  agent {
-				  id
-				  name
-				  labels
-			  }
-			}
-		  }`, d.Config.Environment.DataPipelineFlowName, d.Config.Environment.DataPipelineProjectName)
-
-	return d.runGraphqlRequest(queryString)
-}
-
-func (d *DataPipelineRunner) getIDString() string {
-	result := "["
-	d.mutex.Lock()
-	for k := range d.currentFlowIDs {
-		result += "\"" + k + "\"" + ","
-	}
-	d.mutex.Unlock()
-
-	if result != "[" {
-		return result[:len(result)-1] + "]"
-	}
-	return "[]"
-}
-
-func (d *DataPipelineRunner) getFlowRunsByIds(ids string) (*flowRuns, error) {
-	queryString := fmt.Sprintf(
-		`query {
-			flow_run(where: {
-			  _and: [{
-					id: {_in: %s}
-			  }, {
-					flow: { _and: [{ name: {_eq: "%s"}}, { project: { name: {_eq: "%s"}}}]}
-			  }
-			  ]
-			}) {
-			  id
-			  state
-			  flow {
-				id
-				name
-				version_group_id
-			  }
-			}
-		  }`, ids, d.Config.Environment.DataPipelineFlowName, d.Config.Environment.DataPipelineProjectName)
-
-	return d.runGraphqlRequest(queryString)
-}
-
-func (d *DataPipelineRunner) runGraphqlRequest(queryString string) (*flowRuns, error) {
-	query := graphql.NewRequest(queryString)
-
-	// run it and capture the response
-	var respData flowRuns
-	if err := d.client.Run(context.Background(), query, &respData); err != nil {
-		return nil, errors.Wrap(err, "failed to fetch running flows")
-	}
-	return &respData, nil
-}
-
-type flowResponse struct {
-	Flow []struct {
-		VersionGroupID string `json:"version_group_id"`
-	} `json:"flow"`
-}
-type flowSubmissionResponse struct {
-	CreateFlowRun struct {
-		ID string
-	} `json:"create_flow_run"`
-}
-
-// Submits a flow run request to prefect.
-func (d *DataPipelineRunner) submitFlowRunRequest(request *KeyedEnqueueRequestData, labels []string) (string, error) {
-	// compose the run name
-	runName := fmt.Sprintf("%s:%s", request.ModelID, request.RunID)
-
-	query := graphql.NewRequest(fmt.Sprintf(`
-		query {
-			flow(where: {
-				_and: [
-					{name: { _eq: "%s"}},
-					{ project: { name: { _eq: "%s"}}}
-				]
-			}) {
-				version_group_id
-			}
-		}
-	`, d.Environment.DataPipelineFlowName, d.Environment.DataPipelineProjectName))
-
-	var resData flowResponse
-	// run it and capture the response
-	if err := d.client.Run(context.Background(), query, &resData); err != nil {
-		return "", errors.Wrap(err, "failed to fetch flow information")
-	}
-
-	if len(resData.Flow) == 0 {
-		return "", fmt.Errorf("flow, '%s' with project, '%s', does not exist", d.Environment.DataPipelineFlowName, d.Environment.DataPipelineProjectName)
-	}
-
-	flowVersionGroupID := resData.Flow[0].VersionGroupID
-
-	// prefect server expects JSON to be escaped and without newlines/tabs
-	buffer := bytes.Buffer{}
-	if err := json.Compact(&buffer, request.RequestData); err != nil {
-		return "", errors.Wrap(err, "failed to compact request JSON")
-	}
-	escaped := strings.ReplaceAll(buffer.String(), `"`, `\"`)
-
-	// Define a task submission query
-	// ** NOTE: Using a GraphQL variable for the `parameters` field generates an error on the server,
-	// and the same error can be replicated through the Prefect "Interactive API" in the UI.  It seems
-	// to a bug in how the prefect server parses the JSON stored in the parameters string.  For now the
-	// best we can do is include the JSON through string formatting.
-	requestStr := fmt.Sprintf("mutation($id: String, $runName: String, $labels: [String!], $key: String) {"+
-		"create_flow_run(input: { "+
-		"   idempotency_key: $key, "+
-		"	version_group_id: $id, "+
-		"	flow_run_name: $runName, "+
-		"	labels: $labels, "+
-		"	parameters: \"%s\""+
-		"}) { "+
-		"	id "+
-		"}"+
-		"}", escaped)
-
-	mutation := graphql.NewRequest(requestStr)
-
-	mutation.Var("id", flowVersionGroupID)
-	mutation.Var("runName", runName)
-	if len(request.Labels) > 0 {
-		mutation.Var("labels", request.Labels)
-	} else if len(labels) > 0 {
-		mutation.Var("labels", labels)
-	}
-
-	// set the key to use for prefect's idempotency checks - if a pipeline is run to completion,
-	// SUCESSFULLY or UNSUCESSFULLY, an attempt to re-run with the same key will result in it being
-	// skipped.
-	if config.UsePrefectIdempotency(d.Environment.DataPipelineIdempotencyChecks) {
-		idempotencyKey := strconv.FormatUint(uint64(request.RequestKey), 16)
-		mutation.Var("key", idempotencyKey)
-	}
-
-	var respData flowSubmissionResponse
-	// run it and capture the response
-	if err := d.client.Run(context.Background(), mutation, &respData); err != nil {
-		return respData.CreateFlowRun.ID, errors.Wrap(err, "failed to run flow")
+// transitionJob moves a job to a new state, logging any failure.
+func (d *DataPipelineRunner) transitionJob(request EnqueueRequestData, state string, flowID string, reason string) {
+	if err := d.jobs.Transition(request, state, flowID, reason); err != nil {
+		d.Logger.Warn(err)
 	}
-	return respData.CreateFlowRun.ID, nil
 }
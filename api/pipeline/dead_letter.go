@@ -0,0 +1,181 @@
+package pipeline
+
+import (
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FailureRecord describes a single failed attempt to run a request.
+type FailureRecord struct {
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// DeadLetterEntry holds the failure history of a request.  Once a request has failed the maximum
+// number of times it is dead lettered, and is no longer submitted until it is requeued.
+type DeadLetterEntry struct {
+	Request        EnqueueRequestData `json:"request"`
+	Labels         []string           `json:"labels"`
+	Failures       []FailureRecord    `json:"failures"`
+	Dead           bool               `json:"dead"`
+	DeadLetteredAt time.Time          `json:"dead_lettered_at"`
+}
+
+// DeadLetterStore tracks failed submissions and failed flow runs by run ID, and holds requests that
+// have failed too many times.  The store is persisted to disk on every change.
+type DeadLetterStore struct {
+	path        string
+	maxFailures int
+	entries     map[string]*DeadLetterEntry
+	mutex       *sync.RWMutex
+}
+
+// NewDeadLetterStore creates a dead letter store persisted to `<name>.json` in `dir`, reloading any
+// existing entries.  Requests are dead lettered after `maxFailures` failures.
+func NewDeadLetterStore(dir string, name string, maxFailures int) (*DeadLetterStore, error) {
+	store := &DeadLetterStore{
+		path:        path.Join(dir, name+".json"),
+		maxFailures: maxFailures,
+		entries:     map[string]*DeadLetterEntry{},
+		mutex:       &sync.RWMutex{},
+	}
+	if err := readJSONFile(store.path, &store.entries); err != nil {
+		return nil, errors.Wrap(err, "failed to load dead letter store")
+	}
+	return store, nil
+}
+
+// RecordFailure adds a failure to the history of a request, and returns true if the request has
+// now been dead lettered.
+func (s *DeadLetterStore) RecordFailure(request EnqueueRequestData, labels []string, reason string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[request.RunID]
+	if !ok {
+		entry = &DeadLetterEntry{Failures: []FailureRecord{}}
+		s.entries[request.RunID] = entry
+	}
+	now := time.Now()
+	entry.Request = request
+	entry.Labels = labels
+	entry.Failures = append(entry.Failures, FailureRecord{Reason: reason, Time: now})
+	if len(entry.Failures) >= s.maxFailures && !entry.Dead {
+		entry.Dead = true
+		entry.DeadLetteredAt = now
+	}
+	return entry.Dead, s.save()
+}
+
+// DeadLetter adds a final failure to the history of a request and dead letters it, however many
+// times it has failed.
+func (s *DeadLetterStore) DeadLetter(request EnqueueRequestData, labels []string, reason string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[request.RunID]
+	if !ok {
+		entry = &DeadLetterEntry{Failures: []FailureRecord{}}
+		s.entries[request.RunID] = entry
+	}
+	now := time.Now()
+	entry.Request = request
+	entry.Labels = labels
+	entry.Failures = append(entry.Failures, FailureRecord{Reason: reason, Time: now})
+	if !entry.Dead {
+		entry.Dead = true
+		entry.DeadLetteredAt = now
+	}
+	return s.save()
+}
+
+// Resolve discards the failure history of a request that has completed successfully.
+func (s *DeadLetterStore) Resolve(runID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.entries[runID]; !ok {
+		return nil
+	}
+	delete(s.entries, runID)
+	return s.save()
+}
+
+// Discard drops the failure history of a request that ended without being dead lettered, such as
+// one that was cancelled or ran out of retries, so that its failures don't count toward dead
+// lettering a later resubmission with the same run ID.  Dead lettered requests are kept.
+func (s *DeadLetterStore) Discard(runID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[runID]
+	if !ok || entry.Dead {
+		return nil
+	}
+	delete(s.entries, runID)
+	return s.save()
+}
+
+// List returns the dead lettered requests, oldest first.
+func (s *DeadLetterStore) List() []DeadLetterEntry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := []DeadLetterEntry{}
+	for _, entry := range s.entries {
+		if entry.Dead {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeadLetteredAt.Before(entries[j].DeadLetteredAt)
+	})
+	return entries
+}
+
+// Get returns the dead lettered request with the supplied run ID.
+func (s *DeadLetterStore) Get(runID string) (DeadLetterEntry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entry, ok := s.entries[runID]
+	if !ok || !entry.Dead {
+		return DeadLetterEntry{}, false
+	}
+	return *entry, true
+}
+
+// Remove deletes the dead lettered request with the supplied run ID, returning false if
+// there is no such request.
+func (s *DeadLetterStore) Remove(runID string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[runID]
+	if !ok || !entry.Dead {
+		return false, nil
+	}
+	delete(s.entries, runID)
+	return true, s.save()
+}
+
+// Purge deletes all dead lettered requests.
+func (s *DeadLetterStore) Purge() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for runID, entry := range s.entries {
+		if entry.Dead {
+			delete(s.entries, runID)
+		}
+	}
+	return s.save()
+}
+
+func (s *DeadLetterStore) save() error {
+	return errors.Wrap(writeJSONFile(s.path, s.entries), "failed to save dead letter store")
+}
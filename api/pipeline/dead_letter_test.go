@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterRecordFailure(t *testing.T) {
+	dir := path.Join("test_data", "dl1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	store, err := NewDeadLetterStore(dir, "dead_letter", 2)
+	assert.NoError(t, err)
+
+	request := EnqueueRequestData{ModelID: "model", RunID: "run1", RequestData: []byte(`{"run_id":"run1"}`)}
+	dead, err := store.RecordFailure(request, []string{"label"}, "first")
+	assert.NoError(t, err)
+	assert.False(t, dead)
+	assert.Empty(t, store.List())
+	_, ok := store.Get("run1")
+	assert.False(t, ok)
+
+	dead, err = store.RecordFailure(request, []string{"label"}, "second")
+	assert.NoError(t, err)
+	assert.True(t, dead)
+
+	// failures for a request that succeeds are discarded
+	other := EnqueueRequestData{ModelID: "model", RunID: "run2"}
+	_, _ = store.RecordFailure(other, nil, "first")
+	err = store.Resolve("run2")
+	assert.NoError(t, err)
+
+	// as are those for a request that ends without being dead lettered, but dead letters are kept
+	_, _ = store.RecordFailure(EnqueueRequestData{RunID: "run3"}, nil, "first")
+	err = store.Discard("run3")
+	assert.NoError(t, err)
+	err = store.Discard("run1")
+	assert.NoError(t, err)
+
+	// entries survive a reload
+	store, err = NewDeadLetterStore(dir, "dead_letter", 2)
+	assert.NoError(t, err)
+	entries := store.List()
+	assert.Len(t, entries, 1)
+	entry, ok := store.Get("run1")
+	assert.True(t, ok)
+	assert.Equal(t, request, entry.Request)
+	assert.Equal(t, []string{"label"}, entry.Labels)
+	assert.Len(t, entry.Failures, 2)
+	assert.Equal(t, "second", entry.Failures[1].Reason)
+
+	dead, err = store.RecordFailure(other, nil, "first")
+	assert.NoError(t, err)
+	assert.False(t, dead)
+	dead, err = store.RecordFailure(EnqueueRequestData{RunID: "run3"}, nil, "second")
+	assert.NoError(t, err)
+	assert.False(t, dead)
+
+	found, err := store.Remove("run1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = store.Remove("run1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestDeadLetterPurge(t *testing.T) {
+	dir := path.Join("test_data", "dl2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	store, err := NewDeadLetterStore(dir, "dead_letter", 1)
+	assert.NoError(t, err)
+	_, _ = store.RecordFailure(EnqueueRequestData{RunID: "run1"}, nil, "failed")
+	_, _ = store.RecordFailure(EnqueueRequestData{RunID: "run2"}, nil, "failed")
+	assert.Len(t, store.List(), 2)
+
+	err = store.Purge()
+	assert.NoError(t, err)
+	assert.Empty(t, store.List())
+}
@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// typicalRunSample is the number of recent finished flow runs used to estimate how long a flow
+// run takes.
+const typicalRunSample = 100
+
+// TypicalRunDuration returns the median duration of the most recent flow runs in the history,
+// or false if no finished job had a flow run.
+func (s *HistoryStore) TypicalRunDuration() (time.Duration, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	durations := []time.Duration{}
+	for i := len(s.records) - 1; i >= 0 && len(durations) < typicalRunSample; i-- {
+		record := s.records[i]
+		if !record.SubmittedAt.IsZero() {
+			durations = append(durations, record.FinishedAt.Sub(record.SubmittedAt))
+		}
+	}
+	if len(durations) == 0 {
+		return 0, false
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2], true
+}
+
+// FlowStartTimes returns the time each tracked flow run was submitted.
+func (d *DataPipelineRunner) FlowStartTimes() []time.Time {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	times := make([]time.Time, 0, len(d.currentFlowIDs))
+	for _, flow := range d.currentFlowIDs {
+		times = append(times, flow.StartTime)
+	}
+	return times
+}
+
+// EstimateDispatchTimes estimates when each of `queued` jobs will be dispatched, in queue order.
+// Each of the `parallelism` slots is taken by a flow run until it has run for `runDuration`, and
+// queued jobs take the earliest free slot in turn.  Flow runs that have taken longer than
+// expected are assumed to be about to finish.  If `resumeAt` is given it is used to push dispatches
+// past maintenance windows, and the estimates stop short at the first dispatch it can't place.
+func EstimateDispatchTimes(now time.Time, queued int, running []time.Time, parallelism int, runDuration time.Duration, resumeAt func(time.Time) time.Time) []time.Time {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	finishes := make([]time.Time, 0, len(running))
+	for _, started := range running {
+		finish := started.Add(runDuration)
+		if finish.Before(now) {
+			finish = now
+		}
+		finishes = append(finishes, finish)
+	}
+	sort.Slice(finishes, func(i, j int) bool { return finishes[i].Before(finishes[j]) })
+	// when more flows are running than there are slots, a slot is only freed for queued jobs once
+	// enough of them have finished, so the slots are held by the flows that finish last
+	if len(finishes) > parallelism {
+		finishes = finishes[len(finishes)-parallelism:]
+	}
+	slots := slotHeap(finishes)
+	for len(slots) < parallelism {
+		slots = append(slots, now)
+	}
+	heap.Init(&slots)
+
+	estimates := make([]time.Time, 0, queued)
+	for i := 0; i < queued; i++ {
+		free := heap.Pop(&slots).(time.Time)
+		if resumeAt != nil {
+			if free = resumeAt(free); free.IsZero() {
+				break
+			}
+		}
+		estimates = append(estimates, free)
+		heap.Push(&slots, free.Add(runDuration))
+	}
+	return estimates
+}
+
+// slotHeap orders the times dispatch slots become free, earliest first.
+type slotHeap []time.Time
+
+func (h slotHeap) Len() int            { return len(h) }
+func (h slotHeap) Less(i, j int) bool  { return h[i].Before(h[j]) }
+func (h slotHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slotHeap) Push(x interface{}) { *h = append(*h, x.(time.Time)) }
+func (h *slotHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateDispatchTimes(t *testing.T) {
+	now := time.Now()
+	minutes := func(times []time.Time) []float64 {
+		offsets := []float64{}
+		for _, estimate := range times {
+			offsets = append(offsets, estimate.Sub(now).Minutes())
+		}
+		return offsets
+	}
+
+	// free slots are used straight away, then jobs wait for the flow ahead of them
+	assert.Equal(t, []float64{0, 0, 10, 10, 20}, minutes(EstimateDispatchTimes(now, 5, nil, 2, 10*time.Minute, nil)))
+
+	// running flows hold their slot until they are expected to finish, and overdue flows are
+	// expected to finish now
+	running := []time.Time{now.Add(-4 * time.Minute), now.Add(-20 * time.Minute)}
+	assert.Equal(t, []float64{0, 6, 10}, minutes(EstimateDispatchTimes(now, 3, running, 2, 10*time.Minute, nil)))
+
+	// when more flows are running than there are slots, a queued job waits for enough of them
+	// to finish
+	running = []time.Time{now.Add(-8 * time.Minute), now.Add(-5 * time.Minute), now.Add(-2 * time.Minute)}
+	assert.Equal(t, []float64{5, 8, 15}, minutes(EstimateDispatchTimes(now, 3, running, 2, 10*time.Minute, nil)))
+
+	// nothing is dispatched during a maintenance window, and jobs can't be placed past a window
+	// that doesn't end
+	windowStart := now.Add(5 * time.Minute)
+	windowEnd := now.Add(15 * time.Minute)
+	resumeAt := func(t time.Time) time.Time {
+		if !t.Before(windowStart) && t.Before(windowEnd) {
+			return windowEnd
+		}
+		return t
+	}
+	assert.Equal(t, []float64{0, 0, 15, 15, 25}, minutes(EstimateDispatchTimes(now, 5, nil, 2, 10*time.Minute, resumeAt)))
+	windowEnd = time.Time{}
+	resumeAt = func(t time.Time) time.Time {
+		if !t.Before(windowStart) {
+			return windowEnd
+		}
+		return t
+	}
+	assert.Equal(t, []float64{0, 0}, minutes(EstimateDispatchTimes(now, 5, nil, 2, 10*time.Minute, resumeAt)))
+}
+
+func TestTypicalRunDuration(t *testing.T) {
+	history := &HistoryStore{records: []*HistoryRecord{}, mutex: &sync.RWMutex{}}
+	_, ok := history.TypicalRunDuration()
+	assert.False(t, ok)
+
+	now := time.Now()
+	for _, duration := range []time.Duration{time.Minute, 3 * time.Minute, 2 * time.Minute} {
+		history.records = append(history.records, &HistoryRecord{SubmittedAt: now.Add(-duration), FinishedAt: now})
+	}
+	// jobs that were never submitted are ignored
+	history.records = append(history.records, &HistoryRecord{FinishedAt: now})
+	duration, ok := history.TypicalRunDuration()
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, duration)
+}
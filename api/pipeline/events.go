@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"time"
+)
+
+// Job lifecycle events that subscribers can be notified of.
+const (
+	// EventEnqueued is sent when a request is accepted into the queue
+	EventEnqueued = "enqueued"
+	// EventDispatched is sent when a flow run is started for a queued request
+	EventDispatched = "dispatched"
+	// EventSucceeded is sent when a flow run succeeds
+	EventSucceeded = "succeeded"
+	// EventFailed is sent when a request will not be run to completion, because its flow run
+	// failed with no retries left, it was cancelled, or it could not be submitted
+	EventFailed = "failed"
+	// EventRetried is sent when a failed flow run is scheduled to be retried
+	EventRetried = "retried"
+)
+
+// Events lists every job lifecycle event.
+var Events = []string{EventEnqueued, EventDispatched, EventSucceeded, EventFailed, EventRetried}
+
+// JobEvent describes a change in the lifecycle of a request.
+type JobEvent struct {
+	Event   string
+	Time    time.Time
+	Request EnqueueRequestData
+	// FlowID is the ID of the flow run the event is about, if there is one.
+	FlowID string
+	// State is the state the flow run finished in, for failed events.
+	State string
+	// EnqueuedAt is when the request was last added to the queue, if known.
+	EnqueuedAt time.Time
+	// SubmittedAt is when the request's flow run was submitted, if it has one.
+	SubmittedAt time.Time
+	// AgentID identifies the agent that ran the flow run, for finished flow runs.
+	AgentID string
+	// Retries is the number of times the request has been retried.
+	Retries int
+}
+
+// NewJobEvent creates an event about a request that happens now.
+func NewJobEvent(event string, request EnqueueRequestData) JobEvent {
+	return JobEvent{Event: event, Time: time.Now(), Request: request}
+}
+
+// Notifier publishes job lifecycle events to subscribers.
+type Notifier interface {
+	Notify(event JobEvent)
+}
+
+// Notifiers publishes events to each of a set of notifiers in turn.
+type Notifiers []Notifier
+
+// Notify publishes an event to each notifier.
+func (n Notifiers) Notify(event JobEvent) {
+	for _, notifier := range n {
+		notifier.Notify(event)
+	}
+}
@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Flow run states reported by an executor.  Executors that use different names for their states
+// map them to these.
+const (
+	StateSubmitted = "Submitted"
+	StateScheduled = "Scheduled"
+	StateRunning   = "Running"
+	StateSuccess   = "Success"
+	StateFailed    = "Failed"
+	StateCancelled = "Cancelled"
+)
+
+// Agent is a worker that an executor dispatches flow runs to.  Flow runs are sent to an agent by
+// submitting them with its labels.
+type Agent struct {
+	ID     string
+	Name   string
+	Labels []string
+}
+
+// FlowRun is a run of the data pipeline flow in an executor.
+type FlowRun struct {
+	ID         string
+	Name       string
+	State      string
+	Created    time.Time
+	Parameters json.RawMessage
+	AgentID    string
+}
+
+// Executor runs the data pipeline flow for dequeued requests, and reports on the flow runs it
+// has started.
+type Executor interface {
+	// Submit starts a flow run for the request using the supplied agent labels, and returns the
+	// ID of the flow run.
+	Submit(request *KeyedEnqueueRequestData, labels []string) (string, error)
+	// FlowRuns returns the flow runs with the supplied IDs.  Unknown IDs are left out.
+	FlowRuns(ids []string) ([]FlowRun, error)
+	// ActiveFlowRuns returns the flow runs that are submitted, scheduled or running.
+	ActiveFlowRuns() ([]FlowRun, error)
+	// Agents returns the agents that flow runs can be dispatched to.
+	Agents() ([]Agent, error)
+	// Cancel stops a flow run.
+	Cancel(flowID string) error
+}
+
+// FlowChecker is implemented by executors that can confirm that the flow they start runs of
+// exists, without starting one.
+type FlowChecker interface {
+	CheckFlow() error
+}
@@ -0,0 +1,81 @@
+package fakeprefect
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Notification is a pipeline reporting request received by the fake causemos.
+type Notification struct {
+	// Endpoint is the last element of the request path (ie. "processing-succeeded")
+	Endpoint string
+	Payload  map[string]interface{}
+	Username string
+	Password string
+}
+
+// Causemos answers the causemos pipeline reporting endpoints, recording each notification.
+type Causemos struct {
+	*httptest.Server
+	mutex         sync.Mutex
+	notifications []Notification
+	status        int
+}
+
+// NewCausemos starts a fake causemos that accepts all notifications.
+func NewCausemos() *Causemos {
+	c := &Causemos{status: http.StatusOK}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.handle))
+	return c
+}
+
+// RespondWith sets the status code returned for notifications, to simulate causemos failures.
+// Notifications are still recorded.
+func (c *Causemos) RespondWith(status int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status = status
+}
+
+// Notifications returns the notifications received, in the order they were received.
+func (c *Causemos) Notifications() []Notification {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Notification{}, c.notifications...)
+}
+
+// NotificationsFor returns the notifications received for a run ID, in the order they were received.
+func (c *Causemos) NotificationsFor(runID string) []Notification {
+	notifications := []Notification{}
+	for _, notification := range c.Notifications() {
+		if notification.Payload["run_id"] == runID {
+			notifications = append(notifications, notification)
+		}
+	}
+	return notifications
+}
+
+func (c *Causemos) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.URL.Path, "/api/maas/pipeline-reporting/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	notification := Notification{Endpoint: path.Base(r.URL.Path)}
+	if err := json.NewDecoder(r.Body).Decode(&notification.Payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notification.Username, notification.Password, _ = r.BasicAuth()
+
+	c.mutex.Lock()
+	c.notifications = append(c.notifications, notification)
+	status := c.status
+	c.mutex.Unlock()
+
+	w.WriteHeader(status)
+}
@@ -0,0 +1,337 @@
+// Package fakeprefect provides in-process stand-ins for the prefect server GraphQL API and the
+// causemos pipeline reporting API, so that the data pipeline runner can be tested end to end.
+package fakeprefect
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default states that a flow run steps through as it is advanced.
+var defaultScript = []string{"Scheduled", "Running", "Success"}
+
+// Flow run states that prefect reports as active.
+var activeStates = map[string]bool{"Submitted": true, "Scheduled": true, "Running": true}
+
+var (
+	parametersPattern = regexp.MustCompile(`parameters: "((?:[^"\\]|\\.)*)"`)
+	idListPattern     = regexp.MustCompile(`_in: (\[[^\]]*\])`)
+	ignoredPattern    = regexp.MustCompile(`_contains: "([^"]*)"`)
+)
+
+// Agent is a prefect agent.
+type Agent struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+// FlowRun is a flow run created through the fake server.
+type FlowRun struct {
+	ID             string          `json:"id"`
+	Name           string          `json:"name"`
+	State          string          `json:"state"`
+	Created        time.Time       `json:"created"`
+	Parameters     json.RawMessage `json:"parameters"`
+	Labels         []string        `json:"-"`
+	IdempotencyKey string          `json:"-"`
+	Agent          *Agent          `json:"agent"`
+	script         []string
+	step           int
+}
+
+// Server answers the agent, flow, flow_run, create_flow_run and cancel_flow_run operations of the
+// prefect server GraphQL API for a single flow.  Flow runs step through a script of states each
+// time they are advanced, which defaults to Scheduled, Running, Success.
+type Server struct {
+	*httptest.Server
+	flowName       string
+	projectName    string
+	mutex          sync.Mutex
+	agents         []Agent
+	runs           []*FlowRun
+	scripts        map[string][]string
+	advanceOnPoll  bool
+	nextID         int
+	versionGroupID string
+}
+
+// NewServer starts a fake prefect server with a flow of the given name in the given project.
+func NewServer(flowName string, projectName string) *Server {
+	s := &Server{
+		flowName:       flowName,
+		projectName:    projectName,
+		scripts:        map[string][]string{},
+		versionGroupID: "version-group-1",
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// AddAgent registers an agent with the given labels.  Running flow runs are assigned to the first
+// agent that has all of their labels.
+func (s *Server) AddAgent(id string, name string, labels ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.agents = append(s.agents, Agent{ID: id, Name: name, Labels: labels})
+}
+
+// Script sets the states that flow runs with the given name (ie. "model_id:run_id") step through.
+func (s *Server) Script(runName string, states ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scripts[runName] = states
+}
+
+// AdvanceOnPoll sets whether flow runs are advanced each time their states are queried, so that
+// runs progress without the test advancing them.
+func (s *Server) AdvanceOnPoll(advance bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.advanceOnPoll = advance
+}
+
+// Advance moves each flow run to the next state in its script.
+func (s *Server) Advance() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.advance()
+}
+
+func (s *Server) advance() {
+	for _, run := range s.runs {
+		if run.step+1 < len(run.script) && activeStates[run.State] {
+			run.step++
+			s.setState(run, run.script[run.step])
+		}
+	}
+}
+
+// SetState sets the state of a flow run, regardless of its script.
+func (s *Server) SetState(flowID string, state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, run := range s.runs {
+		if run.ID == flowID {
+			s.setState(run, state)
+		}
+	}
+}
+
+func (s *Server) setState(run *FlowRun, state string) {
+	run.State = state
+	if state == "Running" && run.Agent == nil {
+		run.Agent = s.agentFor(run.Labels)
+	}
+}
+
+// Returns the first agent with all of the labels.
+func (s *Server) agentFor(labels []string) *Agent {
+	for i, agent := range s.agents {
+		if containsAll(agent.Labels, labels) {
+			return &s.agents[i]
+		}
+	}
+	return nil
+}
+
+// FlowRuns returns copies of the flow runs that have been created, in the order they were created.
+func (s *Server) FlowRuns() []FlowRun {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	runs := make([]FlowRun, len(s.runs))
+	for i, run := range s.runs {
+		runs[i] = *run
+	}
+	return runs
+}
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type graphQLError struct {
+	Message string `json:"message"`
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	var request graphQLRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	data, err := s.run(request)
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []graphQLError{{Message: err.Error()}}})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+// Runs an operation, identified by the root field of the query.
+func (s *Server) run(request graphQLRequest) (interface{}, error) {
+	query := request.Query
+	switch {
+	case strings.Contains(query, "create_flow_run"):
+		return s.createFlowRun(query, request.Variables)
+	case strings.Contains(query, "cancel_flow_run"):
+		return s.cancelFlowRun(request.Variables)
+	case strings.Contains(query, "flow_run("):
+		return s.flowRuns(query)
+	case strings.Contains(query, "flow("):
+		return s.flows(query)
+	case strings.Contains(query, "agent("):
+		return s.agentsQuery(query)
+	}
+	return nil, fmt.Errorf("unsupported operation: %s", query)
+}
+
+func (s *Server) isFlowQuery(query string) bool {
+	return strings.Contains(query, fmt.Sprintf(`"%s"`, s.flowName)) && strings.Contains(query, fmt.Sprintf(`"%s"`, s.projectName))
+}
+
+func (s *Server) flows(query string) (interface{}, error) {
+	flows := []map[string]string{}
+	if s.isFlowQuery(query) {
+		flows = append(flows, map[string]string{"version_group_id": s.versionGroupID})
+	}
+	return map[string]interface{}{"flow": flows}, nil
+}
+
+func (s *Server) agentsQuery(query string) (interface{}, error) {
+	ignored := ""
+	if match := ignoredPattern.FindStringSubmatch(query); match != nil {
+		ignored = match[1]
+	}
+	agents := []Agent{}
+	for _, agent := range s.agents {
+		if ignored == "" || !containsAll(agent.Labels, []string{ignored}) {
+			agents = append(agents, agent)
+		}
+	}
+	return map[string]interface{}{"agent": agents}, nil
+}
+
+func (s *Server) flowRuns(query string) (interface{}, error) {
+	if s.advanceOnPoll {
+		s.advance()
+	}
+
+	runs := []FlowRun{}
+	if !s.isFlowQuery(query) {
+		return map[string]interface{}{"flow_run": runs}, nil
+	}
+
+	if match := idListPattern.FindStringSubmatch(query); match != nil {
+		var ids []string
+		if err := json.Unmarshal([]byte(match[1]), &ids); err != nil {
+			return nil, fmt.Errorf("invalid id list: %s", match[1])
+		}
+		for _, run := range s.runs {
+			if containsAll(ids, []string{run.ID}) {
+				runs = append(runs, *run)
+			}
+		}
+	} else {
+		for _, run := range s.runs {
+			if activeStates[run.State] {
+				runs = append(runs, *run)
+			}
+		}
+	}
+	return map[string]interface{}{"flow_run": runs}, nil
+}
+
+func (s *Server) createFlowRun(query string, variables map[string]interface{}) (interface{}, error) {
+	if variables["id"] != s.versionGroupID {
+		return nil, fmt.Errorf("unknown version group: %v", variables["id"])
+	}
+	match := parametersPattern.FindStringSubmatch(query)
+	if match == nil {
+		return nil, fmt.Errorf("missing parameters")
+	}
+	parameters := strings.ReplaceAll(match[1], `\"`, `"`)
+	if !json.Valid([]byte(parameters)) {
+		return nil, fmt.Errorf("invalid parameters: %s", parameters)
+	}
+
+	// a run with the same idempotency key is returned rather than creating another
+	key, _ := variables["key"].(string)
+	if key != "" {
+		for _, run := range s.runs {
+			if run.IdempotencyKey == key {
+				return createFlowRunResponse(run.ID), nil
+			}
+		}
+	}
+
+	name, _ := variables["runName"].(string)
+	var labels []string
+	if values, ok := variables["labels"].([]interface{}); ok {
+		for _, value := range values {
+			labels = append(labels, fmt.Sprint(value))
+		}
+	}
+
+	script := defaultScript
+	if custom, ok := s.scripts[name]; ok {
+		script = custom
+	}
+
+	s.nextID++
+	run := &FlowRun{
+		ID:             fmt.Sprintf("flow-run-%d", s.nextID),
+		Name:           name,
+		Created:        time.Now(),
+		Parameters:     json.RawMessage(parameters),
+		Labels:         labels,
+		IdempotencyKey: key,
+		script:         script,
+	}
+	s.setState(run, script[0])
+	s.runs = append(s.runs, run)
+	return createFlowRunResponse(run.ID), nil
+}
+
+func createFlowRunResponse(id string) interface{} {
+	return map[string]interface{}{"create_flow_run": map[string]string{"id": id}}
+}
+
+func (s *Server) cancelFlowRun(variables map[string]interface{}) (interface{}, error) {
+	for _, run := range s.runs {
+		if run.ID == variables["id"] {
+			s.setState(run, "Cancelled")
+			return map[string]interface{}{"cancel_flow_run": map[string]string{"state": run.State}}, nil
+		}
+	}
+	return nil, fmt.Errorf("flow run not found: %v", variables["id"])
+}
+
+// Returns true if all of the values are in the set.
+func containsAll(set []string, values []string) bool {
+	for _, value := range values {
+		found := false
+		for _, member := range set {
+			if member == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
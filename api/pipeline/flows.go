@@ -0,0 +1,41 @@
+package pipeline
+
+import (
+	"github.com/pkg/errors"
+)
+
+// loadTrackedFlows reads the flows that were being tracked when the service last stopped, so that
+// causemos is still notified when they complete.
+func loadTrackedFlows(path string) (map[string]FlowData, error) {
+	flows := map[string]FlowData{}
+	if err := readJSONFile(path, &flows); err != nil {
+		return nil, errors.Wrap(err, "failed to load tracked flows")
+	}
+	return flows, nil
+}
+
+// saveTrackedFlows persists the flows currently being tracked.  The caller must not hold the
+// runner's mutex.
+func (d *DataPipelineRunner) saveTrackedFlows() {
+	// saves are serialized so that an older copy of the flows never overwrites a newer one
+	d.persistMutex.Lock()
+	defer d.persistMutex.Unlock()
+
+	d.mutex.RLock()
+	flows := make(map[string]FlowData, len(d.currentFlowIDs))
+	for flowID, flow := range d.currentFlowIDs {
+		flows[flowID] = flow
+	}
+	d.mutex.RUnlock()
+
+	if err := writeJSONFile(d.flowsPath, flows); err != nil {
+		d.Logger.Error(errors.Wrap(err, "failed to save tracked flows"))
+	}
+}
+
+// TrackedFlowCount returns the number of submitted flows that have not yet finished.
+func (d *DataPipelineRunner) TrackedFlowCount() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return len(d.currentFlowIDs)
+}
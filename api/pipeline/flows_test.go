@@ -0,0 +1,48 @@
+package pipeline
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func TestTrackedFlowsReload(t *testing.T) {
+	dir := path.Join("test_data", "flows1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+	flowsPath := path.Join(dir, "current_flows.json")
+
+	// nothing to load on first start
+	flows, err := loadTrackedFlows(flowsPath)
+	assert.NoError(t, err)
+	assert.Empty(t, flows)
+
+	startTime := time.Now().Round(time.Millisecond)
+	runner := &DataPipelineRunner{
+		Config:         config.Config{Logger: zap.NewNop().Sugar()},
+		mutex:          &sync.RWMutex{},
+		currentFlowIDs: map[string]FlowData{},
+		flowsPath:      flowsPath,
+	}
+	runner.currentFlowIDs["flow1"] = FlowData{
+		Request:   EnqueueRequestData{ModelID: "model", RunID: "run1", RequestData: []byte(`{"run_id":"run1"}`)},
+		StartTime: startTime,
+	}
+	runner.saveTrackedFlows()
+	assert.Equal(t, 1, runner.TrackedFlowCount())
+
+	flows, err = loadTrackedFlows(flowsPath)
+	assert.NoError(t, err)
+	assert.Len(t, flows, 1)
+	assert.Equal(t, "run1", flows["flow1"].Request.RunID)
+	assert.Equal(t, []byte(`{"run_id":"run1"}`), flows["flow1"].Request.RequestData)
+	assert.True(t, startTime.Equal(flows["flow1"].StartTime))
+}
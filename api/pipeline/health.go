@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// Dependencies checked for readiness.
+const (
+	// CheckExecutor confirms the executor's API, ie. prefect graphql, responds
+	CheckExecutor = "executor"
+	// CheckFlow confirms the configured flow and project, or deployment, exists
+	CheckFlow = "flow"
+	// CheckCausemos confirms causemos is reachable
+	CheckCausemos = "causemos"
+	// CheckQueueStorage confirms the queue directory is writable
+	CheckQueueStorage = "queue_storage"
+)
+
+// HealthCheck checks that a dependency is available.
+type HealthCheck struct {
+	Name string
+	// Critical checks make the service unready when they fail.  Other checks are only reported.
+	Critical bool
+	Check    func() error
+}
+
+// HealthResult is the outcome of a health check.
+type HealthResult struct {
+	Name       string  `json:"name"`
+	Healthy    bool    `json:"healthy"`
+	Critical   bool    `json:"critical"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// NewHealthChecks creates the readiness checks for the configured dependencies.  The executor,
+// its flow and the queue directory are critical.  Causemos isn't, since notifications wait in the
+// outbox until it's reachable again, and it's only checked when an address is configured.
+func NewHealthChecks(env *config.Environment, executor Executor) []HealthCheck {
+	checks := []HealthCheck{
+		{
+			Name:     CheckExecutor,
+			Critical: true,
+			Check: func() error {
+				_, err := executor.Agents()
+				return err
+			},
+		},
+	}
+	if checker, ok := executor.(FlowChecker); ok {
+		checks = append(checks, HealthCheck{Name: CheckFlow, Critical: true, Check: checker.CheckFlow})
+	}
+	if env.CausemosAddr != "" {
+		// standard http client with our timeout
+		httpClient := &http.Client{Timeout: time.Second * time.Duration(env.DataPipelineTimeoutSec)}
+		checks = append(checks, HealthCheck{
+			Name:  CheckCausemos,
+			Check: func() error { return checkReachable(httpClient, env.CausemosAddr) },
+		})
+	}
+	checks = append(checks, HealthCheck{
+		Name:     CheckQueueStorage,
+		Critical: true,
+		Check:    func() error { return checkWritable(env.DataPipelineQueueDir) },
+	})
+	return checks
+}
+
+// RunHealthChecks runs the checks concurrently, returning their results in order and whether
+// every critical check passed.
+func RunHealthChecks(checks []HealthCheck) ([]HealthResult, bool) {
+	results := make([]HealthResult, len(checks))
+	wg := sync.WaitGroup{}
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := check.Check()
+			results[i] = HealthResult{
+				Name:       check.Name,
+				Healthy:    err == nil,
+				Critical:   check.Critical,
+				DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, result := range results {
+		if result.Critical && !result.Healthy {
+			ready = false
+		}
+	}
+	return results, ready
+}
+
+// checkReachable returns an error if the address doesn't respond, or responds with a server error.
+func checkReachable(client *http.Client, addr string) error {
+	resp, err := client.Get(addr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.Errorf("response %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkWritable returns an error if a file can't be created in the directory.
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create file in queue directory")
+	}
+	name := file.Name()
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close file in queue directory")
+	}
+	return errors.Wrap(os.Remove(name), "failed to remove file from queue directory")
+}
@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+func TestHealthChecks(t *testing.T) {
+	queueDir := "test_data/health"
+	assert.NoError(t, os.MkdirAll(queueDir, 0755))
+	t.Cleanup(func() { _ = os.RemoveAll("test_data") })
+
+	flowExists := atomic.Bool{}
+	flowExists.Store(true)
+	prefect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query string `json:"query"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(body.Query, "agent(") {
+			_, _ = w.Write([]byte(`{"data": {"agent": []}}`))
+			return
+		}
+		if flowExists.Load() {
+			_, _ = w.Write([]byte(`{"data": {"flow": [{"version_group_id": "group1"}]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": {"flow": []}}`))
+	}))
+	defer prefect.Close()
+	causemos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer causemos.Close()
+
+	env := &config.Environment{
+		DataPipelineAddr:     prefect.URL,
+		DataPipelineQueueDir: queueDir,
+		CausemosAddr:         causemos.URL,
+	}
+	checks := NewHealthChecks(env, NewPrefectExecutor(env))
+
+	// causemos isn't critical, so its failure is reported without affecting readiness
+	results, ready := RunHealthChecks(checks)
+	assert.True(t, ready)
+	assert.Len(t, results, 4)
+	healthy := map[string]bool{}
+	for _, result := range results {
+		healthy[result.Name] = result.Healthy
+	}
+	assert.Equal(t, map[string]bool{CheckExecutor: true, CheckFlow: true, CheckCausemos: false, CheckQueueStorage: true}, healthy)
+	assert.Equal(t, "response 502", results[2].Error)
+	entries, err := os.ReadDir(queueDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	flowExists.Store(false)
+	results, ready = RunHealthChecks(checks)
+	assert.False(t, ready)
+	assert.Equal(t, CheckFlow, results[1].Name)
+	assert.False(t, results[1].Healthy)
+	assert.Contains(t, results[1].Error, "does not exist")
+
+	env.DataPipelineQueueDir = "test_data/missing"
+	env.CausemosAddr = ""
+	checks = NewHealthChecks(env, NewPrefectExecutor(env))
+	assert.Len(t, checks, 3)
+	flowExists.Store(true)
+	results, ready = RunHealthChecks(checks)
+	assert.False(t, ready)
+	assert.Equal(t, CheckQueueStorage, results[2].Name)
+	assert.False(t, results[2].Healthy)
+}
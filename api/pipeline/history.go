@@ -0,0 +1,286 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// NotificationResult is the outcome of telling a subscriber that a job finished.
+type NotificationResult struct {
+	Endpoint  string    `json:"endpoint"`
+	Delivered bool      `json:"delivered"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// HistoryRecord describes a job that has finished.
+type HistoryRecord struct {
+	RunID   string          `json:"run_id"`
+	ModelID string          `json:"model_id"`
+	Request json.RawMessage `json:"request"`
+	FlowID  string          `json:"flow_id,omitempty"`
+	AgentID string          `json:"agent_id,omitempty"`
+	// State is the job's final state (succeeded, failed or cancelled).
+	State string `json:"state"`
+	// FlowState is the state the flow run finished in, or why the job failed if it had no flow run.
+	FlowState   string    `json:"flow_state"`
+	Retries     int       `json:"retries"`
+	EnqueuedAt  time.Time `json:"enqueued_at"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	// QueueWaitSec is the time from enqueue to submission, and is 0 if either isn't known.
+	QueueWaitSec float64 `json:"queue_wait_sec"`
+	// RunDurationSec is the time from submission until the flow run finished, and is 0 if the
+	// job had no flow run.
+	RunDurationSec float64 `json:"run_duration_sec"`
+	// Notifications holds the outcome of the finished notification to each subscriber.
+	Notifications map[string]NotificationResult `json:"notifications"`
+}
+
+// key identifies the record in the history's journal.  A run can finish more than once if it is
+// requeued, so the key includes when it finished.
+func (r *HistoryRecord) key() string {
+	return r.RunID + "@" + strconv.FormatInt(r.FinishedAt.UnixNano(), 10)
+}
+
+// HistoryFilter selects history records.  Empty fields match every record.
+type HistoryFilter struct {
+	ModelID string
+	State   string
+	// From and To bound the time the job finished, inclusively.
+	From time.Time
+	To   time.Time
+}
+
+// Matches returns true if the record is selected by the filter.
+func (f *HistoryFilter) Matches(record *HistoryRecord) bool {
+	if f.ModelID != "" && record.ModelID != f.ModelID {
+		return false
+	}
+	if f.State != "" && record.State != f.State {
+		return false
+	}
+	if !f.From.IsZero() && record.FinishedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && record.FinishedAt.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// HistoryStore keeps a record of each finished job for the retention period.  Each change is
+// journalled to disk as it is made.
+type HistoryStore struct {
+	config.Config
+	journal   *journal
+	retention time.Duration
+	records   []*HistoryRecord
+	index     map[string]*HistoryRecord
+	mutex     *sync.RWMutex
+}
+
+// NewHistoryStore creates a history store persisted to `<name>.json` and `<name>.journal` in the
+// queue directory, reloading any existing records.
+func NewHistoryStore(cfg *config.Config) (*HistoryStore, error) {
+	store := &HistoryStore{
+		Config: config.Config{
+			Logger:      cfg.Logger,
+			Environment: cfg.Environment,
+		},
+		journal:   newJournal(path.Join(cfg.Environment.DataPipelineQueueDir, cfg.Environment.DataPipelineHistoryName+".json")),
+		retention: time.Duration(cfg.Environment.DataPipelineHistoryRetentionHours) * time.Hour,
+		records:   []*HistoryRecord{},
+		mutex:     &sync.RWMutex{},
+	}
+	put := func(key string, value json.RawMessage) error {
+		record := &HistoryRecord{}
+		if err := json.Unmarshal(value, record); err != nil {
+			return err
+		}
+		if existing, ok := store.lookup(key); ok {
+			*existing = *record
+			return nil
+		}
+		store.records = append(store.records, record)
+		store.index[key] = record
+		return nil
+	}
+	remove := func(key string) {
+		record, ok := store.lookup(key)
+		if !ok {
+			return
+		}
+		delete(store.index, key)
+		for i := range store.records {
+			if store.records[i] == record {
+				store.records = append(store.records[:i], store.records[i+1:]...)
+				break
+			}
+		}
+	}
+	if err := store.journal.load(&store.records, put, remove); err != nil {
+		return nil, errors.Wrap(err, "failed to load job history")
+	}
+	if store.index == nil {
+		store.indexRecords()
+	}
+	return store, nil
+}
+
+// Notify records the jobs that finish.
+func (s *HistoryStore) Notify(event JobEvent) {
+	record := &HistoryRecord{
+		RunID:         event.Request.RunID,
+		ModelID:       event.Request.ModelID,
+		Request:       event.Request.RequestData,
+		FlowID:        event.FlowID,
+		AgentID:       event.AgentID,
+		FlowState:     event.State,
+		Retries:       event.Retries,
+		EnqueuedAt:    event.EnqueuedAt,
+		SubmittedAt:   event.SubmittedAt,
+		FinishedAt:    event.Time,
+		Notifications: map[string]NotificationResult{},
+	}
+	switch event.Event {
+	case EventSucceeded:
+		record.State = JobSucceeded
+	case EventFailed:
+		record.State = JobFailed
+		if event.State == StateCancelled {
+			record.State = JobCancelled
+		}
+	default:
+		return
+	}
+	if len(record.Request) == 0 {
+		record.Request = json.RawMessage("null")
+	}
+	if !record.EnqueuedAt.IsZero() && !record.SubmittedAt.IsZero() {
+		record.QueueWaitSec = record.SubmittedAt.Sub(record.EnqueuedAt).Seconds()
+	}
+	if !record.SubmittedAt.IsZero() {
+		record.RunDurationSec = record.FinishedAt.Sub(record.SubmittedAt).Seconds()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.lookup(record.key()); ok {
+		return
+	}
+	s.records = append(s.records, record)
+	s.index[record.key()] = record
+	if err := s.save(record); err != nil {
+		s.Logger.Error(err)
+	}
+}
+
+// NotificationResult records the outcome of a notification about a finished job.  Notifications
+// created before the job's most recent finish, such as queue-runtime reports, are ignored.
+func (s *HistoryStore) NotificationResult(entry OutboxEntry, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := len(s.records) - 1; i >= 0; i-- {
+		record := s.records[i]
+		if record.RunID != entry.RunID {
+			continue
+		}
+		if entry.CreatedAt.Before(record.FinishedAt) {
+			return
+		}
+		result := NotificationResult{Endpoint: entry.Endpoint, Delivered: err == nil, Time: time.Now()}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if record.Notifications == nil {
+			record.Notifications = map[string]NotificationResult{}
+		}
+		record.Notifications[entry.Subscriber] = result
+		if err := s.save(record); err != nil {
+			s.Logger.Error(err)
+		}
+		return
+	}
+}
+
+// List returns the records selected by the filter, in the order the jobs finished.
+func (s *HistoryStore) List(filter HistoryFilter) []HistoryRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	records := []HistoryRecord{}
+	for _, record := range s.records {
+		if filter.Matches(record) {
+			copied := *record
+			copied.Notifications = map[string]NotificationResult{}
+			for subscriber, result := range record.Notifications {
+				copied.Notifications[subscriber] = result
+			}
+			records = append(records, copied)
+		}
+	}
+	return records
+}
+
+// Close closes the history's journal.
+func (s *HistoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.journal.close()
+}
+
+// indexRecords indexes the records by their journal keys.
+func (s *HistoryStore) indexRecords() {
+	s.index = map[string]*HistoryRecord{}
+	for _, record := range s.records {
+		s.index[record.key()] = record
+	}
+}
+
+// lookup returns the record with the supplied journal key, indexing the records first if they
+// were loaded from a snapshot.
+func (s *HistoryStore) lookup(key string) (*HistoryRecord, bool) {
+	if s.index == nil {
+		s.indexRecords()
+	}
+	record, ok := s.index[key]
+	return record, ok
+}
+
+// prune removes records of jobs that finished before the retention period.  Records are added in
+// the order jobs finish, so only the oldest need to be checked.
+func (s *HistoryStore) prune(now time.Time) error {
+	cutoff := now.Add(-s.retention)
+	pruned := 0
+	for _, record := range s.records {
+		if !record.FinishedAt.Before(cutoff) {
+			break
+		}
+		delete(s.index, record.key())
+		if err := s.journal.remove(record.key()); err != nil {
+			return err
+		}
+		pruned++
+	}
+	s.records = append(s.records[:0], s.records[pruned:]...)
+	return nil
+}
+
+// save journals a changed record, pruning expired records and compacting the journal as it grows.
+func (s *HistoryStore) save(record *HistoryRecord) error {
+	if err := s.journal.put(record.key(), record); err != nil {
+		return errors.Wrap(err, "failed to save job history")
+	}
+	if err := s.prune(record.FinishedAt); err != nil {
+		return errors.Wrap(err, "failed to save job history")
+	}
+	return errors.Wrap(s.journal.compact(len(s.records), s.records), "failed to save job history")
+}
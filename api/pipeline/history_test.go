@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func TestHistoryStore(t *testing.T) {
+	dir := path.Join("test_data", "history1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	cfg := &config.Config{
+		Logger:      zap.NewNop().Sugar(),
+		Environment: &config.Environment{DataPipelineQueueDir: dir, DataPipelineHistoryName: "history", DataPipelineHistoryRetentionHours: 24},
+	}
+	history, err := NewHistoryStore(cfg)
+	assert.NoError(t, err)
+
+	// only finished jobs are recorded
+	now := time.Now()
+	succeeded := flowEvent(EventSucceeded, "flow1", FlowData{
+		Request:    EnqueueRequestData{ModelID: "model1", RunID: "run1", RequestData: []byte(`{"run_id":"run1"}`)},
+		EnqueuedAt: now.Add(-3 * time.Minute),
+		StartTime:  now.Add(-2 * time.Minute),
+	})
+	succeeded.Time = now
+	succeeded.AgentID = "agent1"
+	history.Notify(succeeded)
+	history.Notify(flowEvent(EventDispatched, "flow2", FlowData{Request: EnqueueRequestData{ModelID: "model2", RunID: "run2"}}))
+	cancelled := flowEvent(EventFailed, "flow2", FlowData{Request: EnqueueRequestData{ModelID: "model2", RunID: "run2"}})
+	cancelled.State = StateCancelled
+	cancelled.Time = now.Add(time.Minute)
+	history.Notify(cancelled)
+
+	records := history.List(HistoryFilter{})
+	assert.Len(t, records, 2)
+	assert.Equal(t, JobSucceeded, records[0].State)
+	assert.Equal(t, "agent1", records[0].AgentID)
+	assert.JSONEq(t, `{"run_id":"run1"}`, string(records[0].Request))
+	assert.InDelta(t, 60, records[0].QueueWaitSec, 0.001)
+	assert.InDelta(t, 120, records[0].RunDurationSec, 0.001)
+	assert.Equal(t, JobCancelled, records[1].State)
+	assert.Equal(t, float64(0), records[1].QueueWaitSec)
+
+	// records are filtered by model, final state and the time the job finished
+	assert.Len(t, history.List(HistoryFilter{ModelID: "model2"}), 1)
+	assert.Len(t, history.List(HistoryFilter{State: JobSucceeded}), 1)
+	assert.Len(t, history.List(HistoryFilter{From: now.Add(time.Second)}), 1)
+	assert.Len(t, history.List(HistoryFilter{To: now}), 1)
+	assert.Len(t, history.List(HistoryFilter{ModelID: "model1", State: JobFailed}), 0)
+
+	// the outcome of notifications sent after the job finished is recorded
+	history.NotificationResult(OutboxEntry{Subscriber: CausemosSubscriberName, RunID: "run1", Endpoint: endpointQueueRuntime, CreatedAt: now.Add(-time.Minute)}, nil)
+	history.NotificationResult(OutboxEntry{Subscriber: CausemosSubscriberName, RunID: "run1", Endpoint: endpointSucceeded, CreatedAt: now}, errors.New("response 500"))
+	history.NotificationResult(OutboxEntry{Subscriber: "webhook", RunID: "run1", Endpoint: EventSucceeded, CreatedAt: now}, nil)
+
+	// changes are journalled rather than rewriting the history
+	_, err = os.Stat(path.Join(dir, "history.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	// records survive a restart
+	assert.NoError(t, history.Close())
+	history, err = NewHistoryStore(cfg)
+	assert.NoError(t, err)
+	records = history.List(HistoryFilter{})
+	assert.Len(t, records, 2)
+	assert.Equal(t, endpointSucceeded, records[0].Notifications[CausemosSubscriberName].Endpoint)
+	assert.False(t, records[0].Notifications[CausemosSubscriberName].Delivered)
+	assert.Equal(t, "response 500", records[0].Notifications[CausemosSubscriberName].Error)
+	assert.True(t, records[0].Notifications["webhook"].Delivered)
+
+	// records are removed once the retention period has passed
+	later := flowEvent(EventFailed, "", FlowData{Request: EnqueueRequestData{ModelID: "model3", RunID: "run3"}})
+	later.Time = now.Add(25 * time.Hour)
+	history.Notify(later)
+	records = history.List(HistoryFilter{})
+	assert.Len(t, records, 1)
+	assert.Equal(t, "run3", records[0].RunID)
+
+	// as is their removal
+	assert.NoError(t, history.Close())
+	history, err = NewHistoryStore(cfg)
+	assert.NoError(t, err)
+	records = history.List(HistoryFilter{})
+	assert.Len(t, records, 1)
+	assert.Equal(t, "run3", records[0].RunID)
+}
@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// Job lifecycle states.
+const (
+	// JobQueued jobs are waiting in the queue, or waiting on a retry backoff
+	JobQueued = "queued"
+	// JobDispatching jobs have been taken from the queue and are being submitted to the executor
+	JobDispatching = "dispatching"
+	// JobSubmitted jobs have a flow run that hasn't started yet
+	JobSubmitted = "submitted"
+	// JobRunning jobs have a flow run in progress
+	JobRunning = "running"
+	// JobSucceeded jobs have a flow run that succeeded
+	JobSucceeded = "succeeded"
+	// JobFailed jobs will not be run to completion
+	JobFailed = "failed"
+	// JobCancelled jobs were cancelled while queued or running
+	JobCancelled = "cancelled"
+)
+
+// jobTransitions lists the states a job can move to from each state.  Finished jobs can be queued
+// again when they are retried or requeued.
+var jobTransitions = map[string][]string{
+	JobQueued:      {JobDispatching, JobSubmitted, JobFailed, JobCancelled},
+	JobDispatching: {JobQueued, JobSubmitted, JobFailed, JobCancelled},
+	JobSubmitted:   {JobQueued, JobRunning, JobSucceeded, JobFailed, JobCancelled},
+	JobRunning:     {JobQueued, JobSucceeded, JobFailed, JobCancelled},
+	JobSucceeded:   {JobQueued},
+	JobFailed:      {JobQueued},
+	JobCancelled:   {JobQueued},
+}
+
+// JobTransition records a job entering a state.
+type JobTransition struct {
+	State  string    `json:"state"`
+	Time   time.Time `json:"time"`
+	FlowID string    `json:"flow_id,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Job is the lifecycle of a request, identified by its run ID.
+type Job struct {
+	RunID   string `json:"run_id"`
+	ModelID string `json:"model_id"`
+	State   string `json:"state"`
+	// FlowID is the ID of the job's most recent flow run.
+	FlowID      string          `json:"flow_id,omitempty"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	Transitions []JobTransition `json:"transitions"`
+}
+
+// Finished returns true if the job has succeeded, failed or been cancelled.
+func (j *Job) Finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobCancelled
+}
+
+// JobStore tracks the state of each job through its lifecycle.  Finished jobs are kept for the
+// retention period, and unfinished jobs that stop changing are dropped once they are stale.  Each
+// change is journalled to disk as it is made.
+type JobStore struct {
+	config.Config
+	journal   *journal
+	retention time.Duration
+	stale     time.Duration
+	jobs      map[string]*Job
+	pruned    time.Time
+	mutex     *sync.RWMutex
+}
+
+// NewJobStore creates a job store persisted to `<name>.json` and `<name>.journal` in the queue
+// directory, reloading any existing jobs.
+func NewJobStore(cfg *config.Config) (*JobStore, error) {
+	store := &JobStore{
+		Config: config.Config{
+			Logger:      cfg.Logger,
+			Environment: cfg.Environment,
+		},
+		journal:   newJournal(path.Join(cfg.Environment.DataPipelineQueueDir, cfg.Environment.DataPipelineJobsName+".json")),
+		retention: time.Duration(cfg.Environment.DataPipelineJobRetentionHours) * time.Hour,
+		stale:     time.Duration(cfg.Environment.DataPipelineJobStaleHours) * time.Hour,
+		jobs:      map[string]*Job{},
+		mutex:     &sync.RWMutex{},
+	}
+	put := func(key string, value json.RawMessage) error {
+		job := &Job{}
+		if err := json.Unmarshal(value, job); err != nil {
+			return err
+		}
+		store.jobs[key] = job
+		return nil
+	}
+	remove := func(key string) {
+		delete(store.jobs, key)
+	}
+	if err := store.journal.load(&store.jobs, put, remove); err != nil {
+		return nil, errors.Wrap(err, "failed to load job store")
+	}
+	return store, nil
+}
+
+// Transition moves a job to a new state, creating it if it isn't known.  An error is returned if
+// the job can't move from its current state to the new one.  Moving a job to the state it is
+// already in only records a new flow run ID.
+func (s *JobStore) Transition(request EnqueueRequestData, state string, flowID string, reason string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job, ok := s.jobs[request.RunID]
+	if !ok {
+		job = &Job{RunID: request.RunID, Transitions: []JobTransition{}}
+		s.jobs[request.RunID] = job
+	} else if job.State == state {
+		if flowID == "" || flowID == job.FlowID {
+			return nil
+		}
+	} else if !validTransition(job.State, state) {
+		return errors.Errorf("run %s can't move from %s to %s", request.RunID, job.State, state)
+	}
+
+	now := time.Now()
+	if request.ModelID != "" {
+		job.ModelID = request.ModelID
+	}
+	job.State = state
+	if flowID != "" {
+		job.FlowID = flowID
+	}
+	job.UpdatedAt = now
+	job.Transitions = append(job.Transitions, JobTransition{State: state, Time: now, FlowID: flowID, Reason: reason})
+	if err := s.journal.put(job.RunID, job); err != nil {
+		return errors.Wrap(err, "failed to save job store")
+	}
+	return s.prune(now)
+}
+
+func validTransition(from string, to string) bool {
+	for _, state := range jobTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify moves a job to the state that follows a lifecycle event.
+func (s *JobStore) Notify(event JobEvent) {
+	var state, reason string
+	switch event.Event {
+	case EventEnqueued:
+		state = JobQueued
+	case EventDispatched:
+		state = JobSubmitted
+	case EventSucceeded:
+		state = JobSucceeded
+	case EventFailed:
+		state = JobFailed
+		if event.State == StateCancelled {
+			state = JobCancelled
+		}
+		reason = event.State
+	case EventRetried:
+		state = JobQueued
+		reason = "retry scheduled"
+	default:
+		return
+	}
+	if err := s.Transition(event.Request, state, event.FlowID, reason); err != nil {
+		s.Logger.Warn(err)
+	}
+}
+
+// Get returns the job with the supplied run ID.
+func (s *JobStore) Get(runID string) (Job, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	job, ok := s.jobs[runID]
+	if !ok {
+		return Job{}, false
+	}
+	copied := *job
+	copied.Transitions = append([]JobTransition{}, job.Transitions...)
+	return copied, true
+}
+
+// Close closes the job store's journal.
+func (s *JobStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.journal.close()
+}
+
+// prune removes finished jobs that haven't changed within the retention period, and unfinished
+// jobs that haven't changed since they became stale, such as those whose requests were lost from
+// the queue.  The store is scanned at most once per prune interval, and the journal is compacted
+// once it has grown past the size of the store.
+func (s *JobStore) prune(now time.Time) error {
+	if now.Sub(s.pruned) >= pruneInterval {
+		s.pruned = now
+		for runID, job := range s.jobs {
+			age := now.Sub(job.UpdatedAt)
+			if (job.Finished() && age > s.retention) || (!job.Finished() && s.stale > 0 && age > s.stale) {
+				delete(s.jobs, runID)
+				if err := s.journal.remove(runID); err != nil {
+					return errors.Wrap(err, "failed to save job store")
+				}
+			}
+		}
+	}
+	return errors.Wrap(s.journal.compact(len(s.jobs), s.jobs), "failed to save job store")
+}
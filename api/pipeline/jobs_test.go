@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func newTestJobStore(t *testing.T, cfg *config.Config) *JobStore {
+	jobs, err := NewJobStore(cfg)
+	assert.NoError(t, err)
+	return jobs
+}
+
+func jobStates(job Job) []string {
+	states := []string{}
+	for _, transition := range job.Transitions {
+		states = append(states, transition.State)
+	}
+	return states
+}
+
+func TestJobStore(t *testing.T) {
+	dir := path.Join("test_data", "jobs1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	cfg := &config.Config{
+		Logger:      zap.NewNop().Sugar(),
+		Environment: &config.Environment{DataPipelineQueueDir: dir, DataPipelineJobsName: "jobs", DataPipelineJobRetentionHours: 1, DataPipelineJobStaleHours: 2},
+	}
+	jobs := newTestJobStore(t, cfg)
+
+	// jobs follow the lifecycle events, and are retried from the start
+	request := EnqueueRequestData{ModelID: "model", RunID: "run1"}
+	jobs.Notify(NewJobEvent(EventEnqueued, request))
+	assert.NoError(t, jobs.Transition(request, JobDispatching, "", ""))
+	dispatched := NewJobEvent(EventDispatched, request)
+	dispatched.FlowID = "flow1"
+	jobs.Notify(dispatched)
+	assert.NoError(t, jobs.Transition(request, JobRunning, "flow1", ""))
+	assert.NoError(t, jobs.Transition(request, JobRunning, "flow1", ""))
+	retried := NewJobEvent(EventRetried, request)
+	retried.FlowID = "flow1"
+	jobs.Notify(retried)
+	cancelled := NewJobEvent(EventFailed, request)
+	cancelled.State = StateCancelled
+	jobs.Notify(cancelled)
+
+	job, ok := jobs.Get("run1")
+	assert.True(t, ok)
+	assert.Equal(t, "model", job.ModelID)
+	assert.Equal(t, JobCancelled, job.State)
+	assert.Equal(t, "flow1", job.FlowID)
+	assert.Equal(t, []string{JobQueued, JobDispatching, JobSubmitted, JobRunning, JobQueued, JobCancelled}, jobStates(job))
+	assert.Equal(t, "retry scheduled", job.Transitions[4].Reason)
+
+	// finished jobs can only be queued again
+	assert.Error(t, jobs.Transition(request, JobRunning, "flow2", ""))
+
+	// changes are journalled rather than rewriting the store
+	_, err := os.Stat(path.Join(dir, "jobs.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	// jobs survive a restart
+	assert.NoError(t, jobs.Close())
+	jobs = newTestJobStore(t, cfg)
+	job, ok = jobs.Get("run1")
+	assert.True(t, ok)
+	assert.Len(t, job.Transitions, 6)
+	_, ok = jobs.Get("run2")
+	assert.False(t, ok)
+
+	// finished jobs are removed once the retention period has passed
+	jobs.jobs["run1"].UpdatedAt = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, jobs.Transition(EnqueueRequestData{RunID: "run2"}, JobQueued, "", ""))
+	_, ok = jobs.Get("run1")
+	assert.False(t, ok)
+	_, ok = jobs.Get("run2")
+	assert.True(t, ok)
+
+	// unfinished jobs are removed once they are stale, which survives a restart
+	jobs.jobs["run2"].UpdatedAt = time.Now().Add(-3 * time.Hour)
+	jobs.pruned = time.Time{}
+	assert.NoError(t, jobs.Transition(EnqueueRequestData{RunID: "run3"}, JobQueued, "", ""))
+	assert.NoError(t, jobs.Close())
+	jobs = newTestJobStore(t, cfg)
+	_, ok = jobs.Get("run2")
+	assert.False(t, ok)
+	_, ok = jobs.Get("run3")
+	assert.True(t, ok)
+	assert.Len(t, jobs.jobs, 1)
+}
@@ -0,0 +1,228 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// maxReportedLocalRuns is the number of finished local runs that are kept after their final state
+// has been reported, so that recent runs can still be looked up (ie. to retry them).
+const maxReportedLocalRuns = 100
+
+// Flow run of a local process.
+type localFlowRun struct {
+	FlowRun
+	cancel context.CancelFunc
+}
+
+// LocalExecutor runs the data pipeline as a local command, for development and testing without
+// a prefect server.  The request data is passed to the command on stdin or in a temporary file, and
+// the command's exit code determines whether the run succeeded.  At most DataPipelineParallelism
+// commands are run at once - runs submitted beyond that wait in the Scheduled state.  Runs are only
+// held in memory, and are dropped some time after their final state has been reported.  A run
+// that isn't known was started before a restart, and is reported as failed since its command was
+// stopped along with the service.
+type LocalExecutor struct {
+	env      *config.Environment
+	command  []string
+	slots    chan struct{}
+	mutex    *sync.RWMutex
+	runs     map[string]*localFlowRun
+	reported []string
+}
+
+// NewLocalExecutor creates an executor that runs the configured command.
+func NewLocalExecutor(env *config.Environment) (*LocalExecutor, error) {
+	command := strings.Fields(env.DataPipelineLocalCommand)
+	if len(command) == 0 {
+		return nil, errors.New("no local command configured")
+	}
+	if env.DataPipelineLocalInput != config.LocalInputStdin && env.DataPipelineLocalInput != config.LocalInputFile {
+		return nil, errors.Errorf("invalid local input: %s", env.DataPipelineLocalInput)
+	}
+	parallelism := env.DataPipelineParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &LocalExecutor{
+		env:     env,
+		command: command,
+		slots:   make(chan struct{}, parallelism),
+		mutex:   &sync.RWMutex{},
+		runs:    map[string]*localFlowRun{},
+	}, nil
+}
+
+// Agents returns no agents, local runs don't use labels.
+func (l *LocalExecutor) Agents() ([]Agent, error) {
+	return []Agent{}, nil
+}
+
+// Submit starts a local run of the command for the request.
+func (l *LocalExecutor) Submit(request *KeyedEnqueueRequestData, labels []string) (string, error) {
+	id, err := newLocalFlowRunID()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &localFlowRun{
+		FlowRun: FlowRun{
+			ID:         id,
+			Name:       fmt.Sprintf("%s:%s", request.ModelID, request.RunID),
+			State:      StateScheduled,
+			Created:    time.Now(),
+			Parameters: request.RequestData,
+		},
+		cancel: cancel,
+	}
+
+	l.mutex.Lock()
+	l.runs[id] = run
+	l.mutex.Unlock()
+
+	go l.run(ctx, run, request.EnqueueRequestData)
+	return id, nil
+}
+
+// Runs the command once a slot is free, and records the state it finishes in.
+func (l *LocalExecutor) run(ctx context.Context, run *localFlowRun, request EnqueueRequestData) {
+	select {
+	case l.slots <- struct{}{}:
+		defer func() { <-l.slots }()
+	case <-ctx.Done():
+		l.setState(run, StateCancelled)
+		return
+	}
+	l.setState(run, StateRunning)
+
+	err := l.execute(ctx, run.ID, request)
+	switch {
+	case ctx.Err() != nil:
+		l.setState(run, StateCancelled)
+	case err != nil:
+		l.setState(run, StateFailed)
+	default:
+		l.setState(run, StateSuccess)
+	}
+}
+
+// Runs the command, returning an error if it couldn't be started or exited with a non-zero code.
+func (l *LocalExecutor) execute(ctx context.Context, flowID string, request EnqueueRequestData) error {
+	cmd := exec.CommandContext(ctx, l.command[0], l.command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"WM_FLOW_RUN_ID="+flowID,
+		"WM_RUN_ID="+request.RunID,
+		"WM_MODEL_ID="+request.ModelID,
+	)
+
+	if l.env.DataPipelineLocalInput == config.LocalInputFile {
+		file, err := ioutil.TempFile("", "wm-request-*.json")
+		if err != nil {
+			return errors.Wrap(err, "failed to create request file")
+		}
+		defer os.Remove(file.Name())
+		_, err = file.Write(request.RequestData)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to write request file")
+		}
+		// the file is passed as the last argument, as well as in the environment
+		cmd.Args = append(cmd.Args, file.Name())
+		cmd.Env = append(cmd.Env, "WM_REQUEST_FILE="+file.Name())
+	} else {
+		cmd.Stdin = bytes.NewReader(request.RequestData)
+	}
+
+	return cmd.Run()
+}
+
+func (l *LocalExecutor) setState(run *localFlowRun, state string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	run.State = state
+}
+
+// FlowRuns returns the local runs with the supplied IDs.  Unknown IDs are reported as failed runs.
+// Once a finished run has been reported, it is kept until enough newer runs have been reported.
+func (l *LocalExecutor) FlowRuns(ids []string) ([]FlowRun, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	runs := []FlowRun{}
+	for _, id := range ids {
+		run, ok := l.runs[id]
+		if !ok {
+			runs = append(runs, FlowRun{ID: id, State: StateFailed})
+			continue
+		}
+		runs = append(runs, run.FlowRun)
+		if run.State == StateSuccess || run.State == StateFailed || run.State == StateCancelled {
+			l.evictReported(id)
+		}
+	}
+	return runs, nil
+}
+
+// evictReported records that a finished run has been reported, dropping the run reported longest
+// ago once there are too many.  The caller must hold the executor's mutex.
+func (l *LocalExecutor) evictReported(id string) {
+	for _, reported := range l.reported {
+		if reported == id {
+			return
+		}
+	}
+	l.reported = append(l.reported, id)
+	if len(l.reported) > maxReportedLocalRuns {
+		delete(l.runs, l.reported[0])
+		l.reported = l.reported[1:]
+	}
+}
+
+// ActiveFlowRuns returns the local runs that are waiting for a slot or running.
+func (l *LocalExecutor) ActiveFlowRuns() ([]FlowRun, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	runs := []FlowRun{}
+	for _, run := range l.runs {
+		if run.State == StateScheduled || run.State == StateRunning {
+			runs = append(runs, run.FlowRun)
+		}
+	}
+	return runs, nil
+}
+
+// Cancel kills a local run, or stops it from starting if it's still waiting for a slot.
+func (l *LocalExecutor) Cancel(flowID string) error {
+	l.mutex.RLock()
+	run, ok := l.runs[flowID]
+	l.mutex.RUnlock()
+	if !ok {
+		return errors.Errorf("flow run %s not found", flowID)
+	}
+	run.cancel()
+	return nil
+}
+
+func newLocalFlowRunID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "failed to generate flow run id")
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,207 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+// writeScript writes an executable shell script to the test directory.
+func writeScript(t *testing.T, dir string, name string, script string) string {
+	err := os.MkdirAll(dir, 0755)
+	assert.NoError(t, err)
+	scriptPath := path.Join(dir, name)
+	err = ioutil.WriteFile(scriptPath, []byte("#!/bin/sh\n"+script), 0755)
+	assert.NoError(t, err)
+	return scriptPath
+}
+
+func newLocalRequest(runID string, data string) *KeyedEnqueueRequestData {
+	return &KeyedEnqueueRequestData{EnqueueRequestData: EnqueueRequestData{ModelID: "model", RunID: runID, RequestData: []byte(data)}}
+}
+
+func waitForState(t *testing.T, executor Executor, flowID string, state string) {
+	assert.Eventually(t, func() bool {
+		runs, err := executor.FlowRuns([]string{flowID})
+		return err == nil && len(runs) == 1 && runs[0].State == state
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLocalExecutorExitCodes(t *testing.T) {
+	dir := path.Join("test_data", "local1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	script := writeScript(t, dir, "stdin.sh", `if grep -q fail; then exit 1; fi`)
+	executor, err := NewLocalExecutor(&config.Environment{DataPipelineLocalCommand: script, DataPipelineLocalInput: config.LocalInputStdin, DataPipelineParallelism: 2})
+	assert.NoError(t, err)
+
+	succeeded, err := executor.Submit(newLocalRequest("run1", `{"run_id": "run1"}`), nil)
+	assert.NoError(t, err)
+	failed, err := executor.Submit(newLocalRequest("run2", `{"run_id": "fail"}`), nil)
+	assert.NoError(t, err)
+
+	waitForState(t, executor, succeeded, StateSuccess)
+	waitForState(t, executor, failed, StateFailed)
+	runs, err := executor.FlowRuns([]string{succeeded})
+	assert.NoError(t, err)
+	assert.Equal(t, "model:run1", runs[0].Name)
+	assert.JSONEq(t, `{"run_id": "run1"}`, string(runs[0].Parameters))
+
+	active, err := executor.ActiveFlowRuns()
+	assert.NoError(t, err)
+	assert.Empty(t, active)
+}
+
+func TestLocalExecutorFileInput(t *testing.T) {
+	dir := path.Join("test_data", "local2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	script := writeScript(t, dir, "file.sh", `grep -q run1 "$1" && grep -q run1 "$WM_REQUEST_FILE"`)
+	executor, err := NewLocalExecutor(&config.Environment{DataPipelineLocalCommand: script, DataPipelineLocalInput: config.LocalInputFile})
+	assert.NoError(t, err)
+
+	flowID, err := executor.Submit(newLocalRequest("run1", `{"run_id": "run1"}`), nil)
+	assert.NoError(t, err)
+	waitForState(t, executor, flowID, StateSuccess)
+
+	_, err = NewLocalExecutor(&config.Environment{DataPipelineLocalInput: config.LocalInputFile})
+	assert.Error(t, err)
+}
+
+func TestLocalExecutorParallelism(t *testing.T) {
+	dir := path.Join("test_data", "local3")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	script := writeScript(t, dir, "sleep.sh", `exec sleep 10`)
+	executor, err := NewLocalExecutor(&config.Environment{DataPipelineLocalCommand: script, DataPipelineLocalInput: config.LocalInputStdin, DataPipelineParallelism: 1})
+	assert.NoError(t, err)
+
+	first, err := executor.Submit(newLocalRequest("run1", `{}`), nil)
+	assert.NoError(t, err)
+	waitForState(t, executor, first, StateRunning)
+	second, err := executor.Submit(newLocalRequest("run2", `{}`), nil)
+	assert.NoError(t, err)
+
+	// the second run waits for the first to finish
+	active, err := executor.ActiveFlowRuns()
+	assert.NoError(t, err)
+	assert.Len(t, active, 2)
+	runs, err := executor.FlowRuns([]string{second})
+	assert.NoError(t, err)
+	assert.Equal(t, StateScheduled, runs[0].State)
+
+	err = executor.Cancel(first)
+	assert.NoError(t, err)
+	waitForState(t, executor, first, StateCancelled)
+	waitForState(t, executor, second, StateRunning)
+
+	err = executor.Cancel(second)
+	assert.NoError(t, err)
+	waitForState(t, executor, second, StateCancelled)
+	assert.Error(t, executor.Cancel("unknown"))
+}
+
+func TestLocalExecutorRunner(t *testing.T) {
+	dir := path.Join("test_data", "local4")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	var mutex sync.Mutex
+	var notified []string
+	causemos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		notified = append(notified, r.URL.Path)
+		mutex.Unlock()
+	}))
+	defer causemos.Close()
+
+	script := writeScript(t, dir, "stdin.sh", `cat > /dev/null`)
+	env := &config.Environment{
+		CausemosAddr:             causemos.URL,
+		DataPipelineQueueDir:     dir,
+		DataPipelineFlowsName:    "current_flows",
+		DataPipelineRetriesName:  "pending_retries",
+		DataPipelineOutboxName:   "outbox",
+		DataPipelineJobsName:     "jobs",
+		DataPipelineParallelism:  1,
+		DataPipelineTimeoutSec:   5,
+		DataPipelineLocalCommand: script,
+		DataPipelineLocalInput:   config.LocalInputStdin,
+	}
+	executor, err := NewLocalExecutor(env)
+	assert.NoError(t, err)
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	requestQueue := queue.NewListFIFOQueue(5)
+	cfg := &config.Config{Logger: zap.NewNop().Sugar(), Environment: env}
+	notifier := newTestNotifier(t, cfg)
+	runner, err := NewDataPipelineRunner(cfg, requestQueue, deadLetters, newTestJobStore(t, cfg), notifier, executor)
+	assert.NoError(t, err)
+
+	_, err = requestQueue.EnqueueHashed(1, *newLocalRequest("run1", `{"run_id": "run1"}`))
+	assert.NoError(t, err)
+
+	// the request is dequeued and run, then causemos is notified once it succeeds (which may be
+	// during the first submit if the command finishes quickly)
+	runner.Submit(SubmitParams{})
+	assert.Equal(t, 0, requestQueue.Size())
+	assert.Eventually(t, func() bool {
+		runner.Submit(SubmitParams{})
+		return runner.TrackedFlowCount() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// closing waits for the notifications to be delivered
+	notifier.Close()
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{
+		"/api/maas/pipeline-reporting/queue-runtime",
+		"/api/maas/pipeline-reporting/processing-succeeded",
+	}, notified)
+}
+
+func TestLocalExecutorForgetsRuns(t *testing.T) {
+	executor, err := NewLocalExecutor(&config.Environment{DataPipelineLocalCommand: "true", DataPipelineLocalInput: config.LocalInputStdin})
+	assert.NoError(t, err)
+
+	// a run from before a restart is reported as failed
+	runs, err := executor.FlowRuns([]string{"unknown"})
+	assert.NoError(t, err)
+	assert.Equal(t, []FlowRun{{ID: "unknown", State: StateFailed}}, runs)
+
+	// finished runs are kept for a while after they're reported, running ones until they finish
+	executor.runs["running"] = &localFlowRun{FlowRun: FlowRun{ID: "running", State: StateRunning}}
+	for i := 0; i <= maxReportedLocalRuns; i++ {
+		id := fmt.Sprintf("finished%d", i)
+		executor.runs[id] = &localFlowRun{FlowRun: FlowRun{ID: id, State: StateSuccess, Parameters: []byte(`{}`)}}
+		runs, err = executor.FlowRuns([]string{id, "running"})
+		assert.NoError(t, err)
+		assert.Equal(t, StateSuccess, runs[0].State)
+	}
+	assert.Len(t, executor.runs, maxReportedLocalRuns+1)
+	assert.NotContains(t, executor.runs, "finished0")
+	assert.Contains(t, executor.runs, "finished1")
+	assert.Contains(t, executor.runs, "running")
+}
@@ -0,0 +1,169 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+)
+
+// agentRefreshInterval is how often the executor's agents are refetched while the runner is running.
+const agentRefreshInterval = 24 * time.Hour
+
+// pollLoop updates the status of submitted flows and enqueues due retries on each poll interval,
+// and refreshes the tracked agents daily, until shut down.
+func (d *DataPipelineRunner) pollLoop(done <-chan struct{}) {
+	defer d.workers.Done()
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	agentTicker := time.NewTicker(agentRefreshInterval)
+	defer agentTicker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-agentTicker.C:
+			d.SetAgents()
+		case <-ticker.C:
+			d.enqueueDueRetries()
+			d.updateCurrentFlows()
+			// agents can also be freed by flows the runner doesn't track, and failed submissions
+			// are left at the head of the queue, so dispatch is retried on every poll
+			d.wakeDispatcher()
+		}
+	}
+}
+
+// updateCurrentFlows fetches the state of the flows being tracked, and stops tracking any that
+// have failed or succeeded.  Failed flows are retried or reported to causemos, and succeeded flows
+// are reported to causemos.
+func (d *DataPipelineRunner) updateCurrentFlows() {
+	flowIDs := d.getFlowIDs()
+	if len(flowIDs) == 0 {
+		return
+	}
+	currentFlows, err := d.executor.FlowRuns(flowIDs)
+	if err != nil {
+		d.Logger.Error(err)
+		return
+	}
+
+	finished := false
+	for _, flowRun := range currentFlows {
+		if flowRun.State == StateRunning {
+			d.flowRunning(flowRun)
+		}
+		if flowRun.State != StateFailed && flowRun.State != StateCancelled && flowRun.State != StateSuccess {
+			continue
+		}
+		// the flow may have stopped being tracked (ie. cancelled) since its state was fetched
+		flow, ok := d.untrackFlow(flowRun.ID)
+		if !ok {
+			continue
+		}
+		finished = true
+		if flowRun.State == StateSuccess {
+			d.flowSucceeded(flowRun, flow)
+		} else {
+			d.flowFailed(flowRun, flow)
+		}
+	}
+
+	if finished {
+		d.saveTrackedFlows()
+		// finished flows free up slots for queued requests
+		d.wakeDispatcher()
+	}
+}
+
+// flowRunning records that a tracked flow has started running.
+func (d *DataPipelineRunner) flowRunning(flowRun FlowRun) {
+	d.mutex.RLock()
+	flow, ok := d.currentFlowIDs[flowRun.ID]
+	d.mutex.RUnlock()
+	if ok {
+		d.transitionJob(flow.Request, JobRunning, flowRun.ID, "")
+	}
+}
+
+// untrackFlow stops tracking a flow, returning false if it wasn't being tracked.
+func (d *DataPipelineRunner) untrackFlow(flowID string) (FlowData, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	flow, ok := d.currentFlowIDs[flowID]
+	if ok {
+		delete(d.currentFlowIDs, flowID)
+	}
+	return flow, ok
+}
+
+// flowFailed retries a failed flow, or reports that it failed if it has no retries left.  A request
+// that has used up its retries, or failed too many times, is moved to the dead letter store.
+func (d *DataPipelineRunner) flowFailed(flowRun FlowRun, flow FlowData) {
+	reason := fmt.Sprintf("flow run %s finished in state %s", flowRun.ID, flowRun.State)
+	var dead bool
+	var err error
+	if d.retryPolicy.Exhausted(flowRun.State, flow.Retries) {
+		dead = true
+		err = d.deadLetters.DeadLetter(flow.Request, flow.Labels, reason)
+	} else {
+		dead, err = d.deadLetters.RecordFailure(flow.Request, flow.Labels, reason)
+	}
+	if err != nil {
+		d.Logger.Error(err)
+	}
+	if dead {
+		d.Logger.Warnf("Run %s failed too many times, moved to dead letter store", flow.Request.RunID)
+	}
+
+	// the failure is only reported once there are no retries left
+	if !dead && d.retryPolicy.ShouldRetry(flowRun.State, flow.Retries) {
+		d.scheduleRetry(flowRun.ID, flow)
+		return
+	}
+	d.notifyFailed(flowRun.ID, flow, flowRun.AgentID, flowRun.State)
+	if !dead {
+		// the request is finished, so its failures mustn't count against a later resubmission
+		if err := d.deadLetters.Discard(flow.Request.RunID); err != nil {
+			d.Logger.Error(err)
+		}
+	}
+}
+
+// flowSucceeded reports that a flow succeeded.
+func (d *DataPipelineRunner) flowSucceeded(flowRun FlowRun, flow FlowData) {
+	if err := d.deadLetters.Resolve(flow.Request.RunID); err != nil {
+		d.Logger.Error(err)
+	}
+	event := flowEvent(EventSucceeded, flowRun.ID, flow)
+	event.State = flowRun.State
+	event.AgentID = flowRun.AgentID
+	d.notifier.Notify(event)
+}
+
+// notifyFailed reports that a request will not be run to completion, and the state it ended in.
+// The flow ID and agent ID are empty if the request never had a flow run.
+func (d *DataPipelineRunner) notifyFailed(flowID string, flow FlowData, agentID string, state string) {
+	event := flowEvent(EventFailed, flowID, flow)
+	event.State = state
+	event.AgentID = agentID
+	d.notifier.Notify(event)
+}
+
+// flowEvent creates an event about a request's flow run.
+func flowEvent(name string, flowID string, flow FlowData) JobEvent {
+	event := NewJobEvent(name, flow.Request)
+	event.FlowID = flowID
+	event.EnqueuedAt = flow.EnqueuedAt
+	event.SubmittedAt = flow.StartTime
+	event.Retries = flow.Retries
+	return event
+}
+
+func (d *DataPipelineRunner) getFlowIDs() []string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	ids := make([]string, 0, len(d.currentFlowIDs))
+	for k := range d.currentFlowIDs {
+		ids = append(ids, k)
+	}
+	return ids
+}
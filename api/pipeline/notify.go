@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// Message is a notification to be delivered to a subscriber.
+type Message struct {
+	// Endpoint identifies where the subscriber delivers the message (ie. "processing-succeeded").
+	Endpoint string
+	// Fallback is the endpoint notified instead once delivery to `Endpoint` has used all of its
+	// attempts.  It is skipped when empty.
+	Fallback string
+	Payload  []byte
+}
+
+// Subscriber receives notifications of job lifecycle events.
+type Subscriber interface {
+	// Name uniquely identifies the subscriber.
+	Name() string
+	// Messages returns the messages to deliver for an event, or none if the subscriber isn't
+	// interested in it.
+	Messages(event JobEvent) []Message
+	// Deliver sends a message to the subscriber, returning an error if it wasn't accepted.
+	Deliver(message Message) error
+}
+
+// DeliveryObserver is told the outcome of each message once it has been delivered, or has used
+// all of its attempts.
+type DeliveryObserver interface {
+	NotificationResult(entry OutboxEntry, err error)
+}
+
+// OutboxNotifier delivers job lifecycle events to subscribers from its own goroutine, so that a
+// slow or unreachable subscriber never holds up dispatch or flow monitoring.  Messages are stored
+// in the outbox until their subscriber accepts them.
+type OutboxNotifier struct {
+	config.Config
+	outbox      *Outbox
+	subscribers map[string]Subscriber
+	observers   []DeliveryObserver
+	stop        chan struct{}
+	done        chan struct{}
+	closed      bool
+	mutex       sync.Mutex
+}
+
+// NewOutboxNotifier creates a notifier and starts delivering the messages in the outbox.
+func NewOutboxNotifier(cfg *config.Config, outbox *Outbox, subscribers []Subscriber) *OutboxNotifier {
+	n := &OutboxNotifier{
+		Config: config.Config{
+			Logger:      cfg.Logger,
+			Environment: cfg.Environment,
+		},
+		outbox:      outbox,
+		subscribers: map[string]Subscriber{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, subscriber := range subscribers {
+		n.subscribers[subscriber.Name()] = subscriber
+	}
+	go n.run()
+	return n
+}
+
+// Notify stores the messages each subscriber wants for an event in the outbox for delivery.
+// Messages are stored even after the notifier is closed, and are delivered once the service
+// restarts.
+func (n *OutboxNotifier) Notify(event JobEvent) {
+	for name, subscriber := range n.subscribers {
+		for _, message := range subscriber.Messages(event) {
+			if _, err := n.outbox.Add(name, event.Request.RunID, message); err != nil {
+				n.Logger.Error(errors.Wrapf(err, "failed to store %s notification for %s of run %s", event.Event, name, event.Request.RunID))
+			}
+		}
+	}
+}
+
+// Observe adds an observer that is told the outcome of each delivery.
+func (n *OutboxNotifier) Observe(observer DeliveryObserver) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.observers = append(n.observers, observer)
+}
+
+// observeResult tells the observers the outcome of a delivery.
+func (n *OutboxNotifier) observeResult(entry OutboxEntry, err error) {
+	n.mutex.Lock()
+	observers := n.observers
+	n.mutex.Unlock()
+	for _, observer := range observers {
+		observer.NotificationResult(entry, err)
+	}
+}
+
+// Close stops the notifier after a final attempt to deliver the messages that are due.
+func (n *OutboxNotifier) Close() {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.stop)
+	n.mutex.Unlock()
+	<-n.done
+}
+
+// run delivers the messages in the outbox whenever one is added or retried, or a retry is due,
+// until the notifier is closed.
+func (n *OutboxNotifier) run() {
+	defer close(n.done)
+	for {
+		n.deliverDue()
+
+		// wait for the earliest retry, or indefinitely if nothing is waiting
+		timer := time.NewTimer(time.Hour)
+		if next, ok := n.outbox.NextAttempt(); ok {
+			timer.Reset(time.Until(next))
+		} else {
+			timer.Stop()
+		}
+		select {
+		case <-n.stop:
+			timer.Stop()
+			n.deliverDue()
+			return
+		case <-n.outbox.Ready():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts delivery of each message that is due.
+func (n *OutboxNotifier) deliverDue() {
+	for _, entry := range n.outbox.Due(time.Now()) {
+		n.deliver(entry)
+	}
+}
+
+// deliver sends a message to its subscriber, removing it from the outbox once it is accepted.
+// A message that has used all of its attempts is replaced by its fallback, if it has one.
+func (n *OutboxNotifier) deliver(entry OutboxEntry) {
+	subscriber, ok := n.subscribers[entry.Subscriber]
+	if !ok {
+		// the subscriber was removed from the configuration since the message was stored
+		n.Logger.Warnf("Dropping %s notification for run %s to unknown subscriber %s", entry.Endpoint, entry.RunID, entry.Subscriber)
+		if err := n.outbox.Delivered(entry.ID); err != nil {
+			n.Logger.Error(err)
+		}
+		return
+	}
+
+	err := subscriber.Deliver(Message{Endpoint: entry.Endpoint, Fallback: entry.Fallback, Payload: entry.Payload})
+	if err == nil {
+		n.Logger.Infof("Run %s notified %s of %s", entry.RunID, entry.Subscriber, entry.Endpoint)
+		if err := n.outbox.Delivered(entry.ID); err != nil {
+			n.Logger.Error(err)
+		}
+		n.observeResult(entry, nil)
+		return
+	}
+
+	n.Logger.Warnf("Error notifying %s of %s for run %s: %v", entry.Subscriber, entry.Endpoint, entry.RunID, err)
+	failed, saveErr := n.outbox.AttemptFailed(entry.ID, err)
+	if saveErr != nil {
+		n.Logger.Error(saveErr)
+	}
+	if !failed {
+		return
+	}
+	n.observeResult(entry, err)
+	n.Logger.Errorf("Failed to notify %s of %s for run %s after %d attempts", entry.Subscriber, entry.Endpoint, entry.RunID, entry.Attempts+1)
+	if entry.Fallback != "" {
+		if _, err := n.outbox.Add(entry.Subscriber, entry.RunID, Message{Endpoint: entry.Fallback, Payload: entry.Payload}); err != nil {
+			n.Logger.Error(err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package pipeline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+// newTestNotifier creates a notifier that delivers to the configured causemos instance.
+func newTestNotifier(t *testing.T, cfg *config.Config) *OutboxNotifier {
+	return NewOutboxNotifier(cfg, newTestOutbox(t, cfg.Environment), []Subscriber{NewCausemosSubscriber(cfg.Environment)})
+}
+
+// recordingNotifier keeps the events it is notified of.
+type recordingNotifier struct {
+	events []JobEvent
+	mutex  sync.Mutex
+}
+
+func (r *recordingNotifier) Notify(event JobEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recordingNotifier) Events() []JobEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]JobEvent{}, r.events...)
+}
+
+func TestNotifierRetries(t *testing.T) {
+	dir := path.Join("test_data", "notify1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	// causemos is unavailable for the first few notifications
+	var mutex sync.Mutex
+	var notified []string
+	causemos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		notified = append(notified, r.URL.Path)
+		if len(notified) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer causemos.Close()
+
+	env := &config.Environment{CausemosAddr: causemos.URL, DataPipelineTimeoutSec: 5, DataPipelineQueueDir: dir, DataPipelineOutboxName: "outbox"}
+	outbox := newTestOutbox(t, env)
+	n := NewOutboxNotifier(&config.Config{Logger: zap.NewNop().Sugar(), Environment: env}, outbox, []Subscriber{NewCausemosSubscriber(env)})
+	request := EnqueueRequestData{RunID: "run1"}
+	n.Notify(NewJobEvent(EventEnqueued, request))
+	n.Notify(NewJobEvent(EventDispatched, request))
+	n.Notify(NewJobEvent(EventSucceeded, request))
+
+	// causemos isn't told about enqueued requests, and its notifications are retried until they
+	// are delivered, in order for each run
+	assert.Eventually(t, func() bool { return len(outbox.List()) == 0 }, 5*time.Second, time.Millisecond)
+	n.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{
+		"/api/maas/pipeline-reporting/queue-runtime",
+		"/api/maas/pipeline-reporting/queue-runtime",
+		"/api/maas/pipeline-reporting/queue-runtime",
+		"/api/maas/pipeline-reporting/queue-runtime",
+		"/api/maas/pipeline-reporting/processing-succeeded",
+	}, notified)
+}
+
+func TestNotifierFallback(t *testing.T) {
+	dir := path.Join("test_data", "notify2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	var mutex sync.Mutex
+	var notified []string
+	causemos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		notified = append(notified, r.URL.Path)
+		mutex.Unlock()
+		if r.URL.Path == "/api/maas/pipeline-reporting/processing-succeeded" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer causemos.Close()
+
+	env := &config.Environment{CausemosAddr: causemos.URL, DataPipelineTimeoutSec: 5, DataPipelineQueueDir: dir, DataPipelineOutboxName: "outbox", DataPipelineOutboxMaxAttempts: 2}
+	outbox := newTestOutbox(t, env)
+	n := NewOutboxNotifier(&config.Config{Logger: zap.NewNop().Sugar(), Environment: env}, outbox, []Subscriber{NewCausemosSubscriber(env)})
+	n.Notify(NewJobEvent(EventSucceeded, EnqueueRequestData{RunID: "run1"}))
+
+	// once the notification has used all of its attempts it is marked as failed and its fallback
+	// is delivered instead
+	assert.Eventually(t, func() bool {
+		entries := outbox.List()
+		return len(entries) == 1 && entries[0].Failed
+	}, 5*time.Second, time.Millisecond)
+	n.Close()
+
+	entry := outbox.List()[0]
+	assert.Equal(t, endpointSucceeded, entry.Endpoint)
+	assert.Equal(t, 2, entry.Attempts)
+	assert.Equal(t, "response 500", entry.LastError)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{
+		"/api/maas/pipeline-reporting/processing-succeeded",
+		"/api/maas/pipeline-reporting/processing-succeeded",
+		"/api/maas/pipeline-reporting/processing-failed",
+	}, notified)
+}
+
+func TestNotifierDoesNotBlockRunner(t *testing.T) {
+	dir := path.Join("test_data", "notify3")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	release := make(chan struct{})
+	causemos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer causemos.Close()
+
+	cfg := config.Config{
+		Logger:      zap.NewNop().Sugar(),
+		Environment: &config.Environment{CausemosAddr: causemos.URL, DataPipelineTimeoutSec: 5, DataPipelineQueueDir: dir, DataPipelineOutboxName: "outbox"},
+	}
+	notifier := newTestNotifier(t, &cfg)
+	runner := &DataPipelineRunner{
+		Config:         cfg,
+		mutex:          &sync.RWMutex{},
+		currentFlowIDs: map[string]FlowData{},
+		notifier:       notifier,
+	}
+
+	// the runner's state can be read while causemos is stalled on a notification
+	runner.notifyFailed("flow1", FlowData{Request: EnqueueRequestData{RunID: "run1"}}, "", StateFailed)
+	done := make(chan struct{})
+	go func() {
+		assert.True(t, runner.IsFlowDone("flow1"))
+		assert.Equal(t, 0, runner.TrackedFlowCount())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "runner blocked by notification")
+	}
+
+	close(release)
+	notifier.Close()
+}
@@ -0,0 +1,279 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// OutboxEntry is a notification waiting to be delivered to a subscriber.
+type OutboxEntry struct {
+	ID uint64 `json:"id"`
+	// Subscriber is the name of the subscriber the notification is for.
+	Subscriber string `json:"subscriber"`
+	RunID      string `json:"run_id"`
+	Endpoint   string `json:"endpoint"`
+	// Fallback is the endpoint notified instead once delivery to `Endpoint` has used all of its
+	// attempts.  It is skipped when empty.
+	Fallback      string          `json:"fallback,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	// Failed is set once delivery has used all of its attempts.  Failed entries are kept for
+	// inspection for the failed retention period, and are no longer delivered unless they are
+	// retried.
+	Failed   bool      `json:"failed"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// Outbox holds notifications until their subscriber accepts them.  Failed deliveries are retried
+// with an exponential backoff, and every change is journaled to disk so that notifications survive
+// a restart.
+type Outbox struct {
+	journal   *journal
+	policy    RetryPolicy
+	retention time.Duration
+	pruned    time.Time
+	entries   map[uint64]*OutboxEntry
+	nextID    uint64
+	ready     chan struct{}
+	mutex     *sync.RWMutex
+}
+
+// NewOutbox creates an outbox persisted to `<name>.json` and `<name>.journal` in the queue directory,
+// reloading any notifications that were not delivered before the service last stopped.
+func NewOutbox(env *config.Environment) (*Outbox, error) {
+	outbox := &Outbox{
+		journal: newJournal(path.Join(env.DataPipelineQueueDir, env.DataPipelineOutboxName+".json")),
+		policy: RetryPolicy{
+			MaxAttempts: env.DataPipelineOutboxMaxAttempts,
+			BackoffBase: time.Duration(env.DataPipelineOutboxBackoffBaseSec) * time.Second,
+			BackoffMax:  time.Duration(env.DataPipelineOutboxBackoffMaxSec) * time.Second,
+		},
+		retention: time.Duration(env.DataPipelineOutboxFailedRetentionHours) * time.Hour,
+		entries:   map[uint64]*OutboxEntry{},
+		nextID:    1,
+		ready:     make(chan struct{}, 1),
+		mutex:     &sync.RWMutex{},
+	}
+	put := func(key string, value json.RawMessage) error {
+		entry := &OutboxEntry{}
+		if err := json.Unmarshal(value, entry); err != nil {
+			return err
+		}
+		outbox.entries[entry.ID] = entry
+		return nil
+	}
+	remove := func(key string) {
+		if id, err := strconv.ParseUint(key, 10, 64); err == nil {
+			delete(outbox.entries, id)
+		}
+	}
+	if err := outbox.journal.load(&outbox.entries, put, remove); err != nil {
+		return nil, errors.Wrap(err, "failed to load outbox")
+	}
+	for id, entry := range outbox.entries {
+		// entries stored before there were other subscribers are all for causemos
+		if entry.Subscriber == "" {
+			entry.Subscriber = CausemosSubscriberName
+		}
+		if id >= outbox.nextID {
+			outbox.nextID = id + 1
+		}
+	}
+	return outbox, nil
+}
+
+// Add stores a message to a subscriber for delivery, returning its entry.
+func (o *Outbox) Add(subscriber string, runID string, message Message) (OutboxEntry, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now()
+	entry := &OutboxEntry{
+		ID:            o.nextID,
+		Subscriber:    subscriber,
+		RunID:         runID,
+		Endpoint:      message.Endpoint,
+		Fallback:      message.Fallback,
+		Payload:       message.Payload,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	o.nextID++
+	o.entries[entry.ID] = entry
+	o.signalReady()
+	return *entry, o.save(entry.ID)
+}
+
+// Due returns the entries that are ready to be delivered, oldest first.  An entry is held back
+// while an older entry for the same run and subscriber is waiting, so that each subscriber
+// receives a run's notifications in order.
+func (o *Outbox) Due(now time.Time) []OutboxEntry {
+	due := []OutboxEntry{}
+	waiting := map[[2]string]bool{}
+	for _, entry := range o.List() {
+		if entry.Failed {
+			continue
+		}
+		key := [2]string{entry.Subscriber, entry.RunID}
+		if !waiting[key] && !now.Before(entry.NextAttemptAt) {
+			due = append(due, entry)
+		}
+		waiting[key] = true
+	}
+	return due
+}
+
+// NextAttempt returns the time of the earliest delivery attempt, or false if nothing is waiting.
+func (o *Outbox) NextAttempt() (time.Time, bool) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	var next time.Time
+	found := false
+	for _, entry := range o.entries {
+		if !entry.Failed && (!found || entry.NextAttemptAt.Before(next)) {
+			next = entry.NextAttemptAt
+			found = true
+		}
+	}
+	return next, found
+}
+
+// Delivered removes an entry that its subscriber has accepted.
+func (o *Outbox) Delivered(id uint64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if _, ok := o.entries[id]; !ok {
+		return nil
+	}
+	delete(o.entries, id)
+	return o.save(id)
+}
+
+// AttemptFailed records a failed delivery, and schedules the next attempt after a backoff.  Once
+// the entry has used all of its attempts it is marked as failed and true is returned.
+func (o *Outbox) AttemptFailed(id uint64, reason error) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry, ok := o.entries[id]
+	if !ok {
+		return false, nil
+	}
+	entry.Attempts++
+	entry.LastError = reason.Error()
+	entry.NextAttemptAt = time.Now().Add(o.policy.Backoff(entry.Attempts - 1))
+	if o.policy.MaxAttempts > 0 && entry.Attempts >= o.policy.MaxAttempts {
+		entry.Failed = true
+		entry.FailedAt = time.Now()
+	}
+	return entry.Failed, o.save(id)
+}
+
+// Retry returns a failed entry to the outbox for delivery, with its attempts reset.  False is
+// returned if there is no failed entry with the supplied ID.
+func (o *Outbox) Retry(id uint64) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry, ok := o.entries[id]
+	if !ok || !entry.Failed {
+		return false, nil
+	}
+	entry.Failed = false
+	entry.FailedAt = time.Time{}
+	entry.Attempts = 0
+	entry.NextAttemptAt = time.Now()
+	o.signalReady()
+	return true, o.save(id)
+}
+
+// Ready returns a channel that receives a value after entries are added or retried.  Signals are
+// coalesced, so a single receive may follow several changes.
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+func (o *Outbox) signalReady() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+		// a signal is already pending
+	}
+}
+
+// List returns the entries in the outbox, oldest first.
+func (o *Outbox) List() []OutboxEntry {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	entries := make([]OutboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// Close closes the outbox's journal.
+func (o *Outbox) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.journal.close()
+}
+
+// prune removes entries that have been failed for longer than the retention period.  The outbox
+// is scanned at most once per prune interval, and failed entries are kept when there's no retention
+// period.
+func (o *Outbox) prune(now time.Time) error {
+	if o.retention <= 0 || now.Sub(o.pruned) < pruneInterval {
+		return nil
+	}
+	o.pruned = now
+	for id, entry := range o.entries {
+		// entries that failed before the failure time was recorded age from when they were added
+		failedAt := entry.FailedAt
+		if failedAt.IsZero() {
+			failedAt = entry.CreatedAt
+		}
+		if entry.Failed && now.Sub(failedAt) > o.retention {
+			delete(o.entries, id)
+			if err := o.journal.remove(strconv.FormatUint(id, 10)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// save journals the current state of an entry, pruning expired entries and compacting the journal
+// when it has grown too large.
+func (o *Outbox) save(id uint64) error {
+	key := strconv.FormatUint(id, 10)
+	var err error
+	if entry, ok := o.entries[id]; ok {
+		err = o.journal.put(key, entry)
+	} else {
+		err = o.journal.remove(key)
+	}
+	if err == nil {
+		err = o.prune(time.Now())
+	}
+	if err == nil {
+		err = o.journal.compact(len(o.entries), o.entries)
+	}
+	return errors.Wrap(err, "failed to save outbox")
+}
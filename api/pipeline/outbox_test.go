@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+func newTestOutbox(t *testing.T, env *config.Environment) *Outbox {
+	outbox, err := NewOutbox(env)
+	assert.NoError(t, err)
+	return outbox
+}
+
+func TestOutbox(t *testing.T) {
+	dir := path.Join("test_data", "outbox1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	env := &config.Environment{
+		DataPipelineQueueDir:                   dir,
+		DataPipelineOutboxName:                 "outbox",
+		DataPipelineOutboxMaxAttempts:          2,
+		DataPipelineOutboxBackoffBaseSec:       60,
+		DataPipelineOutboxBackoffMaxSec:        60,
+		DataPipelineOutboxFailedRetentionHours: 1,
+	}
+	outbox := newTestOutbox(t, env)
+
+	first, err := outbox.Add(CausemosSubscriberName, "run1", Message{Endpoint: endpointQueueRuntime, Payload: []byte(`{"run_id":"run1"}`)})
+	assert.NoError(t, err)
+	second, err := outbox.Add(CausemosSubscriberName, "run1", Message{Endpoint: endpointSucceeded, Fallback: endpointFailed, Payload: []byte(`{"run_id":"run1"}`)})
+	assert.NoError(t, err)
+	third, err := outbox.Add(CausemosSubscriberName, "run2", Message{Endpoint: endpointQueueRuntime, Payload: []byte(`{"run_id":"run2"}`)})
+	assert.NoError(t, err)
+	webhook, err := outbox.Add("webhook", "run1", Message{Endpoint: EventDispatched, Payload: []byte(`{"run_id":"run1"}`)})
+	assert.NoError(t, err)
+
+	// a run's later notifications wait for its earlier ones to the same subscriber
+	now := time.Now()
+	assert.Equal(t, []uint64{first.ID, third.ID, webhook.ID}, entryIDs(outbox.Due(now)))
+	assert.NoError(t, outbox.Delivered(webhook.ID))
+
+	// failed attempts are retried after a backoff
+	failed, err := outbox.AttemptFailed(first.ID, errors.New("response 503"))
+	assert.NoError(t, err)
+	assert.False(t, failed)
+	assert.Equal(t, []uint64{third.ID}, entryIDs(outbox.Due(now)))
+	assert.Equal(t, []uint64{first.ID, third.ID}, entryIDs(outbox.Due(now.Add(time.Hour))))
+	assert.NoError(t, outbox.Delivered(third.ID))
+
+	// entries are kept once they have used all of their attempts, until they are retried
+	failed, err = outbox.AttemptFailed(first.ID, errors.New("response 503"))
+	assert.NoError(t, err)
+	assert.True(t, failed)
+	assert.Equal(t, []uint64{second.ID}, entryIDs(outbox.Due(now.Add(2*time.Hour))))
+	found, err := outbox.Retry(first.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = outbox.Retry(second.ID)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// undelivered entries survive a restart
+	outbox = newTestOutbox(t, env)
+	entries := outbox.List()
+	assert.Equal(t, []uint64{first.ID, second.ID}, entryIDs(entries))
+	assert.Equal(t, 0, entries[0].Attempts)
+	assert.Equal(t, "response 503", entries[0].LastError)
+	assert.JSONEq(t, `{"run_id":"run1"}`, string(entries[1].Payload))
+	assert.Equal(t, endpointFailed, entries[1].Fallback)
+
+	added, err := outbox.Add(CausemosSubscriberName, "run3", Message{Endpoint: endpointQueueRuntime, Payload: []byte(`{}`)})
+	assert.NoError(t, err)
+	assert.Greater(t, added.ID, second.ID)
+
+	// failed entries are removed once the retention period has passed, which survives a restart
+	for i := 0; i < 2; i++ {
+		_, err = outbox.AttemptFailed(second.ID, errors.New("response 503"))
+		assert.NoError(t, err)
+	}
+	outbox.entries[second.ID].FailedAt = time.Now().Add(-2 * time.Hour)
+	outbox.pruned = time.Time{}
+	assert.NoError(t, outbox.Delivered(added.ID))
+	assert.NoError(t, outbox.Close())
+	outbox = newTestOutbox(t, env)
+	assert.Equal(t, []uint64{first.ID}, entryIDs(outbox.List()))
+}
+
+func entryIDs(entries []OutboxEntry) []uint64 {
+	ids := []uint64{}
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
@@ -0,0 +1,181 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// readJSONFile decodes the contents of a JSON file into `v`.  A missing file is not an error, and
+// leaves `v` unchanged.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	return errors.Wrapf(json.Unmarshal(data, v), "failed to decode %s", path)
+}
+
+// writeJSONFile encodes `v` as JSON and writes it to a file.  The data is written to a temporary
+// file that is renamed into place, so a crash never leaves a partially written file.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "failed to create dir for %s", path)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, path), "failed to write %s", path)
+}
+
+// pruneInterval is the least time between scans of a store for expired entries to remove.
+const pruneInterval = time.Minute
+
+// journalCompactMin is the fewest changes a journal holds before it is compacted.
+const journalCompactMin = 1000
+
+// journalRecord is a change to a keyed collection.  A record without a value removes its key.
+type journalRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// journal persists a keyed collection as a JSON snapshot and an append-only log of the changes
+// made since the snapshot was written, so that each change is a single small write rather than a
+// rewrite of the whole collection.  The log is compacted into a new snapshot once it holds more
+// changes than the collection has entries, which keeps the cost of writing snapshots proportional
+// to the number of changes.  Every record holds the full value of its key, so replaying a log over
+// a snapshot that already includes it (ie. after a crash part way through a compaction) gives the
+// same result.  Journals are not thread safe - callers are expected to synchronize access.
+type journal struct {
+	snapshot string
+	path     string
+	file     *os.File
+	changes  int
+}
+
+// newJournal creates a journal for the snapshot at `snapshot`, logging changes to a file of the same
+// name with a `.journal` extension.
+func newJournal(snapshot string) *journal {
+	return &journal{
+		snapshot: snapshot,
+		path:     strings.TrimSuffix(snapshot, filepath.Ext(snapshot)) + ".journal",
+	}
+}
+
+// load decodes the snapshot into `v`, then calls `put` or `remove` for each change in the log, in
+// order.  A partially written final record, left by a crash, is discarded.
+func (j *journal) load(v interface{}, put func(key string, value json.RawMessage) error, remove func(key string)) error {
+	if err := readJSONFile(j.snapshot, v); err != nil {
+		return err
+	}
+	file, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to read %s", j.path)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return errors.Wrapf(os.Truncate(j.path, offset), "failed to truncate %s", j.path)
+			}
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read %s", j.path)
+		}
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return errors.Wrapf(err, "failed to decode %s", j.path)
+		}
+		if len(record.Value) == 0 {
+			remove(record.Key)
+		} else if err := put(record.Key, record.Value); err != nil {
+			return errors.Wrapf(err, "failed to decode %s", j.path)
+		}
+		offset += int64(len(line))
+		j.changes++
+	}
+}
+
+// put logs the value of a key.
+func (j *journal) put(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", j.path)
+	}
+	return j.append(journalRecord{Key: key, Value: data})
+}
+
+// remove logs the removal of a key.
+func (j *journal) remove(key string) error {
+	return j.append(journalRecord{Key: key})
+}
+
+func (j *journal) append(record journalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", j.path)
+	}
+	if j.file == nil {
+		if err := os.MkdirAll(filepath.Dir(j.path), os.ModePerm); err != nil {
+			return errors.Wrapf(err, "failed to create dir for %s", j.path)
+		}
+		file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %s", j.path)
+		}
+		j.file = file
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrapf(err, "failed to write %s", j.path)
+	}
+	j.changes++
+	return nil
+}
+
+// compact writes `v` as the new snapshot and empties the log, if the log holds more changes than
+// the `size` entries of the collection.
+func (j *journal) compact(size int, v interface{}) error {
+	if j.changes < journalCompactMin || j.changes <= size {
+		return nil
+	}
+	if err := writeJSONFile(j.snapshot, v); err != nil {
+		return err
+	}
+	if err := os.Truncate(j.path, 0); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to truncate %s", j.path)
+	}
+	j.changes = 0
+	return nil
+}
+
+// close closes the log file.  The journal can still be written to, which reopens the file.
+func (j *journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return errors.Wrapf(err, "failed to close %s", j.path)
+}
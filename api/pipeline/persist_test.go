@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestJournal(t *testing.T, snapshot string) (*journal, map[string]int) {
+	values := map[string]int{}
+	j := newJournal(snapshot)
+	err := j.load(&values, func(key string, value json.RawMessage) error {
+		var v int
+		err := json.Unmarshal(value, &v)
+		values[key] = v
+		return err
+	}, func(key string) {
+		delete(values, key)
+	})
+	assert.NoError(t, err)
+	return j, values
+}
+
+func TestJournal(t *testing.T) {
+	dir := path.Join("test_data", "journal1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+	snapshot := path.Join(dir, "values.json")
+
+	j, values := loadTestJournal(t, snapshot)
+	assert.Empty(t, values)
+	assert.NoError(t, j.put("a", 1))
+	assert.NoError(t, j.put("b", 2))
+	assert.NoError(t, j.put("a", 3))
+	assert.NoError(t, j.remove("b"))
+	assert.NoError(t, j.close())
+
+	// changes are replayed in order, and a partially written record is discarded
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`{"key": "c", "val`)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	j, values = loadTestJournal(t, snapshot)
+	assert.Equal(t, map[string]int{"a": 3}, values)
+	assert.NoError(t, j.put("c", 4))
+
+	// the log is only compacted once it holds more changes than there are values
+	assert.NoError(t, j.compact(1, values))
+	_, err = os.Stat(snapshot)
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < journalCompactMin; i++ {
+		key := fmt.Sprintf("key%d", i)
+		values[key] = i
+		assert.NoError(t, j.put(key, i))
+	}
+	values["c"] = 4
+	assert.NoError(t, j.compact(len(values), values))
+	info, err := os.Stat(j.path)
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// changes after a compaction are replayed over the snapshot
+	assert.NoError(t, j.remove("a"))
+	assert.NoError(t, j.close())
+	_, reloaded := loadTestJournal(t, snapshot)
+	delete(values, "a")
+	assert.Equal(t, values, reloaded)
+}
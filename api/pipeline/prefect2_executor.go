@@ -0,0 +1,265 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// Prefect 2 state types mapped to the executor flow run states.
+var prefect2States = map[string]string{
+	"SCHEDULED":  StateScheduled,
+	"PENDING":    StateSubmitted,
+	"RUNNING":    StateRunning,
+	"PAUSED":     StateRunning,
+	"CANCELLING": StateRunning,
+	"COMPLETED":  StateSuccess,
+	"FAILED":     StateFailed,
+	"CRASHED":    StateFailed,
+	"CANCELLED":  StateCancelled,
+}
+
+// Prefect 2 state types of flow runs that have not finished.
+var prefect2ActiveStates = []string{"SCHEDULED", "PENDING", "RUNNING", "PAUSED", "CANCELLING"}
+
+// Prefect2Executor runs the data pipeline flow from a Prefect 2 deployment through the prefect
+// REST API.  Prefect 2 has no agent labels, so the work queues of the configured work pool stand in
+// for agents - a flow run submitted with an agent's labels is sent to the work queue of that name.
+type Prefect2Executor struct {
+	env          *config.Environment
+	httpClient   *http.Client
+	mutex        *sync.Mutex
+	deploymentID string
+}
+
+// NewPrefect2Executor creates an executor for the prefect 2 API at the configured address.
+func NewPrefect2Executor(env *config.Environment) *Prefect2Executor {
+	return &Prefect2Executor{
+		env:        env,
+		httpClient: &http.Client{Timeout: time.Second * time.Duration(env.DataPipelineTimeoutSec)},
+		mutex:      &sync.Mutex{},
+	}
+}
+
+type prefect2State struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type prefect2FlowRun struct {
+	ID            string          `json:"id"`
+	Name          string          `json:"name"`
+	Created       time.Time       `json:"created"`
+	Parameters    json.RawMessage `json:"parameters"`
+	State         *prefect2State  `json:"state"`
+	WorkQueueName string          `json:"work_queue_name"`
+}
+
+type prefect2WorkQueue struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type prefect2Deployment struct {
+	ID string `json:"id"`
+}
+
+type prefect2Filter struct {
+	FlowRuns    map[string]interface{} `json:"flow_runs,omitempty"`
+	Deployments map[string]interface{} `json:"deployments,omitempty"`
+}
+
+// Agents returns the work queues of the configured work pool, other than those with the label to
+// ignore in their name.
+func (p *Prefect2Executor) Agents() ([]Agent, error) {
+	endpoint := "/work_queues/filter"
+	if p.env.DataPipelineWorkPool != "" {
+		endpoint = fmt.Sprintf("/work_pools/%s/queues/filter", url.PathEscape(p.env.DataPipelineWorkPool))
+	}
+
+	var queues []prefect2WorkQueue
+	if err := p.post(endpoint, struct{}{}, &queues); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch work queues")
+	}
+
+	agents := []Agent{}
+	for _, queue := range queues {
+		if p.env.AgentLabelToIgnore != "" && strings.Contains(queue.Name, p.env.AgentLabelToIgnore) {
+			continue
+		}
+		// flow runs report the name of their work queue, so it's used as the ID
+		agents = append(agents, Agent{ID: queue.Name, Name: queue.Name, Labels: []string{queue.Name}})
+	}
+	return agents, nil
+}
+
+// ActiveFlowRuns fetches the scheduled/pending/running flow runs of the data pipeline deployment.
+func (p *Prefect2Executor) ActiveFlowRuns() ([]FlowRun, error) {
+	return p.filterFlowRuns(map[string]interface{}{
+		"state": map[string]interface{}{"type": map[string]interface{}{"any_": prefect2ActiveStates}},
+	})
+}
+
+// FlowRuns fetches the flow runs of the data pipeline deployment with the supplied IDs.
+func (p *Prefect2Executor) FlowRuns(ids []string) ([]FlowRun, error) {
+	return p.filterFlowRuns(map[string]interface{}{
+		"id": map[string]interface{}{"any_": ids},
+	})
+}
+
+func (p *Prefect2Executor) filterFlowRuns(flowRunFilter map[string]interface{}) ([]FlowRun, error) {
+	deploymentID, err := p.getDeploymentID()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := prefect2Filter{
+		FlowRuns:    flowRunFilter,
+		Deployments: map[string]interface{}{"id": map[string]interface{}{"any_": []string{deploymentID}}},
+	}
+	var respData []prefect2FlowRun
+	if err := p.post("/flow_runs/filter", filter, &respData); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch flow runs")
+	}
+
+	runs := make([]FlowRun, len(respData))
+	for i, run := range respData {
+		runs[i] = FlowRun{
+			ID:         run.ID,
+			Name:       run.Name,
+			Created:    run.Created,
+			Parameters: run.Parameters,
+			AgentID:    run.WorkQueueName,
+		}
+		if run.State != nil {
+			runs[i].State = prefect2States[run.State.Type]
+		}
+	}
+	return runs, nil
+}
+
+// Submit creates a flow run of the data pipeline deployment.  The run is sent to the work queue
+// named by the first of its labels.
+func (p *Prefect2Executor) Submit(request *KeyedEnqueueRequestData, labels []string) (string, error) {
+	deploymentID, err := p.getDeploymentID()
+	if err != nil {
+		return "", err
+	}
+
+	body := map[string]interface{}{
+		"name":       fmt.Sprintf("%s:%s", request.ModelID, request.RunID),
+		"parameters": json.RawMessage(request.RequestData),
+	}
+	if len(request.Labels) > 0 {
+		labels = request.Labels
+	}
+	if len(labels) > 0 {
+		body["work_queue_name"] = labels[0]
+	}
+	if key := idempotencyKey(p.env, request); key != "" {
+		body["idempotency_key"] = key
+	}
+
+	var respData prefect2FlowRun
+	if err := p.post(fmt.Sprintf("/deployments/%s/create_flow_run", deploymentID), body, &respData); err != nil {
+		return "", errors.Wrap(err, "failed to run flow")
+	}
+	return respData.ID, nil
+}
+
+// Cancel asks for a flow run to be cancelled.  The flow run moves to cancelling, and is cancelled
+// once its worker has stopped it.
+func (p *Prefect2Executor) Cancel(flowID string) error {
+	body := map[string]interface{}{
+		"state": prefect2State{Type: "CANCELLING", Name: "Cancelling"},
+	}
+	if err := p.post(fmt.Sprintf("/flow_runs/%s/set_state", flowID), body, nil); err != nil {
+		return errors.Wrapf(err, "failed to cancel flow run %s", flowID)
+	}
+	return nil
+}
+
+// Looks up the ID of the data pipeline deployment, which is cached once found.
+func (p *Prefect2Executor) getDeploymentID() (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.deploymentID != "" {
+		return p.deploymentID, nil
+	}
+
+	deploymentID, err := p.fetchDeploymentID()
+	if err != nil {
+		return "", err
+	}
+	p.deploymentID = deploymentID
+	return p.deploymentID, nil
+}
+
+// CheckFlow returns an error if the configured deployment of the flow doesn't exist.  Unlike
+// submissions, the check doesn't use the cached deployment ID.
+func (p *Prefect2Executor) CheckFlow() error {
+	_, err := p.fetchDeploymentID()
+	return err
+}
+
+func (p *Prefect2Executor) fetchDeploymentID() (string, error) {
+	endpoint := fmt.Sprintf("/deployments/name/%s/%s",
+		url.PathEscape(p.env.DataPipelineFlowName), url.PathEscape(p.env.DataPipelineDeploymentName))
+	var deployment prefect2Deployment
+	if err := p.do(http.MethodGet, endpoint, nil, &deployment); err != nil {
+		return "", errors.Wrapf(err, "failed to fetch deployment '%s' of flow '%s'",
+			p.env.DataPipelineDeploymentName, p.env.DataPipelineFlowName)
+	}
+	return deployment.ID, nil
+}
+
+func (p *Prefect2Executor) post(endpoint string, body interface{}, result interface{}) error {
+	return p.do(http.MethodPost, endpoint, body, result)
+}
+
+// Sends a request to the prefect API, decoding the response into result when it isn't nil.
+func (p *Prefect2Executor) do(method string, endpoint string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return errors.Wrap(err, "failed to marshal request")
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(p.env.DataPipelineAddr, "/")+endpoint, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-type", "application/json")
+	if p.env.DataPipelineAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.env.DataPipelineAPIKey)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("prefect returned %d: %s", resp.StatusCode, respBody)
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(respBody, result), "failed to unmarshal response")
+}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// newPrefect2Server stands in for the prefect 2 API, serving a single deployment and recording the
+// bodies of the requests it receives by path.
+func newPrefect2Server(t *testing.T, requests map[string]map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/deployments/name/data-pipeline/default", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id": "deployment1"}`))
+	})
+	mux.HandleFunc("/api/deployments/deployment1/create_flow_run", func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path] = decodeBody(t, r)
+		_, _ = w.Write([]byte(`{"id": "flow1", "name": "model:run1", "state": {"type": "SCHEDULED"}}`))
+	})
+	mux.HandleFunc("/api/flow_runs/filter", func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path] = decodeBody(t, r)
+		_, _ = w.Write([]byte(`[
+			{"id": "flow1", "name": "model:run1", "state": {"type": "RUNNING"}, "parameters": {"run_id": "run1"}, "work_queue_name": "gpu"},
+			{"id": "flow2", "name": "model:run2", "state": {"type": "CRASHED"}, "parameters": {"run_id": "run2"}},
+			{"id": "flow3", "name": "model:run3", "state": {"type": "COMPLETED"}, "parameters": {"run_id": "run3"}}
+		]`))
+	})
+	mux.HandleFunc("/api/work_pools/pool1/queues/filter", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id": "q1", "name": "default"}, {"id": "q2", "name": "gpu"}, {"id": "q3", "name": "non-dask"}]`))
+	})
+	mux.HandleFunc("/api/flow_runs/flow1/set_state", func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path] = decodeBody(t, r)
+		_, _ = w.Write([]byte(`{"status": "ACCEPT"}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func decodeBody(t *testing.T, r *http.Request) map[string]interface{} {
+	var body map[string]interface{}
+	assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	return body
+}
+
+func TestPrefect2Executor(t *testing.T) {
+	requests := map[string]map[string]interface{}{}
+	server := newPrefect2Server(t, requests)
+	defer server.Close()
+
+	executor := NewPrefect2Executor(&config.Environment{
+		DataPipelineAddr:              server.URL + "/api",
+		DataPipelineFlowName:          "data-pipeline",
+		DataPipelineDeploymentName:    "default",
+		DataPipelineWorkPool:          "pool1",
+		DataPipelineIdempotencyChecks: config.IdempotencyAll,
+		AgentLabelToIgnore:            "non-dask",
+	})
+
+	// work queues stand in for agents
+	agents, err := executor.Agents()
+	assert.NoError(t, err)
+	assert.Equal(t, []Agent{
+		{ID: "default", Name: "default", Labels: []string{"default"}},
+		{ID: "gpu", Name: "gpu", Labels: []string{"gpu"}},
+	}, agents)
+
+	request := &KeyedEnqueueRequestData{
+		EnqueueRequestData: EnqueueRequestData{ModelID: "model", RunID: "run1", RequestData: []byte(`{"run_id": "run1"}`)},
+		RequestKey:         255,
+	}
+	flowID, err := executor.Submit(request, []string{"gpu"})
+	assert.NoError(t, err)
+	assert.Equal(t, "flow1", flowID)
+	submitted := requests["/api/deployments/deployment1/create_flow_run"]
+	assert.Equal(t, "model:run1", submitted["name"])
+	assert.Equal(t, map[string]interface{}{"run_id": "run1"}, submitted["parameters"])
+	assert.Equal(t, "gpu", submitted["work_queue_name"])
+	assert.Equal(t, "ff", submitted["idempotency_key"])
+
+	// prefect 2 states are mapped to the executor states
+	runs, err := executor.FlowRuns([]string{"flow1", "flow2", "flow3"})
+	assert.NoError(t, err)
+	assert.Len(t, runs, 3)
+	assert.Equal(t, StateRunning, runs[0].State)
+	assert.Equal(t, "gpu", runs[0].AgentID)
+	assert.Equal(t, StateFailed, runs[1].State)
+	assert.Equal(t, StateSuccess, runs[2].State)
+	assert.JSONEq(t, `{"run_id": "run3"}`, string(runs[2].Parameters))
+	filter := requests["/api/flow_runs/filter"]
+	assert.Equal(t, map[string]interface{}{"id": map[string]interface{}{"any_": []interface{}{"flow1", "flow2", "flow3"}}}, filter["flow_runs"])
+	assert.Equal(t, map[string]interface{}{"id": map[string]interface{}{"any_": []interface{}{"deployment1"}}}, filter["deployments"])
+
+	_, err = executor.ActiveFlowRuns()
+	assert.NoError(t, err)
+	filter = requests["/api/flow_runs/filter"]
+	assert.Equal(t, map[string]interface{}{"state": map[string]interface{}{"type": map[string]interface{}{"any_": []interface{}{"SCHEDULED", "PENDING", "RUNNING", "PAUSED", "CANCELLING"}}}}, filter["flow_runs"])
+
+	err = executor.Cancel("flow1")
+	assert.NoError(t, err)
+	assert.Equal(t, "CANCELLING", requests["/api/flow_runs/flow1/set_state"]["state"].(map[string]interface{})["type"])
+	assert.NotContains(t, requests["/api/flow_runs/flow1/set_state"], "force")
+
+	// errors from prefect are returned
+	err = executor.Cancel("flow2")
+	assert.Error(t, err)
+}
@@ -0,0 +1,315 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/machinebox/graphql"
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// PrefectExecutor runs the data pipeline flow on a Prefect Server (1.x) through its GraphQL API.
+type PrefectExecutor struct {
+	client *graphql.Client
+	env    *config.Environment
+}
+
+// NewPrefectExecutor creates an executor for the prefect server at the configured address.
+func NewPrefectExecutor(env *config.Environment) *PrefectExecutor {
+	// standard http client with our timeout
+	httpClient := &http.Client{Timeout: time.Second * time.Duration(env.DataPipelineTimeoutSec)}
+
+	// graphql client that uses our http  client - our timeout is applied transitively
+	graphQLClient := graphql.NewClient(env.DataPipelineAddr, graphql.WithHTTPClient(httpClient))
+
+	return &PrefectExecutor{
+		client: graphQLClient,
+		env:    env,
+	}
+}
+
+type prefectAgent struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+// Current non-dask agents in prefect
+type prefectAgents struct {
+	Agents []prefectAgent `json:"agent"`
+}
+
+// Agents returns the prefect agents that don't have the label to ignore.
+func (p *PrefectExecutor) Agents() ([]Agent, error) {
+	query := graphql.NewRequest(
+		`query {
+			agent(
+				where: {
+				  _not:{
+					labels:{_contains: "` + p.env.AgentLabelToIgnore + `"}
+				  }
+				}
+			  ) {
+				id
+				name
+				labels
+			  }
+		}`,
+	)
+
+	var respData prefectAgents
+	if err := p.client.Run(context.Background(), query, &respData); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch agents")
+	}
+
+	agents := make([]Agent, len(respData.Agents))
+	for i, agent := range respData.Agents {
+		agents[i] = Agent(agent)
+	}
+	return agents, nil
+}
+
+// Status of prefect flow runs.
+type flowRuns struct {
+	FlowRun []struct {
+		ID         string          `json:"id"`
+		Name       string          `json:"name"`
+		State      string          `json:"state"`
+		Created    time.Time       `json:"created"`
+		Parameters json.RawMessage `json:"parameters"`
+		Agent      prefectAgent    `json:"agent"`
+	} `json:"flow_run"`
+}
+
+// ActiveFlowRuns fetches the submitted/scheduled/running data pipeline flow runs from prefect.
+func (p *PrefectExecutor) ActiveFlowRuns() ([]FlowRun, error) {
+	queryString := fmt.Sprintf(
+		`query {
+			flow_run(where: {
+			  _and: [{
+				_or: [
+					{state: {_eq: "Submitted"}}
+					{state: {_eq: "Scheduled"}}
+					{state: {_eq: "Running"}}
+				]
+			  }, {
+					flow: { _and: [{ name: {_eq: "%s"}}, { project: { name: {_eq: "%s"}}}]}
+			  }
+			  ]
+			}) {
+			  id
+			  name
+			  state
+			  created
+			  parameters
+			  agent {
+				  id
+				  name
+				  labels
+			  }
+			}
+		  }`, p.env.DataPipelineFlowName, p.env.DataPipelineProjectName)
+
+	return p.runFlowRunQuery(queryString)
+}
+
+// FlowRuns fetches the data pipeline flow runs with the supplied IDs from prefect.
+func (p *PrefectExecutor) FlowRuns(ids []string) ([]FlowRun, error) {
+	idList, err := json.Marshal(ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal flow run ids")
+	}
+
+	queryString := fmt.Sprintf(
+		`query {
+			flow_run(where: {
+			  _and: [{
+					id: {_in: %s}
+			  }, {
+					flow: { _and: [{ name: {_eq: "%s"}}, { project: { name: {_eq: "%s"}}}]}
+			  }
+			  ]
+			}) {
+			  id
+			  name
+			  state
+			  created
+			  parameters
+			}
+		  }`, idList, p.env.DataPipelineFlowName, p.env.DataPipelineProjectName)
+
+	return p.runFlowRunQuery(queryString)
+}
+
+func (p *PrefectExecutor) runFlowRunQuery(queryString string) ([]FlowRun, error) {
+	query := graphql.NewRequest(queryString)
+
+	// run it and capture the response
+	var respData flowRuns
+	if err := p.client.Run(context.Background(), query, &respData); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch flow runs")
+	}
+
+	runs := make([]FlowRun, len(respData.FlowRun))
+	for i, run := range respData.FlowRun {
+		runs[i] = FlowRun{
+			ID:         run.ID,
+			Name:       run.Name,
+			State:      run.State,
+			Created:    run.Created,
+			Parameters: run.Parameters,
+			AgentID:    run.Agent.ID,
+		}
+	}
+	return runs, nil
+}
+
+type flowResponse struct {
+	Flow []struct {
+		VersionGroupID string `json:"version_group_id"`
+	} `json:"flow"`
+}
+type flowSubmissionResponse struct {
+	CreateFlowRun struct {
+		ID string
+	} `json:"create_flow_run"`
+}
+
+// Submit submits a flow run request to prefect.
+func (p *PrefectExecutor) Submit(request *KeyedEnqueueRequestData, labels []string) (string, error) {
+	// compose the run name
+	runName := fmt.Sprintf("%s:%s", request.ModelID, request.RunID)
+
+	flowVersionGroupID, err := p.flowVersionGroupID()
+	if err != nil {
+		return "", err
+	}
+
+	// prefect server expects JSON to be escaped and without newlines/tabs
+	buffer := bytes.Buffer{}
+	if err := json.Compact(&buffer, request.RequestData); err != nil {
+		return "", errors.Wrap(err, "failed to compact request JSON")
+	}
+	escaped := strings.ReplaceAll(buffer.String(), `"`, `\"`)
+
+	// Define a task submission query
+	// ** NOTE: Using a GraphQL variable for the `parameters` field generates an error on the server,
+	// and the same error can be replicated through the Prefect "Interactive API" in the UI.  It seems
+	// to a bug in how the prefect server parses the JSON stored in the parameters string.  For now the
+	// best we can do is include the JSON through string formatting.
+	requestStr := fmt.Sprintf("mutation($id: String, $runName: String, $labels: [String!], $key: String) {"+
+		"create_flow_run(input: { "+
+		"   idempotency_key: $key, "+
+		"	version_group_id: $id, "+
+		"	flow_run_name: $runName, "+
+		"	labels: $labels, "+
+		"	parameters: \"%s\""+
+		"}) { "+
+		"	id "+
+		"}"+
+		"}", escaped)
+
+	mutation := graphql.NewRequest(requestStr)
+
+	mutation.Var("id", flowVersionGroupID)
+	mutation.Var("runName", runName)
+	if len(request.Labels) > 0 {
+		mutation.Var("labels", request.Labels)
+	} else if len(labels) > 0 {
+		mutation.Var("labels", labels)
+	}
+
+	if key := idempotencyKey(p.env, request); key != "" {
+		mutation.Var("key", key)
+	}
+
+	var respData flowSubmissionResponse
+	// run it and capture the response
+	if err := p.client.Run(context.Background(), mutation, &respData); err != nil {
+		return respData.CreateFlowRun.ID, errors.Wrap(err, "failed to run flow")
+	}
+	return respData.CreateFlowRun.ID, nil
+}
+
+// CheckFlow returns an error if the configured flow doesn't exist in the configured project.
+func (p *PrefectExecutor) CheckFlow() error {
+	_, err := p.flowVersionGroupID()
+	return err
+}
+
+// flowVersionGroupID looks up the version group of the configured flow, which flow runs are
+// created from.
+func (p *PrefectExecutor) flowVersionGroupID() (string, error) {
+	query := graphql.NewRequest(fmt.Sprintf(`
+		query {
+			flow(where: {
+				_and: [
+					{name: { _eq: "%s"}},
+					{ project: { name: { _eq: "%s"}}}
+				]
+			}) {
+				version_group_id
+			}
+		}
+	`, p.env.DataPipelineFlowName, p.env.DataPipelineProjectName))
+
+	var resData flowResponse
+	// run it and capture the response
+	if err := p.client.Run(context.Background(), query, &resData); err != nil {
+		return "", errors.Wrap(err, "failed to fetch flow information")
+	}
+
+	if len(resData.Flow) == 0 {
+		return "", fmt.Errorf("flow, '%s' with project, '%s', does not exist", p.env.DataPipelineFlowName, p.env.DataPipelineProjectName)
+	}
+	return resData.Flow[0].VersionGroupID, nil
+}
+
+// idempotencyKey returns the key to use for prefect's idempotency checks - if a pipeline is run to
+// completion, SUCESSFULLY or UNSUCESSFULLY, an attempt to re-run with the same key will result in it
+// being skipped.  Retries and requeues from the dead letter store get their own key so that they
+// aren't skipped as a repeat of the failed run.  An empty key is returned when prefect's idempotency
+// checks are disabled.
+func idempotencyKey(env *config.Environment, request *KeyedEnqueueRequestData) string {
+	if !config.UsePrefectIdempotency(env.DataPipelineIdempotencyChecks) {
+		return ""
+	}
+	key := strconv.FormatUint(uint64(request.RequestKey), 16)
+	if request.Requeues > 0 {
+		key = fmt.Sprintf("%s-requeue-%d", key, request.Requeues)
+	}
+	if request.Retries > 0 {
+		key = fmt.Sprintf("%s-retry-%d", key, request.Retries)
+	}
+	return key
+}
+
+type cancelFlowRunResponse struct {
+	CancelFlowRun struct {
+		State string `json:"state"`
+	} `json:"cancel_flow_run"`
+}
+
+// Cancel cancels a flow run in prefect.
+func (p *PrefectExecutor) Cancel(flowID string) error {
+	mutation := graphql.NewRequest(`
+		mutation($id: UUID!) {
+			cancel_flow_run(input: { flow_run_id: $id }) {
+				state
+			}
+		}`)
+	mutation.Var("id", flowID)
+
+	var respData cancelFlowRunResponse
+	if err := p.client.Run(context.Background(), mutation, &respData); err != nil {
+		return errors.Wrapf(err, "failed to cancel flow run %s", flowID)
+	}
+	return nil
+}
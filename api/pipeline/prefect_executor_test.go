@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+func TestPrefectExecutorSubmit(t *testing.T) {
+	var variables map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(body.Query, "create_flow_run") {
+			variables = body.Variables
+			_, _ = w.Write([]byte(`{"data": {"create_flow_run": {"id": "flow1"}}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": {"flow": [{"version_group_id": "group1"}]}}`))
+	}))
+	defer server.Close()
+
+	executor := NewPrefectExecutor(&config.Environment{DataPipelineAddr: server.URL, DataPipelineIdempotencyChecks: config.IdempotencyAll})
+	request := &KeyedEnqueueRequestData{
+		EnqueueRequestData: EnqueueRequestData{ModelID: "model", RunID: "run1", RequestData: []byte(`{"run_id": "run1"}`)},
+		RequestKey:         255,
+		Retries:            2,
+	}
+
+	flowID, err := executor.Submit(request, []string{"agent-label"})
+	assert.NoError(t, err)
+	assert.Equal(t, "flow1", flowID)
+	assert.Equal(t, "group1", variables["id"])
+	assert.Equal(t, "model:run1", variables["runName"])
+	assert.Equal(t, []interface{}{"agent-label"}, variables["labels"])
+	assert.Equal(t, "ff-retry-2", variables["key"])
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	env := &config.Environment{DataPipelineIdempotencyChecks: config.IdempotencyAll}
+	request := &KeyedEnqueueRequestData{EnqueueRequestData: EnqueueRequestData{RunID: "run1"}, RequestKey: 255}
+	assert.Equal(t, "ff", idempotencyKey(env, request))
+
+	// a request requeued from the dead letter store isn't skipped as a repeat of the failed run,
+	// nor are its retries
+	request.Requeues = 1
+	assert.Equal(t, "ff-requeue-1", idempotencyKey(env, request))
+	request.Retries = 1
+	assert.Equal(t, "ff-requeue-1-retry-1", idempotencyKey(env, request))
+	request.Requeues = 2
+	assert.Equal(t, "ff-requeue-2-retry-1", idempotencyKey(env, request))
+
+	env.DataPipelineIdempotencyChecks = config.IdempotencyNone
+	assert.Equal(t, "", idempotencyKey(env, request))
+}
+
+func TestPrefectExecutorFlowRuns(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query string `json:"query"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(body.Query, "agent(") {
+			_, _ = w.Write([]byte(`{"data": {"agent": [{"id": "agent1", "name": "dask", "labels": ["dask"]}]}}`))
+			return
+		}
+		assert.Contains(t, body.Query, `id: {_in: ["flow1","flow2"]}`)
+		_, _ = w.Write([]byte(`{"data": {"flow_run": [
+			{"id": "flow1", "name": "model:run1", "state": "Running", "parameters": {"run_id": "run1"}, "agent": {"id": "agent1"}},
+			{"id": "flow2", "name": "model:run2", "state": "Success", "parameters": {"run_id": "run2"}}
+		]}}`))
+	}))
+	defer server.Close()
+
+	executor := NewPrefectExecutor(&config.Environment{DataPipelineAddr: server.URL})
+
+	runs, err := executor.FlowRuns([]string{"flow1", "flow2"})
+	assert.NoError(t, err)
+	assert.Len(t, runs, 2)
+	assert.Equal(t, StateRunning, runs[0].State)
+	assert.Equal(t, "agent1", runs[0].AgentID)
+	assert.Equal(t, StateSuccess, runs[1].State)
+	assert.JSONEq(t, `{"run_id": "run2"}`, string(runs[1].Parameters))
+
+	agents, err := executor.Agents()
+	assert.NoError(t, err)
+	assert.Equal(t, []Agent{{ID: "agent1", Name: "dask", Labels: []string{"dask"}}}, agents)
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReconciledFlow identifies a flow run found during reconciliation.
+type ReconciledFlow struct {
+	FlowID  string `json:"flow_id"`
+	Name    string `json:"name"`
+	ModelID string `json:"model_id,omitempty"`
+	RunID   string `json:"run_id,omitempty"`
+}
+
+// ReconcileResult reports the outcome of matching the executor's active flow runs against the flows
+// being tracked.  Adopted flows were not tracked and now are, unknown flows could not be matched to
+// a request, and duplicated flows are additional flow runs for a request that is already tracked.
+type ReconcileResult struct {
+	Adopted    []ReconciledFlow `json:"adopted"`
+	Unknown    []ReconciledFlow `json:"unknown"`
+	Duplicated []ReconciledFlow `json:"duplicated"`
+}
+
+// Reconcile finds the data pipeline flow runs that the executor has submitted, scheduled or running,
+// and starts tracking any that were lost (ie. submitted by an instance of the service that stopped
+// before it could save them), so that causemos is notified when they complete.  The request of an
+// adopted flow run is removed from the queue and from the pending retries, so that it isn't
+// submitted again, and its labels, enqueue time and retry count are carried over to the tracked
+// flow.  The job of an adopted flow run is moved to submitted, so that it can follow the run to
+// completion.
+func (d *DataPipelineRunner) Reconcile() (*ReconcileResult, error) {
+	// no request is leased while reconciling, so every queued copy of an adopted request is removed
+	d.dispatchMutex.Lock()
+	defer d.dispatchMutex.Unlock()
+
+	runs, err := d.executor.ActiveFlowRuns()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch active flow runs")
+	}
+
+	// adopt the oldest flow run for a request when there are several
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Created.Before(runs[j].Created)
+	})
+
+	result := &ReconcileResult{
+		Adopted:    []ReconciledFlow{},
+		Unknown:    []ReconciledFlow{},
+		Duplicated: []ReconciledFlow{},
+	}
+
+	// work out which flow runs to adopt while holding the lock, then remove their requests from
+	// the queue without it, since the queue may be persisted to disk
+	adoptions := map[string]FlowData{}
+	d.mutex.RLock()
+
+	// run IDs of the requests being tracked, keyed to their flow
+	trackedRuns := map[string]string{}
+	for flowID, flow := range d.currentFlowIDs {
+		trackedRuns[flow.Request.RunID] = flowID
+	}
+
+	for _, run := range runs {
+		reconciled := ReconciledFlow{FlowID: run.ID, Name: run.Name}
+		if _, ok := d.currentFlowIDs[run.ID]; ok {
+			continue
+		}
+
+		// the flow run name and parameters must both match the request
+		var request EnqueueRequestData
+		if err := json.Unmarshal(run.Parameters, &request); err != nil ||
+			request.ModelID == "" || request.RunID == "" ||
+			run.Name != fmt.Sprintf("%s:%s", request.ModelID, request.RunID) {
+			result.Unknown = append(result.Unknown, reconciled)
+			continue
+		}
+		request.RequestData = run.Parameters
+		reconciled.ModelID = request.ModelID
+		reconciled.RunID = request.RunID
+
+		if _, ok := trackedRuns[request.RunID]; ok {
+			result.Duplicated = append(result.Duplicated, reconciled)
+			continue
+		}
+
+		startTime := run.Created
+		if startTime.IsZero() {
+			startTime = time.Now()
+		}
+		adoptions[run.ID] = FlowData{Request: request, StartTime: startTime, EnqueuedAt: startTime}
+		trackedRuns[request.RunID] = run.ID
+		result.Adopted = append(result.Adopted, reconciled)
+	}
+
+	d.mutex.RUnlock()
+
+	for flowID, flow := range adoptions {
+		runID := flow.Request.RunID
+		removed, err := d.queue.Remove(func(x interface{}) bool {
+			queued, ok := x.(KeyedEnqueueRequestData)
+			return ok && queued.RunID == runID
+		})
+		if err != nil {
+			d.Logger.Error(errors.Wrapf(err, "failed to remove adopted run %s from queue", runID))
+		}
+		for _, x := range removed {
+			queued := x.(KeyedEnqueueRequestData)
+			flow.EnqueuedAt = queued.StartTime
+			flow.Labels = queued.Labels
+			flow.Retries = queued.Retries
+		}
+		adoptions[flowID] = flow
+	}
+
+	retriesChanged := false
+	d.mutex.Lock()
+	for flowID, flow := range adoptions {
+		if retry, ok := d.pendingRetries[flow.Request.RunID]; ok {
+			delete(d.pendingRetries, flow.Request.RunID)
+			retriesChanged = true
+			flow.Labels = retry.Labels
+			flow.Retries = retry.Retries
+		}
+		d.currentFlowIDs[flowID] = flow
+	}
+	d.mutex.Unlock()
+
+	for flowID, flow := range adoptions {
+		d.transitionJob(flow.Request, JobSubmitted, flowID, "adopted by reconcile")
+	}
+
+	if len(result.Adopted) > 0 {
+		d.saveTrackedFlows()
+	}
+	if retriesChanged {
+		d.savePendingRetries()
+	}
+	return result, nil
+}
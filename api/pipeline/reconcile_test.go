@@ -0,0 +1,150 @@
+package pipeline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+const activeFlowRunsResponse = `{"data": {"flow_run": [
+	{"id": "flow1", "name": "model:run1", "created": "2022-01-01T00:00:00+00:00", "parameters": {"model_id": "model", "run_id": "run1"}},
+	{"id": "flow2", "name": "model:run2", "created": "2022-01-01T00:00:01+00:00", "parameters": {"model_id": "model", "run_id": "run2", "doc_ids": ["a"]}},
+	{"id": "flow3", "name": "manual run", "created": "2022-01-01T00:00:02+00:00", "parameters": {}},
+	{"id": "flow4", "name": "model:run2", "created": "2022-01-01T00:00:03+00:00", "parameters": {"model_id": "model", "run_id": "run2"}},
+	{"id": "flow5", "name": "model:run1", "created": "2022-01-01T00:00:04+00:00", "parameters": {"model_id": "model", "run_id": "run1"}}
+]}}`
+
+// lockCheckingQueue records whether the runner's lock was held when requests were removed from the
+// queue.
+type lockCheckingQueue struct {
+	queue.RequestQueue
+	mutex  *sync.RWMutex
+	locked bool
+}
+
+func (q *lockCheckingQueue) Remove(match func(x interface{}) bool) ([]interface{}, error) {
+	if q.mutex.TryLock() {
+		q.mutex.Unlock()
+	} else {
+		q.locked = true
+	}
+	return q.RequestQueue.Remove(match)
+}
+
+func TestReconcile(t *testing.T) {
+	dir := path.Join("test_data", "reconcile1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(activeFlowRunsResponse))
+	}))
+	defer server.Close()
+
+	env := &config.Environment{
+		DataPipelineAddr:              server.URL,
+		DataPipelineFlowName:          "Data Pipeline",
+		DataPipelineProjectName:       "Development",
+		DataPipelineIdempotencyChecks: config.IdempotencyAll,
+		DataPipelineQueueDir:          dir,
+		DataPipelineJobsName:          "jobs",
+	}
+	cfg := config.Config{
+		Logger:      zap.NewNop().Sugar(),
+		Environment: env,
+	}
+	jobs := newTestJobStore(t, &cfg)
+	defer jobs.Close()
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	mutex := &sync.RWMutex{}
+	requestQueue := &lockCheckingQueue{RequestQueue: queue.NewListFIFOQueue(5), mutex: mutex}
+	runner := &DataPipelineRunner{
+		Config:      cfg,
+		executor:    NewPrefectExecutor(env),
+		queue:       requestQueue,
+		deadLetters: deadLetters,
+		jobs:        jobs,
+		notifier:    jobs,
+		mutex:       mutex,
+		currentFlowIDs: map[string]FlowData{
+			"flow1": {Request: EnqueueRequestData{ModelID: "model", RunID: "run1"}},
+		},
+		flowsPath:      path.Join(dir, "current_flows.json"),
+		pendingRetries: map[string]PendingRetry{},
+		retriesPath:    path.Join(dir, "pending_retries.json"),
+	}
+
+	// the request for the lost flow run is still queued, along with another request
+	enqueuedAt := time.Now().Add(-time.Hour)
+	for _, runID := range []string{"run2", "run3"} {
+		keyed := NewKeyedEnqueueRequestData(EnqueueRequestData{ModelID: "model", RunID: runID, RequestData: []byte(`{"run_id":"` + runID + `"}`)}, []string{"gpu"})
+		keyed.StartTime = enqueuedAt
+		keyed.Retries = 1
+		_, err := EnqueueKeyed(&cfg, runner.queue, keyed)
+		assert.NoError(t, err)
+	}
+
+	// the lost flow run was submitted by an instance that stopped while dispatching it
+	request := EnqueueRequestData{ModelID: "model", RunID: "run2"}
+	assert.NoError(t, jobs.Transition(request, JobQueued, "", ""))
+	assert.NoError(t, jobs.Transition(request, JobDispatching, "", ""))
+
+	result, err := runner.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []ReconciledFlow{{FlowID: "flow2", Name: "model:run2", ModelID: "model", RunID: "run2"}}, result.Adopted)
+	assert.Equal(t, []ReconciledFlow{{FlowID: "flow3", Name: "manual run"}}, result.Unknown)
+	assert.Equal(t, []ReconciledFlow{
+		{FlowID: "flow4", Name: "model:run2", ModelID: "model", RunID: "run2"},
+		{FlowID: "flow5", Name: "model:run1", ModelID: "model", RunID: "run1"},
+	}, result.Duplicated)
+
+	// adopted flows are tracked and persisted
+	assert.Equal(t, 2, runner.TrackedFlowCount())
+	adopted := runner.currentFlowIDs["flow2"]
+	assert.Equal(t, []string{"a"}, adopted.Request.DocIDs)
+	assert.Equal(t, []string{"gpu"}, adopted.Labels)
+	assert.Equal(t, 1, adopted.Retries)
+	assert.True(t, enqueuedAt.Equal(adopted.EnqueuedAt))
+
+	// and its request is no longer queued
+	contents, err := runner.queue.GetAll()
+	assert.NoError(t, err)
+	assert.Len(t, contents, 1)
+	assert.Equal(t, "run3", contents[0].(KeyedEnqueueRequestData).RunID)
+	assert.False(t, requestQueue.locked)
+	flows, err := loadTrackedFlows(runner.flowsPath)
+	assert.NoError(t, err)
+	assert.Len(t, flows, 2)
+
+	// the adopted flow's job follows the flow run to completion
+	job, ok := jobs.Get("run2")
+	assert.True(t, ok)
+	assert.Equal(t, JobSubmitted, job.State)
+	assert.Equal(t, "flow2", job.FlowID)
+	runner.flowRunning(FlowRun{ID: "flow2"})
+	flow, ok := runner.untrackFlow("flow2")
+	assert.True(t, ok)
+	runner.flowSucceeded(FlowRun{ID: "flow2", State: StateSuccess}, flow)
+	job, _ = jobs.Get("run2")
+	assert.Equal(t, []string{JobQueued, JobDispatching, JobSubmitted, JobRunning, JobSucceeded}, jobStates(job))
+
+	// a second pass, with the adopted flow still tracked, has nothing new to adopt
+	runner.currentFlowIDs["flow2"] = flow
+	result, err = runner.Reconcile()
+	assert.NoError(t, err)
+	assert.Empty(t, result.Adopted)
+	assert.Len(t, result.Duplicated, 2)
+}
@@ -1,6 +1,15 @@
 package pipeline
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vova616/xxhash"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
 
 // EnqueueRequestData defines the minimum fields upstream callers need to specify in order to run
 // a data pipeline job.  Additional parameters will not be validated and will be passed through
@@ -11,14 +20,22 @@ type EnqueueRequestData struct {
 	DataPaths   []string `json:"data_paths"`
 	DocIDs      []string `json:"doc_ids"`
 	IsIndicator bool     `json:"is_indicator"`
+	Priority    int      `json:"priority"`
+	// Requeues is the number of times the request has been requeued from the dead letter store.
+	Requeues    int `json:"requeues,omitempty"`
 	RequestData []byte
 }
 
 // FlowData is used to keep track of what flows we have that haven't failed or succeded
 // in the data pipeline
 type FlowData struct {
-	Request   EnqueueRequestData
+	Request EnqueueRequestData
+	// StartTime is when the flow run was submitted.
 	StartTime time.Time
+	// EnqueuedAt is when the request was last added to the queue.
+	EnqueuedAt time.Time
+	Labels     []string
+	Retries    int
 }
 
 // KeyedEnqueueRequestData adds an internally generated hash key to support checks for
@@ -28,6 +45,42 @@ type KeyedEnqueueRequestData struct {
 	RequestKey int32
 	StartTime  time.Time
 	Labels     []string
+	Retries    int
+}
+
+// NewKeyedEnqueueRequestData creates the queue entry for a request, using a hash of the request
+// data as its key.
+func NewKeyedEnqueueRequestData(request EnqueueRequestData, labels []string) KeyedEnqueueRequestData {
+	return KeyedEnqueueRequestData{
+		EnqueueRequestData: request,
+		RequestKey:         int32(xxhash.Checksum32(request.RequestData)),
+		StartTime:          time.Now(),
+		Labels:             labels,
+	}
+}
+
+// EnqueueKeyed adds a request to the queue, skipping it if an identical request is already queued
+// and queue idempotency checks are enabled.  Returns true if the request was added, or false if it
+// was skipped as a duplicate.  An error is returned if the queue is full.
+func EnqueueKeyed(cfg *config.Config, requestQueue queue.RequestQueue, keyed KeyedEnqueueRequestData) (bool, error) {
+	var result bool
+	var duplicate bool
+	var err error
+	if config.UseQueueIdempotency(cfg.Environment.DataPipelineIdempotencyChecks) {
+		if deduplicator, ok := requestQueue.(queue.Deduplicator); ok {
+			result, duplicate, err = deduplicator.EnqueueUnique(int(keyed.RequestKey), keyed)
+		} else {
+			result, err = requestQueue.EnqueueHashed(int(keyed.RequestKey), keyed)
+		}
+	} else {
+		result, err = requestQueue.Enqueue(keyed)
+	}
+	if err != nil {
+		return false, err
+	} else if !result {
+		return false, errors.New("request queue full")
+	}
+	return !duplicate, nil
 }
 
 // SubmitParams is to be used for the Submit function in DataPipelineRunner
@@ -35,3 +88,40 @@ type SubmitParams struct {
 	Force          bool
 	ProvidedLabels []string
 }
+
+// RequestPriority returns the priority of a queued request, for use with the priority queue
+// implementations.  Requests with an unexpected type are given the default priority.
+func RequestPriority(x interface{}) int {
+	request, ok := x.(KeyedEnqueueRequestData)
+	if !ok {
+		return 0
+	}
+	return request.Priority
+}
+
+// RequestPartitionKey returns a function that groups queued requests by the value of the named
+// request field, for use with the fair queue implementations.  The `model_id` and `run_id` fields
+// are read directly, while any other field is looked up in the original request body.
+func RequestPartitionKey(field string) queue.PartitionFunc {
+	return func(x interface{}) string {
+		request, ok := x.(KeyedEnqueueRequestData)
+		if !ok {
+			return ""
+		}
+		switch field {
+		case "model_id":
+			return request.ModelID
+		case "run_id":
+			return request.RunID
+		}
+		var params map[string]interface{}
+		if err := json.Unmarshal(request.RequestData, &params); err != nil {
+			return ""
+		}
+		value, ok := params[field]
+		if !ok || value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,160 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// RetryPolicy determines whether failed flow runs are retried, and how long to wait before
+// retrying them.
+type RetryPolicy struct {
+	MaxAttempts int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	States      []string
+}
+
+// NewRetryPolicy creates a retry policy from the environment settings.
+func NewRetryPolicy(env *config.Environment) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: env.DataPipelineRetryMaxAttempts,
+		BackoffBase: time.Duration(env.DataPipelineRetryBackoffBaseSec) * time.Second,
+		BackoffMax:  time.Duration(env.DataPipelineRetryBackoffMaxSec) * time.Second,
+		States:      env.DataPipelineRetryStates,
+	}
+}
+
+// ShouldRetry returns true if a flow run that finished in `state`, after having already been
+// retried `retries` times, should be retried again.
+func (p RetryPolicy) ShouldRetry(state string, retries int) bool {
+	if retries+1 >= p.MaxAttempts {
+		return false
+	}
+	for _, retryable := range p.States {
+		if retryable == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Exhausted returns true if a flow run that finished in `state`, after having already been retried
+// `retries` times, would have been retried but has no attempts left.  It is never true when retries
+// are disabled.
+func (p RetryPolicy) Exhausted(state string, retries int) bool {
+	if p.MaxAttempts <= 1 || retries+1 < p.MaxAttempts {
+		return false
+	}
+	for _, retryable := range p.States {
+		if retryable == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the delay before a request that has already been retried `retries` times
+// is retried again.
+func (p RetryPolicy) Backoff(retries int) time.Duration {
+	delay := p.BackoffBase
+	for i := 0; i < retries && delay < p.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > p.BackoffMax {
+		return p.BackoffMax
+	}
+	return delay
+}
+
+// PendingRetry is a request for a failed flow run that will be re-enqueued once its backoff
+// has passed.
+type PendingRetry struct {
+	Request EnqueueRequestData
+	Labels  []string
+	Retries int
+	RetryAt time.Time
+}
+
+// loadPendingRetries reads the retries that were waiting on their backoff when the service
+// last stopped.
+func loadPendingRetries(path string) (map[string]PendingRetry, error) {
+	retries := map[string]PendingRetry{}
+	if err := readJSONFile(path, &retries); err != nil {
+		return nil, errors.Wrap(err, "failed to load pending retries")
+	}
+	return retries, nil
+}
+
+// scheduleRetry sets a failed flow to be re-enqueued after its backoff.
+func (d *DataPipelineRunner) scheduleRetry(flowID string, flow FlowData) {
+	delay := d.retryPolicy.Backoff(flow.Retries)
+	d.mutex.Lock()
+	d.pendingRetries[flow.Request.RunID] = PendingRetry{
+		Request: flow.Request,
+		Labels:  flow.Labels,
+		Retries: flow.Retries + 1,
+		RetryAt: time.Now().Add(delay),
+	}
+	d.mutex.Unlock()
+	d.savePendingRetries()
+	d.Logger.Infof("Run %s will be retried in %s", flow.Request.RunID, delay)
+
+	event := flowEvent(EventRetried, flowID, flow)
+	event.Retries = flow.Retries + 1
+	d.notifier.Notify(event)
+}
+
+// enqueueDueRetries adds any retries whose backoff has passed to the request queue.
+func (d *DataPipelineRunner) enqueueDueRetries() {
+	now := time.Now()
+	due := map[string]PendingRetry{}
+	d.mutex.RLock()
+	for runID, retry := range d.pendingRetries {
+		if !now.Before(retry.RetryAt) {
+			due[runID] = retry
+		}
+	}
+	d.mutex.RUnlock()
+	if len(due) == 0 {
+		return
+	}
+
+	changed := false
+	for runID, retry := range due {
+		keyed := NewKeyedEnqueueRequestData(retry.Request, retry.Labels)
+		keyed.Retries = retry.Retries
+		if _, err := EnqueueKeyed(&d.Config, d.queue, keyed); err != nil {
+			// leave the retry pending and try again on the next pass
+			d.Logger.Error(errors.Wrapf(err, "failed to enqueue retry of run %s", runID))
+			continue
+		}
+		d.mutex.Lock()
+		delete(d.pendingRetries, runID)
+		d.mutex.Unlock()
+		changed = true
+	}
+	if changed {
+		d.savePendingRetries()
+	}
+}
+
+// savePendingRetries persists the retries waiting on their backoff.  The caller must not hold the
+// runner's mutex.
+func (d *DataPipelineRunner) savePendingRetries() {
+	// saves are serialized so that an older copy of the retries never overwrites a newer one
+	d.persistMutex.Lock()
+	defer d.persistMutex.Unlock()
+
+	d.mutex.RLock()
+	retries := make(map[string]PendingRetry, len(d.pendingRetries))
+	for runID, retry := range d.pendingRetries {
+		retries[runID] = retry
+	}
+	d.mutex.RUnlock()
+
+	if err := writeJSONFile(d.retriesPath, retries); err != nil {
+		d.Logger.Error(errors.Wrap(err, "failed to save pending retries"))
+	}
+}
@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BackoffBase: 10 * time.Second,
+		BackoffMax:  35 * time.Second,
+		States:      []string{"Failed"},
+	}
+
+	assert.True(t, policy.ShouldRetry("Failed", 0))
+	assert.True(t, policy.ShouldRetry("Failed", 1))
+	assert.False(t, policy.ShouldRetry("Failed", 2))
+	assert.False(t, policy.ShouldRetry("Cancelled", 0))
+
+	assert.False(t, policy.Exhausted("Failed", 1))
+	assert.True(t, policy.Exhausted("Failed", 2))
+	assert.False(t, policy.Exhausted("Cancelled", 2))
+	assert.False(t, RetryPolicy{MaxAttempts: 1, States: []string{"Failed"}}.Exhausted("Failed", 0))
+
+	assert.Equal(t, 10*time.Second, policy.Backoff(0))
+	assert.Equal(t, 20*time.Second, policy.Backoff(1))
+	assert.Equal(t, 35*time.Second, policy.Backoff(2))
+	assert.Equal(t, 35*time.Second, policy.Backoff(100))
+}
+
+func TestEnqueueDueRetries(t *testing.T) {
+	dir := path.Join("test_data", "retries1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	requestQueue := queue.NewListFIFOQueue(5)
+	notifier := &recordingNotifier{}
+	runner := &DataPipelineRunner{
+		Config: config.Config{
+			Logger:      zap.NewNop().Sugar(),
+			Environment: &config.Environment{DataPipelineIdempotencyChecks: config.IdempotencyAll},
+		},
+		queue:          requestQueue,
+		mutex:          &sync.RWMutex{},
+		pendingRetries: map[string]PendingRetry{},
+		retriesPath:    path.Join(dir, "pending_retries.json"),
+		retryPolicy:    RetryPolicy{MaxAttempts: 3, BackoffBase: time.Hour, BackoffMax: time.Hour},
+		notifier:       notifier,
+	}
+
+	runner.scheduleRetry("flow1", FlowData{Request: EnqueueRequestData{RunID: "run1", RequestData: []byte(`{"run_id":"run1"}`)}, Labels: []string{"label"}})
+	events := notifier.Events()
+	assert.Len(t, events, 1)
+	assert.Equal(t, EventRetried, events[0].Event)
+	assert.Equal(t, "flow1", events[0].FlowID)
+	assert.Equal(t, 1, events[0].Retries)
+
+	// nothing is enqueued until the backoff passes
+	runner.enqueueDueRetries()
+	assert.Equal(t, 0, requestQueue.Size())
+
+	// pending retries survive a restart
+	retries, err := loadPendingRetries(runner.retriesPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retries["run1"].Retries)
+
+	retry := runner.pendingRetries["run1"]
+	retry.RetryAt = time.Now()
+	runner.pendingRetries["run1"] = retry
+	runner.enqueueDueRetries()
+	assert.Equal(t, 1, requestQueue.Size())
+	assert.Empty(t, runner.pendingRetries)
+
+	data, err := requestQueue.Dequeue()
+	assert.NoError(t, err)
+	request := data.(KeyedEnqueueRequestData)
+	assert.Equal(t, "run1", request.RunID)
+	assert.Equal(t, 1, request.Retries)
+	assert.Equal(t, []string{"label"}, request.Labels)
+
+	retries, err = loadPendingRetries(runner.retriesPath)
+	assert.NoError(t, err)
+	assert.Empty(t, retries)
+}
+
+func TestFlowFailedExhaustsRetries(t *testing.T) {
+	dir := path.Join("test_data", "retries2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	// the dead letter threshold is higher than the number of attempts, so only running out of
+	// retries can dead letter the request
+	deadLetters, err := NewDeadLetterStore(dir, "dead_letter", 10)
+	assert.NoError(t, err)
+	notifier := &recordingNotifier{}
+	runner := &DataPipelineRunner{
+		Config: config.Config{
+			Logger:      zap.NewNop().Sugar(),
+			Environment: &config.Environment{},
+		},
+		mutex:          &sync.RWMutex{},
+		pendingRetries: map[string]PendingRetry{},
+		retriesPath:    path.Join(dir, "pending_retries.json"),
+		retryPolicy:    RetryPolicy{MaxAttempts: 3, BackoffBase: time.Hour, BackoffMax: time.Hour, States: []string{StateFailed}},
+		notifier:       notifier,
+		deadLetters:    deadLetters,
+	}
+
+	request := EnqueueRequestData{RunID: "run1", RequestData: []byte(`{"run_id":"run1"}`)}
+	for retries := 0; retries < 2; retries++ {
+		runner.flowFailed(FlowRun{ID: "flow1", State: StateFailed}, FlowData{Request: request, Retries: retries})
+		assert.Contains(t, runner.pendingRetries, "run1")
+		_, dead := deadLetters.Get("run1")
+		assert.False(t, dead)
+		delete(runner.pendingRetries, "run1")
+	}
+
+	// the last attempt fails, so the request is reported and dead lettered
+	runner.flowFailed(FlowRun{ID: "flow1", State: StateFailed}, FlowData{Request: request, Retries: 2})
+	assert.Empty(t, runner.pendingRetries)
+	entry, dead := deadLetters.Get("run1")
+	assert.True(t, dead)
+	assert.Len(t, entry.Failures, 3)
+	events := notifier.Events()
+	assert.Equal(t, EventFailed, events[len(events)-1].Event)
+}
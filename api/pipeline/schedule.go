@@ -0,0 +1,386 @@
+package pipeline
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// maxResumeSteps bounds how many back to back windows are followed when working out when
+// dispatching resumes.
+const maxResumeSteps = 100
+
+// maxScheduleWait bounds how long the scheduler sleeps between checks, so that it recovers from
+// clock changes.
+const maxScheduleWait = time.Hour
+
+// MaintenanceWindow is a recurring period during which queued requests aren't dispatched.
+type MaintenanceWindow struct {
+	Name string `json:"name"`
+	// Cron is a standard five field cron expression (minute, hour, day of month, month and day of
+	// week) for when the window starts.
+	Cron string `json:"cron"`
+	// DurationMin is how long the window lasts from each start, in minutes.
+	DurationMin int `json:"duration_min"`
+	// TimeZone is the IANA time zone the cron expression is evaluated in, or UTC when empty.
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+// Blackout is a one-off period during which queued requests aren't dispatched.
+type Blackout struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Schedule lists the periods during which queued requests aren't dispatched.
+type Schedule struct {
+	Windows   []MaintenanceWindow `json:"windows"`
+	Blackouts []Blackout          `json:"blackouts"`
+}
+
+// ActiveWindow is an occurrence of a maintenance window or blackout.
+type ActiveWindow struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// recurringWindow is a maintenance window with its cron expression parsed.
+type recurringWindow struct {
+	name     string
+	schedule cron.Schedule
+	location *time.Location
+	duration time.Duration
+}
+
+// compiledSchedule is a schedule that has been validated and parsed.
+type compiledSchedule struct {
+	windows   []recurringWindow
+	blackouts []Blackout
+}
+
+// compileSchedule validates a schedule, returning an error describing the first invalid window or
+// blackout.
+func compileSchedule(schedule Schedule) (compiledSchedule, error) {
+	compiled := compiledSchedule{blackouts: schedule.Blackouts}
+	for _, window := range schedule.Windows {
+		if window.Name == "" {
+			return compiledSchedule{}, errors.New("maintenance window name is required")
+		}
+		parsed, err := cron.ParseStandard(window.Cron)
+		if err != nil {
+			return compiledSchedule{}, errors.Wrapf(err, "maintenance window %s has invalid cron expression", window.Name)
+		}
+		if window.DurationMin <= 0 {
+			return compiledSchedule{}, errors.Errorf("maintenance window %s duration must be positive", window.Name)
+		}
+		location, err := time.LoadLocation(window.TimeZone)
+		if err != nil {
+			return compiledSchedule{}, errors.Wrapf(err, "maintenance window %s has invalid time zone", window.Name)
+		}
+		compiled.windows = append(compiled.windows, recurringWindow{
+			name:     window.Name,
+			schedule: parsed,
+			location: location,
+			duration: time.Duration(window.DurationMin) * time.Minute,
+		})
+	}
+	for _, blackout := range schedule.Blackouts {
+		if blackout.Name == "" {
+			return compiledSchedule{}, errors.New("blackout name is required")
+		}
+		if !blackout.End.After(blackout.Start) {
+			return compiledSchedule{}, errors.Errorf("blackout %s must end after it starts", blackout.Name)
+		}
+	}
+	return compiled, nil
+}
+
+// active returns the windows and blackouts in effect at `now`.
+func (c *compiledSchedule) active(now time.Time) []ActiveWindow {
+	active := []ActiveWindow{}
+	for _, window := range c.windows {
+		// the latest start that hasn't ended is the first start after the window's duration ago
+		start := window.schedule.Next(now.Add(-window.duration).In(window.location))
+		if !start.After(now) {
+			active = append(active, ActiveWindow{Name: window.name, Start: start, End: start.Add(window.duration)})
+		}
+	}
+	for _, blackout := range c.blackouts {
+		if !now.Before(blackout.Start) && now.Before(blackout.End) {
+			active = append(active, ActiveWindow{Name: blackout.Name, Start: blackout.Start, End: blackout.End})
+		}
+	}
+	return active
+}
+
+// nextChange returns the next time after `now` that a window or blackout starts or ends, or the
+// zero time if nothing is scheduled.
+func (c *compiledSchedule) nextChange(now time.Time) time.Time {
+	next := time.Time{}
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	for _, window := range c.windows {
+		consider(window.schedule.Next(now.In(window.location)))
+	}
+	for _, active := range c.active(now) {
+		consider(active.End)
+	}
+	for _, blackout := range c.blackouts {
+		consider(blackout.Start)
+		consider(blackout.End)
+	}
+	return next
+}
+
+// resumeAt returns the first time from `t` on that no window is in effect, or the zero time if
+// windows follow each other without a gap for too long to tell.
+func (c *compiledSchedule) resumeAt(t time.Time) time.Time {
+	for i := 0; i < maxResumeSteps; i++ {
+		current := latest(c.active(t))
+		if current == nil {
+			return t
+		}
+		t = current.End
+	}
+	return time.Time{}
+}
+
+// latest returns the active window that ends last, or nil if none are active.
+func latest(active []ActiveWindow) *ActiveWindow {
+	var found *ActiveWindow
+	for i := range active {
+		if found == nil || active[i].End.After(found.End) {
+			found = &active[i]
+		}
+	}
+	return found
+}
+
+// Scheduler pauses the runner for the duration of each maintenance window and blackout, and
+// resumes it once none are in effect.  The runner is only started or stopped as windows begin and
+// end, so it can still be started or stopped by hand in between.  A runner that was already stopped
+// when a window began, or that was stopped by hand during the window, is left stopped when the
+// window ends.  The schedule is persisted to disk on every change.
+type Scheduler struct {
+	config.Config
+	path     string
+	schedule Schedule
+	compiled compiledSchedule
+	running  func() bool
+	pause    func()
+	resume   func()
+	paused   bool
+	// resumeRunner is true while the runner is paused for a window that should resume it once it ends
+	resumeRunner bool
+	update       chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+	closed       bool
+	mutex        *sync.RWMutex
+}
+
+// NewScheduler creates a scheduler that calls `pause` when a maintenance period begins and `resume`
+// when it ends, reloading any schedule persisted to `<name>.json` in the queue directory.  The
+// runner is only resumed if `running` reported it was running when the period began.  If a window
+// is already in effect the runner is paused before NewScheduler returns.
+func NewScheduler(cfg *config.Config, running func() bool, pause func(), resume func()) (*Scheduler, error) {
+	s := &Scheduler{
+		Config: config.Config{
+			Logger:      cfg.Logger,
+			Environment: cfg.Environment,
+		},
+		path:     path.Join(cfg.Environment.DataPipelineQueueDir, cfg.Environment.DataPipelineScheduleName+".json"),
+		schedule: Schedule{Windows: []MaintenanceWindow{}, Blackouts: []Blackout{}},
+		running:  running,
+		pause:    pause,
+		resume:   resume,
+		update:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		mutex:    &sync.RWMutex{},
+	}
+	if err := readJSONFile(s.path, &s.schedule); err != nil {
+		return nil, errors.Wrap(err, "failed to load maintenance schedule")
+	}
+	compiled, err := compileSchedule(s.schedule)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid maintenance schedule")
+	}
+	s.compiled = compiled
+	s.apply(time.Now())
+	go s.run()
+	return s, nil
+}
+
+// Schedule returns the current schedule.
+func (s *Scheduler) Schedule() Schedule {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return Schedule{
+		Windows:   append([]MaintenanceWindow{}, s.schedule.Windows...),
+		Blackouts: append([]Blackout{}, s.schedule.Blackouts...),
+	}
+}
+
+// SetSchedule replaces the schedule, returning an error without changing it if the new schedule
+// is invalid.  The runner is paused or resumed straight away if that's what the new schedule calls
+// for.
+func (s *Scheduler) SetSchedule(schedule Schedule) error {
+	if schedule.Windows == nil {
+		schedule.Windows = []MaintenanceWindow{}
+	}
+	if schedule.Blackouts == nil {
+		schedule.Blackouts = []Blackout{}
+	}
+	compiled, err := compileSchedule(schedule)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := writeJSONFile(s.path, schedule); err != nil {
+		return errors.Wrap(err, "failed to save maintenance schedule")
+	}
+	s.schedule = schedule
+	s.compiled = compiled
+
+	select {
+	case s.update <- struct{}{}:
+	default:
+		// an update is already pending
+	}
+	return nil
+}
+
+// Current returns the window in effect at `now` that ends last, or nil if none are in effect.
+func (s *Scheduler) Current(now time.Time) *ActiveWindow {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return latest(s.compiled.active(now))
+}
+
+// NextChange returns the next time after `now` that a window starts or ends, or the zero time if
+// nothing is scheduled.
+func (s *Scheduler) NextChange(now time.Time) time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.compiled.nextChange(now)
+}
+
+// ResumeAt returns the first time from `t` on that no window is in effect, or the zero time if
+// windows follow each other without a gap for too long to tell.
+func (s *Scheduler) ResumeAt(t time.Time) time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.compiled.resumeAt(t)
+}
+
+// Paused returns true if the runner is paused for maintenance, and will be resumed once no window
+// is in effect.
+func (s *Scheduler) Paused() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.paused && s.resumeRunner
+}
+
+// Stopped records that the runner was stopped by hand, so that it isn't resumed when the window in
+// effect ends.
+func (s *Scheduler) Stopped() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.resumeRunner = false
+}
+
+// Resume starts the runner, unless a window is in effect, in which case the runner is started once
+// the window ends.
+func (s *Scheduler) Resume() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.paused {
+		s.Logger.Info("Maintenance window in effect, the runner will start once it ends")
+		s.resumeRunner = true
+		return
+	}
+	s.resume()
+}
+
+// Close stops the scheduler, leaving the runner as it is.
+func (s *Scheduler) Close() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.stop)
+	s.mutex.Unlock()
+	<-s.done
+}
+
+// run pauses or resumes the runner whenever a window starts or ends, or the schedule changes,
+// until the scheduler is closed.
+func (s *Scheduler) run() {
+	defer close(s.done)
+	for {
+		now := time.Now()
+		s.apply(now)
+
+		wait := maxScheduleWait
+		if next := s.NextChange(now); !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.update:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// apply pauses the runner when a window has begun, or resumes it when the last window has ended if
+// the window paused it.
+func (s *Scheduler) apply(now time.Time) {
+	s.mutex.Lock()
+	current := latest(s.compiled.active(now))
+	var action func()
+	switch {
+	case current != nil && !s.paused:
+		s.paused = true
+		s.resumeRunner = s.running()
+		if s.resumeRunner {
+			s.Logger.Infof("Maintenance window %s started, pausing until %s", current.Name, current.End.Format(time.RFC3339))
+			action = s.pause
+		} else {
+			s.Logger.Infof("Maintenance window %s started while the runner is stopped", current.Name)
+		}
+	case current == nil && s.paused:
+		s.paused = false
+		if s.resumeRunner {
+			s.Logger.Info("Maintenance window ended, resuming")
+			action = s.resume
+		} else {
+			s.Logger.Info("Maintenance window ended, leaving the stopped runner stopped")
+		}
+		s.resumeRunner = false
+	}
+	s.mutex.Unlock()
+
+	if action != nil {
+		action()
+	}
+}
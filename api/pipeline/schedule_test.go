@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func TestCompileSchedule(t *testing.T) {
+	_, err := compileSchedule(Schedule{Windows: []MaintenanceWindow{{Name: "nightly", Cron: "0 2 * * *", DurationMin: 30, TimeZone: "America/Toronto"}}})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	invalid := []Schedule{
+		{Windows: []MaintenanceWindow{{Cron: "0 2 * * *", DurationMin: 30}}},
+		{Windows: []MaintenanceWindow{{Name: "nightly", Cron: "0 2 * *", DurationMin: 30}}},
+		{Windows: []MaintenanceWindow{{Name: "nightly", Cron: "0 2 * * *"}}},
+		{Windows: []MaintenanceWindow{{Name: "nightly", Cron: "0 2 * * *", DurationMin: 30, TimeZone: "Nowhere/Special"}}},
+		{Blackouts: []Blackout{{Start: now, End: now.Add(time.Hour)}}},
+		{Blackouts: []Blackout{{Name: "upgrade", Start: now, End: now}}},
+	}
+	for i, schedule := range invalid {
+		_, err := compileSchedule(schedule)
+		assert.Error(t, err, i)
+	}
+}
+
+func TestScheduleWindows(t *testing.T) {
+	blackoutStart := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	compiled, err := compileSchedule(Schedule{
+		// 2am eastern standard time is 7am UTC
+		Windows:   []MaintenanceWindow{{Name: "nightly", Cron: "0 2 * * *", DurationMin: 60, TimeZone: "America/Toronto"}},
+		Blackouts: []Blackout{{Name: "upgrade", Start: blackoutStart, End: blackoutStart.Add(24 * time.Hour)}},
+	})
+	assert.NoError(t, err)
+
+	before := time.Date(2022, 3, 1, 6, 0, 0, 0, time.UTC)
+	assert.Empty(t, compiled.active(before))
+	assert.Equal(t, time.Date(2022, 3, 1, 7, 0, 0, 0, time.UTC), compiled.nextChange(before).UTC())
+
+	during := time.Date(2022, 3, 1, 7, 30, 0, 0, time.UTC)
+	active := compiled.active(during)
+	assert.Len(t, active, 1)
+	assert.Equal(t, "nightly", active[0].Name)
+	assert.Equal(t, time.Date(2022, 3, 1, 7, 0, 0, 0, time.UTC), active[0].Start.UTC())
+	assert.Equal(t, time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC), active[0].End.UTC())
+	assert.Equal(t, time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC), compiled.nextChange(during).UTC())
+
+	// windows end exclusively
+	assert.Empty(t, compiled.active(time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC)))
+
+	// the blackout overlaps the next night's window, and outlasts it
+	overlap := time.Date(2022, 3, 3, 7, 15, 0, 0, time.UTC)
+	active = compiled.active(overlap)
+	assert.Len(t, active, 2)
+	assert.Equal(t, "upgrade", latest(active).Name)
+	assert.Equal(t, time.Date(2022, 3, 3, 8, 0, 0, 0, time.UTC), compiled.nextChange(overlap).UTC())
+	assert.Equal(t, blackoutStart.Add(24*time.Hour), compiled.nextChange(time.Date(2022, 3, 3, 8, 0, 0, 0, time.UTC)))
+
+	// dispatching resumes once every overlapping window has ended
+	assert.Equal(t, before, compiled.resumeAt(before))
+	assert.Equal(t, time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC), compiled.resumeAt(during).UTC())
+	assert.Equal(t, blackoutStart.Add(24*time.Hour), compiled.resumeAt(overlap))
+	always, err := compileSchedule(Schedule{Windows: []MaintenanceWindow{{Name: "always", Cron: "* * * * *", DurationMin: 5}}})
+	assert.NoError(t, err)
+	assert.True(t, always.resumeAt(during).IsZero())
+}
+
+// windowPaused returns true if the scheduler has seen a window begin, whether or not it paused the
+// runner.
+func windowPaused(s *Scheduler) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.paused
+}
+
+func TestScheduler(t *testing.T) {
+	dir := path.Join("test_data", "schedule1")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+	cfg := &config.Config{
+		Logger:      zap.NewNop().Sugar(),
+		Environment: &config.Environment{DataPipelineQueueDir: dir, DataPipelineScheduleName: "schedule"},
+	}
+
+	running := atomic.Bool{}
+	running.Store(true)
+	pauses := make(chan struct{}, 2)
+	resumes := make(chan struct{}, 2)
+	pause := func() {
+		running.Store(false)
+		pauses <- struct{}{}
+	}
+	resume := func() {
+		running.Store(true)
+		resumes <- struct{}{}
+	}
+
+	scheduler, err := NewScheduler(cfg, running.Load, pause, resume)
+	assert.NoError(t, err)
+	assert.Nil(t, scheduler.Current(time.Now()))
+
+	// a window that's always in effect pauses the runner as soon as it's added
+	always := Schedule{Windows: []MaintenanceWindow{{Name: "always", Cron: "* * * * *", DurationMin: 5}}}
+	assert.Error(t, scheduler.SetSchedule(Schedule{Windows: []MaintenanceWindow{{Name: "bad", Cron: "never"}}}))
+	assert.NoError(t, scheduler.SetSchedule(always))
+	<-pauses
+	assert.Equal(t, "always", scheduler.Current(time.Now()).Name)
+	assert.True(t, scheduler.Paused())
+
+	// removing it resumes the runner
+	assert.NoError(t, scheduler.SetSchedule(Schedule{}))
+	<-resumes
+	assert.Nil(t, scheduler.Current(time.Now()))
+	assert.False(t, scheduler.Paused())
+	assert.Equal(t, Schedule{Windows: []MaintenanceWindow{}, Blackouts: []Blackout{}}, scheduler.Schedule())
+
+	// a runner stopped by hand during a window isn't resumed when it ends
+	assert.NoError(t, scheduler.SetSchedule(always))
+	<-pauses
+	scheduler.Stopped()
+	assert.False(t, scheduler.Paused())
+	assert.NoError(t, scheduler.SetSchedule(Schedule{}))
+	assert.Eventually(t, func() bool { return scheduler.Current(time.Now()) == nil && !windowPaused(scheduler) }, time.Second, time.Millisecond)
+	assert.Empty(t, resumes)
+
+	// nor is a runner that was already stopped when the window began
+	assert.NoError(t, scheduler.SetSchedule(always))
+	assert.Eventually(t, func() bool { return windowPaused(scheduler) }, time.Second, time.Millisecond)
+	assert.NoError(t, scheduler.SetSchedule(Schedule{}))
+	assert.Eventually(t, func() bool { return !windowPaused(scheduler) }, time.Second, time.Millisecond)
+	assert.Empty(t, pauses)
+	assert.Empty(t, resumes)
+	running.Store(true)
+
+	// the schedule is reloaded on restart, and a window in effect pauses the started runner
+	// straight away
+	assert.NoError(t, scheduler.SetSchedule(always))
+	<-pauses
+	scheduler.Close()
+	running.Store(true)
+	scheduler, err = NewScheduler(cfg, running.Load, pause, resume)
+	assert.NoError(t, err)
+	assert.Equal(t, always.Windows, scheduler.Schedule().Windows)
+	assert.Len(t, pauses, 1)
+	<-pauses
+	assert.Empty(t, resumes)
+	scheduler.Close()
+
+	// a runner that hasn't been started yet isn't started during a window, but once it ends
+	scheduler, err = NewScheduler(cfg, running.Load, pause, resume)
+	assert.NoError(t, err)
+	defer scheduler.Close()
+	scheduler.Resume()
+	assert.True(t, scheduler.Paused())
+	assert.Empty(t, pauses)
+	assert.Empty(t, resumes)
+	assert.NoError(t, scheduler.SetSchedule(Schedule{}))
+	<-resumes
+	assert.True(t, running.Load())
+
+	// and is started straight away when no window is in effect
+	running.Store(false)
+	scheduler.Resume()
+	assert.Len(t, resumes, 1)
+	<-resumes
+}
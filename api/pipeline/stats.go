@@ -0,0 +1,170 @@
+package pipeline
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// unknownAgent groups finished jobs whose agent isn't known, such as those that were never
+// submitted.
+const unknownAgent = "unknown"
+
+// DurationStats summarizes a set of durations.
+type DurationStats struct {
+	Count  int     `json:"count"`
+	P50Sec float64 `json:"p50_sec"`
+	P95Sec float64 `json:"p95_sec"`
+}
+
+// GroupStats summarizes the jobs that finished for a model or agent.
+type GroupStats struct {
+	Finished    int           `json:"finished"`
+	Succeeded   int           `json:"succeeded"`
+	Failed      int           `json:"failed"`
+	QueueWait   DurationStats `json:"queue_wait"`
+	RunDuration DurationStats `json:"run_duration"`
+}
+
+// WindowStats summarizes the jobs that finished within a period ending now.
+type WindowStats struct {
+	WindowHours       int     `json:"window_hours"`
+	Finished          int     `json:"finished"`
+	Succeeded         int     `json:"succeeded"`
+	Failed            int     `json:"failed"`
+	Cancelled         int     `json:"cancelled"`
+	SuccessRatio      float64 `json:"success_ratio"`
+	FailureRatio      float64 `json:"failure_ratio"`
+	ThroughputPerHour float64 `json:"throughput_per_hour"`
+	// QueueWait is the time from enqueue to submission, for jobs that had a flow run.
+	QueueWait DurationStats `json:"queue_wait"`
+	// RunDuration is the time from submission until the flow run finished.
+	RunDuration DurationStats         `json:"run_duration"`
+	Models      map[string]GroupStats `json:"models"`
+	Agents      map[string]GroupStats `json:"agents"`
+}
+
+// durations collects the queue waits and run durations of a set of jobs.
+type durations struct {
+	queueWait   []float64
+	runDuration []float64
+}
+
+func (d *durations) add(record *HistoryRecord) {
+	if record.SubmittedAt.IsZero() {
+		return
+	}
+	if !record.EnqueuedAt.IsZero() {
+		d.queueWait = append(d.queueWait, record.SubmittedAt.Sub(record.EnqueuedAt).Seconds())
+	}
+	d.runDuration = append(d.runDuration, record.FinishedAt.Sub(record.SubmittedAt).Seconds())
+}
+
+// ComputeStats summarizes the finished jobs over each window, given in hours before `now`.
+func ComputeStats(records []HistoryRecord, now time.Time, windowsHours []int) []WindowStats {
+	stats := make([]WindowStats, 0, len(windowsHours))
+	for _, hours := range windowsHours {
+		stats = append(stats, computeWindowStats(records, now, hours))
+	}
+	return stats
+}
+
+func computeWindowStats(records []HistoryRecord, now time.Time, hours int) WindowStats {
+	window := WindowStats{
+		WindowHours: hours,
+		Models:      map[string]GroupStats{},
+		Agents:      map[string]GroupStats{},
+	}
+	start := now.Add(-time.Duration(hours) * time.Hour)
+	all := durations{}
+	models := map[string]*durations{}
+	agents := map[string]*durations{}
+	for i := range records {
+		record := &records[i]
+		if record.FinishedAt.Before(start) || record.FinishedAt.After(now) {
+			continue
+		}
+		window.Finished++
+		switch record.State {
+		case JobSucceeded:
+			window.Succeeded++
+		case JobFailed:
+			window.Failed++
+		case JobCancelled:
+			window.Cancelled++
+		}
+		all.add(record)
+
+		agent := record.AgentID
+		if agent == "" {
+			agent = unknownAgent
+		}
+		window.Models[record.ModelID] = countGroup(window.Models[record.ModelID], record)
+		window.Agents[agent] = countGroup(window.Agents[agent], record)
+		addDurations(models, record.ModelID, record)
+		addDurations(agents, agent, record)
+	}
+
+	if window.Finished > 0 {
+		window.SuccessRatio = float64(window.Succeeded) / float64(window.Finished)
+		window.FailureRatio = float64(window.Failed) / float64(window.Finished)
+	}
+	if hours > 0 {
+		window.ThroughputPerHour = float64(window.Finished) / float64(hours)
+	}
+	window.QueueWait = summarize(all.queueWait)
+	window.RunDuration = summarize(all.runDuration)
+	for model, group := range window.Models {
+		group.QueueWait = summarize(models[model].queueWait)
+		group.RunDuration = summarize(models[model].runDuration)
+		window.Models[model] = group
+	}
+	for agent, group := range window.Agents {
+		group.QueueWait = summarize(agents[agent].queueWait)
+		group.RunDuration = summarize(agents[agent].runDuration)
+		window.Agents[agent] = group
+	}
+	return window
+}
+
+func countGroup(group GroupStats, record *HistoryRecord) GroupStats {
+	group.Finished++
+	switch record.State {
+	case JobSucceeded:
+		group.Succeeded++
+	case JobFailed:
+		group.Failed++
+	}
+	return group
+}
+
+func addDurations(groups map[string]*durations, key string, record *HistoryRecord) {
+	group, ok := groups[key]
+	if !ok {
+		group = &durations{}
+		groups[key] = group
+	}
+	group.add(record)
+}
+
+// summarize returns the count and percentiles of a set of durations in seconds.
+func summarize(values []float64) DurationStats {
+	stats := DurationStats{Count: len(values)}
+	if len(values) == 0 {
+		return stats
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	stats.P50Sec = percentile(sorted, 0.5)
+	stats.P95Sec = percentile(sorted, 0.95)
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
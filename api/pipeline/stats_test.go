@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeStats(t *testing.T) {
+	now := time.Now()
+	record := func(model string, agent string, state string, finishedAgo time.Duration, queueWait time.Duration, runDuration time.Duration) HistoryRecord {
+		finished := now.Add(-finishedAgo)
+		submitted := finished.Add(-runDuration)
+		return HistoryRecord{ModelID: model, AgentID: agent, State: state, EnqueuedAt: submitted.Add(-queueWait), SubmittedAt: submitted, FinishedAt: finished}
+	}
+	records := []HistoryRecord{
+		record("model1", "agent1", JobSucceeded, 2*time.Hour, 10*time.Second, time.Minute),
+		record("model1", "agent1", JobSucceeded, 30*time.Minute, 20*time.Second, 2*time.Minute),
+		record("model1", "agent2", JobFailed, 20*time.Minute, 30*time.Second, 3*time.Minute),
+		record("model2", "agent2", JobSucceeded, 10*time.Minute, 40*time.Second, 4*time.Minute),
+		// a job that failed before it was submitted has no durations or agent
+		{ModelID: "model2", State: JobFailed, FinishedAt: now.Add(-5 * time.Minute)},
+		// jobs outside every window are ignored
+		record("model1", "agent1", JobSucceeded, 48*time.Hour, time.Hour, time.Hour),
+	}
+
+	stats := ComputeStats(records, now, []int{1, 24})
+	assert.Len(t, stats, 2)
+
+	hour := stats[0]
+	assert.Equal(t, 1, hour.WindowHours)
+	assert.Equal(t, 4, hour.Finished)
+	assert.Equal(t, 2, hour.Succeeded)
+	assert.Equal(t, 2, hour.Failed)
+	assert.Equal(t, 0.5, hour.SuccessRatio)
+	assert.Equal(t, 0.5, hour.FailureRatio)
+	assert.Equal(t, 4.0, hour.ThroughputPerHour)
+	assert.Equal(t, DurationStats{Count: 3, P50Sec: 30, P95Sec: 40}, hour.QueueWait)
+	assert.Equal(t, DurationStats{Count: 3, P50Sec: 180, P95Sec: 240}, hour.RunDuration)
+	assert.Equal(t, GroupStats{
+		Finished:    2,
+		Succeeded:   1,
+		Failed:      1,
+		QueueWait:   DurationStats{Count: 2, P50Sec: 20, P95Sec: 30},
+		RunDuration: DurationStats{Count: 2, P50Sec: 120, P95Sec: 180},
+	}, hour.Models["model1"])
+	assert.Equal(t, 1, hour.Agents[unknownAgent].Failed)
+	assert.Equal(t, 0, hour.Agents[unknownAgent].RunDuration.Count)
+
+	day := stats[1]
+	assert.Equal(t, 5, day.Finished)
+	assert.Equal(t, 0.6, day.SuccessRatio)
+	assert.Equal(t, DurationStats{Count: 2, P50Sec: 10, P95Sec: 20}, day.Agents["agent1"].QueueWait)
+}
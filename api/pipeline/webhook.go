@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// Headers set on every webhook delivery.
+const (
+	// WebhookEventHeader names the event being delivered
+	WebhookEventHeader = "X-Webhook-Event"
+	// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of the body, prefixed with
+	// "sha256=", when the webhook has a secret
+	WebhookSignatureHeader = "X-Signature-256"
+)
+
+// WebhookConfig configures a webhook subscription.
+type WebhookConfig struct {
+	// Name uniquely identifies the webhook in logs and the outbox.
+	Name string `json:"name"`
+	// URL is the address events are POSTed to.
+	URL string `json:"url"`
+	// Events lists the events the webhook is notified of.  All events are sent when it's empty.
+	Events []string `json:"events,omitempty"`
+	// Headers are added to each request, ie. for authorization.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret is used to sign each request body.  Requests are unsigned when it's empty.
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookPayload is the body POSTed to a webhook for an event.
+type WebhookPayload struct {
+	Event       string          `json:"event"`
+	Time        time.Time       `json:"time"`
+	RunID       string          `json:"run_id"`
+	ModelID     string          `json:"model_id"`
+	FlowID      string          `json:"flow_id,omitempty"`
+	State       string          `json:"state,omitempty"`
+	AgentID     string          `json:"agent_id,omitempty"`
+	EnqueuedAt  *time.Time      `json:"enqueued_at,omitempty"`
+	SubmittedAt *time.Time      `json:"submitted_at,omitempty"`
+	Retries     int             `json:"retries"`
+	Request     json.RawMessage `json:"request"`
+}
+
+// WebhookSubscriber POSTs job lifecycle events to a configured URL.
+type WebhookSubscriber struct {
+	config     WebhookConfig
+	events     map[string]bool
+	httpClient http.Client
+}
+
+// NewWebhookSubscriber creates a subscriber for a webhook, returning an error if its
+// configuration is invalid.
+func NewWebhookSubscriber(env *config.Environment, webhook WebhookConfig) (*WebhookSubscriber, error) {
+	if webhook.Name == "" {
+		return nil, errors.New("webhook name is required")
+	}
+	if webhook.Name == CausemosSubscriberName {
+		return nil, errors.Errorf("webhook name %s is reserved", webhook.Name)
+	}
+	if webhook.URL == "" {
+		return nil, errors.Errorf("webhook %s url is required", webhook.Name)
+	}
+	events := map[string]bool{}
+	for _, event := range webhook.Events {
+		if !isEvent(event) {
+			return nil, errors.Errorf("webhook %s has unknown event %s", webhook.Name, event)
+		}
+		events[event] = true
+	}
+	return &WebhookSubscriber{
+		config: webhook,
+		events: events,
+		// standard http client with our timeout
+		httpClient: http.Client{Timeout: time.Second * time.Duration(env.DataPipelineTimeoutSec)},
+	}, nil
+}
+
+// Name identifies the subscriber.
+func (w *WebhookSubscriber) Name() string {
+	return w.config.Name
+}
+
+// Messages returns the payload for an event, if the webhook is subscribed to it.
+func (w *WebhookSubscriber) Messages(event JobEvent) []Message {
+	if len(w.events) > 0 && !w.events[event.Event] {
+		return nil
+	}
+	payload := WebhookPayload{
+		Event:   event.Event,
+		Time:    event.Time,
+		RunID:   event.Request.RunID,
+		ModelID: event.Request.ModelID,
+		FlowID:  event.FlowID,
+		State:   event.State,
+		AgentID: event.AgentID,
+		Retries: event.Retries,
+		Request: event.Request.RequestData,
+	}
+	if !event.EnqueuedAt.IsZero() {
+		payload.EnqueuedAt = &event.EnqueuedAt
+	}
+	if !event.SubmittedAt.IsZero() {
+		payload.SubmittedAt = &event.SubmittedAt
+	}
+	if len(payload.Request) == 0 {
+		payload.Request = json.RawMessage("null")
+	}
+	body, _ := json.Marshal(payload)
+	return []Message{{Endpoint: event.Event, Payload: body}}
+}
+
+// Deliver POSTs a message to the webhook.  An error is returned if the request fails or the
+// webhook responds with a non-2xx status.
+func (w *WebhookSubscriber) Deliver(message Message) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewBuffer(message.Payload))
+	if err != nil {
+		return err
+	}
+	for key, value := range w.config.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-type", "application/json")
+	req.Header.Set(WebhookEventHeader, message.Endpoint)
+	if w.config.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhookPayload(w.config.Secret, message.Payload))
+	}
+	return doRequest(&w.httpClient, req)
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 of a payload.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isEvent(event string) bool {
+	for _, known := range Events {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSubscribers creates the configured subscribers - causemos when an address is set, and each
+// webhook in the webhooks file.
+func NewSubscribers(env *config.Environment) ([]Subscriber, error) {
+	subscribers := []Subscriber{}
+	if env.CausemosAddr != "" {
+		subscribers = append(subscribers, NewCausemosSubscriber(env))
+	}
+	if env.DataPipelineWebhooksFile == "" {
+		return subscribers, nil
+	}
+
+	data, err := os.ReadFile(env.DataPipelineWebhooksFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read webhooks file")
+	}
+	webhooks := []WebhookConfig{}
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, errors.Wrap(err, "failed to parse webhooks file")
+	}
+	names := map[string]bool{}
+	for _, webhook := range webhooks {
+		if names[webhook.Name] {
+			return nil, errors.Errorf("duplicate webhook name %s", webhook.Name)
+		}
+		names[webhook.Name] = true
+		subscriber, err := NewWebhookSubscriber(env, webhook)
+		if err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers, nil
+}
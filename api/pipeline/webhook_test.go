@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func TestWebhookSubscriber(t *testing.T) {
+	dir := path.Join("test_data", "webhook1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	var mutex sync.Mutex
+	var requests []*http.Request
+	var bodies [][]byte
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+	}))
+	defer webhook.Close()
+
+	env := &config.Environment{CausemosAddr: "", DataPipelineTimeoutSec: 5, DataPipelineQueueDir: dir, DataPipelineOutboxName: "outbox"}
+	subscriber, err := NewWebhookSubscriber(env, WebhookConfig{
+		Name:    "webhook",
+		URL:     webhook.URL,
+		Events:  []string{EventSucceeded, EventFailed},
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Secret:  "secret",
+	})
+	assert.NoError(t, err)
+	outbox := newTestOutbox(t, env)
+	n := NewOutboxNotifier(&config.Config{Logger: zap.NewNop().Sugar(), Environment: env}, outbox, []Subscriber{subscriber})
+
+	// only the events the webhook subscribed to are sent
+	request := EnqueueRequestData{ModelID: "model", RunID: "run1", RequestData: []byte(`{"run_id":"run1"}`)}
+	n.Notify(NewJobEvent(EventEnqueued, request))
+	event := NewJobEvent(EventFailed, request)
+	event.FlowID = "flow1"
+	event.State = StateFailed
+	n.Notify(event)
+	assert.Eventually(t, func() bool { return len(outbox.List()) == 0 }, 5*time.Second, time.Millisecond)
+	n.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Len(t, requests, 1)
+	assert.Equal(t, http.MethodPost, requests[0].Method)
+	assert.Equal(t, "Bearer token", requests[0].Header.Get("Authorization"))
+	assert.Equal(t, EventFailed, requests[0].Header.Get(WebhookEventHeader))
+	assert.Equal(t, "sha256="+SignWebhookPayload("secret", bodies[0]), requests[0].Header.Get(WebhookSignatureHeader))
+
+	var payload WebhookPayload
+	assert.NoError(t, json.Unmarshal(bodies[0], &payload))
+	assert.Equal(t, EventFailed, payload.Event)
+	assert.Equal(t, "run1", payload.RunID)
+	assert.Equal(t, "model", payload.ModelID)
+	assert.Equal(t, "flow1", payload.FlowID)
+	assert.Equal(t, StateFailed, payload.State)
+	assert.Nil(t, payload.SubmittedAt)
+	assert.JSONEq(t, `{"run_id":"run1"}`, string(payload.Request))
+}
+
+func TestNewSubscribers(t *testing.T) {
+	dir := path.Join("test_data", "webhook2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+	assert.NoError(t, os.MkdirAll(dir, os.ModePerm))
+
+	writeWebhooks := func(webhooks string) string {
+		file := path.Join(dir, "webhooks.json")
+		assert.NoError(t, os.WriteFile(file, []byte(webhooks), 0644))
+		return file
+	}
+
+	env := &config.Environment{CausemosAddr: "http://causemos", DataPipelineWebhooksFile: writeWebhooks(`[
+		{"name": "all", "url": "http://all"},
+		{"name": "failures", "url": "http://failures", "events": ["failed"]}
+	]`)}
+	subscribers, err := NewSubscribers(env)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, subscriber := range subscribers {
+		names = append(names, subscriber.Name())
+	}
+	assert.Equal(t, []string{CausemosSubscriberName, "all", "failures"}, names)
+
+	// causemos is only notified when it has an address
+	env.CausemosAddr = ""
+	subscribers, err = NewSubscribers(env)
+	assert.NoError(t, err)
+	assert.Len(t, subscribers, 2)
+
+	for _, webhooks := range []string{
+		`[{"url": "http://missing-name"}]`,
+		`[{"name": "missing-url"}]`,
+		`[{"name": "causemos", "url": "http://reserved"}]`,
+		`[{"name": "unknown", "url": "http://unknown", "events": ["finished"]}]`,
+		`[{"name": "twice", "url": "http://one"}, {"name": "twice", "url": "http://two"}]`,
+		`{"name": "not-a-list"}`,
+	} {
+		env.DataPipelineWebhooksFile = writeWebhooks(webhooks)
+		_, err := NewSubscribers(env)
+		assert.Error(t, err, webhooks)
+	}
+}
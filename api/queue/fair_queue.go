@@ -0,0 +1,71 @@
+package queue
+
+// PartitionFunc returns the key used to group an item being enqueued for fair scheduling.
+type PartitionFunc func(x interface{}) string
+
+// roundRobinPolicy services each partition in turn, so that a large number of items
+// queued under one key doesn't starve the others.
+type roundRobinPolicy struct {
+	keyOf  PartitionFunc
+	keys   []string
+	cursor int
+}
+
+func (p *roundRobinPolicy) key(x interface{}) string {
+	return p.keyOf(x)
+}
+
+func (p *roundRobinPolicy) add(key string) {
+	// new keys join the end of the current rotation
+	p.keys = append(p.keys[:p.cursor], append([]string{key}, p.keys[p.cursor:]...)...)
+	p.cursor++
+}
+
+func (p *roundRobinPolicy) remove(key string) {
+	for i, k := range p.keys {
+		if k == key {
+			p.keys = append(p.keys[:i], p.keys[i+1:]...)
+			if i < p.cursor {
+				p.cursor--
+			}
+			return
+		}
+	}
+}
+
+func (p *roundRobinPolicy) order() []string {
+	if len(p.keys) == 0 {
+		return p.keys
+	}
+	start := p.cursor % len(p.keys)
+	return append(append([]string{}, p.keys[start:]...), p.keys[:start]...)
+}
+
+func (p *roundRobinPolicy) served(key string) {
+	for i, k := range p.keys {
+		if k == key {
+			p.cursor = i + 1
+			return
+		}
+	}
+}
+
+func (p *roundRobinPolicy) clone() partitionPolicy {
+	return &roundRobinPolicy{keyOf: p.keyOf, keys: append([]string{}, p.keys...), cursor: p.cursor}
+}
+
+// NewListFairQueue creates a new in-memory queue that rotates between the keys of the queued items
+// on each dequeue, and is immediately ready to receive enqueue requests.  Items that share a key are
+// dequeued in FIFO order.  The size of the queue is limited by the `size` parameter, and the key of
+// each item is determined by the `keyOf` function.
+func NewListFairQueue(size int, keyOf PartitionFunc) RequestQueue {
+	return newPartitionedQueue(size, &roundRobinPolicy{keyOf: keyOf}, newListPartition, newLeaseTable())
+}
+
+// NewPersistedFairQueue creates a new fair queue that persists its contents to disk.  The items for
+// each key are stored as a separate dque prefixed with `<queueName>.fair.` in `queueDir`, and any
+// existing entries are reloaded.  The size of the queue is limited by the `size` parameter, and the
+// key of each item is determined by the `keyOf` function.
+func NewPersistedFairQueue(size int, queueDir string, queueName string, keyOf PartitionFunc) (RequestQueue, error) {
+	return newPersistedPartitionedQueue(size, queueDir, queueName+".fair.", &roundRobinPolicy{keyOf: keyOf})
+}
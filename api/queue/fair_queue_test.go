@@ -0,0 +1,182 @@
+package queue
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPartitionKey uses the hundreds digit of an int value as its key
+func testPartitionKey(x interface{}) string {
+	return strconv.Itoa(x.(int) / 100)
+}
+
+func TestListFairEnqueueDequeue(t *testing.T) {
+	queue := NewListFairQueue(10, testPartitionKey)
+
+	for _, value := range []int{10, 20, 30, 40, 110, 120, 210} {
+		result, err := queue.Enqueue(value)
+		assert.NoError(t, err)
+		assert.True(t, result)
+	}
+
+	depths := queue.(DepthReporter).Depths()
+	assert.Equal(t, map[string]int{"0": 4, "1": 2, "2": 1}, depths)
+
+	// keys are serviced in turn, FIFO within a key
+	for _, expected := range []int{10, 110, 210, 20, 120, 30} {
+		dequeueResult, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dequeueResult.(int))
+	}
+
+	// a new key joins the end of the rotation
+	_, _ = queue.Enqueue(310)
+	_, _ = queue.Enqueue(50)
+	for _, expected := range []int{40, 310, 50} {
+		dequeueResult, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dequeueResult.(int))
+	}
+	assert.Equal(t, 0, queue.Size())
+	assert.Empty(t, queue.(DepthReporter).Depths())
+}
+
+func TestListFairGetOrdered(t *testing.T) {
+	queue := NewListFairQueue(10, testPartitionKey)
+
+	for _, value := range []int{10, 20, 30, 40, 110, 120, 210} {
+		_, err := queue.Enqueue(value)
+		assert.NoError(t, err)
+	}
+
+	// contents are listed grouped by key, but ordered as the keys are serviced
+	contents, err := queue.GetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{10, 20, 30, 40, 110, 120, 210}, contents)
+	contents, err = ListOrdered(queue)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{10, 110, 210, 20, 120, 30, 40}, contents)
+
+	// listing doesn't change the rotation, and follows it part way through
+	dequeueResult, err := queue.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, dequeueResult.(int))
+	_, _ = queue.Enqueue(310)
+	contents, err = ListOrdered(NewNotifyingQueue(queue))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{110, 210, 20, 310, 120, 30, 40}, contents)
+
+	for _, expected := range contents {
+		dequeueResult, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dequeueResult)
+	}
+	assert.Equal(t, 0, queue.Size())
+}
+
+func TestListFairHashedEnqueueDequeue(t *testing.T) {
+	queue := NewListFairQueue(3, testPartitionKey)
+
+	result, err := queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	result, err = queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	result, err = queue.EnqueueHashed(2, 110)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	result, err = queue.EnqueueHashed(3, 20)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	result, err = queue.EnqueueHashed(4, 30)
+	assert.NoError(t, err)
+	assert.False(t, result)
+	assert.Equal(t, 3, queue.Size())
+
+	contents, err := queue.GetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{10, 20, 110}, contents)
+
+	err = queue.Clear()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, queue.Size())
+
+	result, err = queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 1, queue.Size())
+}
+
+func TestPersistedFairLoad(t *testing.T) {
+	dir := path.Join("test_data", "fq1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	queue, err := NewPersistedFairQueue(5, dir, "fq", testPartitionKey)
+	assert.NoError(t, err)
+	_, _ = queue.EnqueueHashed(1, 10)
+	_, _ = queue.EnqueueHashed(2, 20)
+	_, _ = queue.EnqueueHashed(3, 110)
+	_, _ = queue.EnqueueHashed(4, 120)
+	err = queue.Close()
+	assert.NoError(t, err)
+
+	queue, err = NewPersistedFairQueue(5, dir, "fq", testPartitionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, queue.Size())
+	assert.Equal(t, map[string]int{"0": 2, "1": 2}, queue.(DepthReporter).Depths())
+
+	// keys are restored
+	result, err := queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 4, queue.Size())
+
+	for _, expected := range []int{10, 110, 20, 120} {
+		dequeueResult, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dequeueResult.(int))
+	}
+
+	// emptied partitions are removed from disk
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	err = queue.Close()
+	assert.NoError(t, err)
+}
+
+func TestPersistedFairRemove(t *testing.T) {
+	dir := path.Join("test_data", "fq2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	queue, err := NewPersistedFairQueue(5, dir, "fq", testPartitionKey)
+	assert.NoError(t, err)
+	_, _ = queue.EnqueueHashed(1, 10)
+	_, _ = queue.EnqueueHashed(2, 20)
+	_, _ = queue.EnqueueHashed(3, 110)
+
+	removed, err := queue.Remove(func(x interface{}) bool { return x.(int) > 100 })
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{110}, removed)
+	assert.Equal(t, map[string]int{"0": 2}, queue.(DepthReporter).Depths())
+
+	result, err := queue.EnqueueHashed(3, 110)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 3, queue.Size())
+
+	err = queue.Close()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,245 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Lease is a reservation on a queued item.  The item is hidden from other consumers until the
+// lease is acknowledged, which removes it permanently, or negatively acknowledged, which returns
+// it to the head of the queue.  A lease that is not acknowledged before its visibility timeout
+// expires is returned to the head of the queue automatically.
+type Lease struct {
+	ID    uint64
+	Value interface{}
+}
+
+// leasedItem is a queued item that has been removed from the underlying queue storage but has not
+// been acknowledged.  Released items are waiting to be redelivered.  Each delivery gets a new lease
+// ID, and the IDs of earlier deliveries are kept so that they can be told apart from leases that
+// were acknowledged.
+type leasedItem struct {
+	ID       uint64
+	Item     *queuedItem
+	Deadline time.Time
+	Released bool
+	Previous []uint64
+}
+
+// leaseTable tracks the items that have been reserved from a queue.  When a journal path is
+// supplied, callers save the table to disk whenever items are added or removed so that unacknowledged
+// items survive a restart.  Lease state doesn't need to be saved, since every lease is released on
+// reload.  When a condition is supplied, it is broadcast whenever a lease expires so that consumers
+// waiting for data notice the released item.  Lease tables are not thread safe - callers are
+// expected to synchronize access.
+type leaseTable struct {
+	leases  []*leasedItem
+	nextID  uint64
+	journal string
+	expired *sync.Cond
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{leases: []*leasedItem{}, nextID: 1}
+}
+
+// loadLeaseTable creates a lease table backed by the supplied journal file, reloading any leases
+// left by a previous run.  Reloaded leases are released, since whoever held them is gone.
+func loadLeaseTable(journal string) (*leaseTable, error) {
+	table := newLeaseTable()
+	table.journal = journal
+
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return table, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read lease journal %s", journal)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&table.leases); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode lease journal %s", journal)
+	}
+	for _, lease := range table.leases {
+		lease.Released = true
+		if lease.ID >= table.nextID {
+			table.nextID = lease.ID + 1
+		}
+	}
+	return table, nil
+}
+
+// save writes the table to its journal, if it has one.
+func (l *leaseTable) save() error {
+	if l.journal == "" {
+		return nil
+	}
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(l.leases); err != nil {
+		return errors.Wrap(err, "failed to encode lease journal")
+	}
+	// write to a temporary file and rename so that a crash never leaves a partial journal
+	tmp := l.journal + ".tmp"
+	if err := os.WriteFile(tmp, buffer.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write lease journal %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, l.journal), "failed to write lease journal %s", l.journal)
+}
+
+// expire releases any lease whose visibility timeout has passed.
+func (l *leaseTable) expire(now time.Time) {
+	for _, lease := range l.leases {
+		if !lease.Released && !now.Before(lease.Deadline) {
+			lease.Released = true
+		}
+	}
+}
+
+// released returns the number of items waiting to be redelivered.
+func (l *leaseTable) released() int {
+	count := 0
+	for _, lease := range l.leases {
+		if lease.Released {
+			count++
+		}
+	}
+	return count
+}
+
+// releasedItems returns the items waiting to be redelivered, in redelivery order.
+func (l *leaseTable) releasedItems() []*queuedItem {
+	items := []*queuedItem{}
+	for _, lease := range l.leases {
+		if lease.Released {
+			items = append(items, lease.Item)
+		}
+	}
+	return items
+}
+
+// redeliver leases the oldest released item under a new lease ID, returning nil if there are none.
+// The previous holder can no longer acknowledge the item.
+func (l *leaseTable) redeliver(deadline time.Time) *Lease {
+	for _, lease := range l.leases {
+		if lease.Released {
+			lease.Previous = append(lease.Previous, lease.ID)
+			lease.ID = l.nextID
+			l.nextID++
+			lease.Released = false
+			lease.Deadline = deadline
+			l.wakeAt(deadline)
+			return &Lease{ID: lease.ID, Value: lease.Item.Value}
+		}
+	}
+	return nil
+}
+
+// take removes the oldest released item from the table, returning nil if there are none.
+func (l *leaseTable) take() *queuedItem {
+	for i, lease := range l.leases {
+		if lease.Released {
+			l.leases = append(l.leases[:i], l.leases[i+1:]...)
+			return lease.Item
+		}
+	}
+	return nil
+}
+
+// add leases an item that has been taken from the underlying queue storage.
+func (l *leaseTable) add(item *queuedItem, deadline time.Time) *Lease {
+	lease := &leasedItem{ID: l.nextID, Item: item, Deadline: deadline}
+	l.nextID++
+	l.leases = append(l.leases, lease)
+	l.wakeAt(deadline)
+	return &Lease{ID: lease.ID, Value: item.Value}
+}
+
+// remove deletes a lease from the table, returning the leased item.  A lease that has expired is
+// still removed if its item hasn't been taken yet, so that an acknowledgement arriving after the
+// visibility timeout doesn't leave a copy of the item to be delivered again.  Removing a lease
+// whose item has since been redelivered is an error, while removing a lease that was issued but is
+// no longer in the table is a no-op that returns a nil item.
+func (l *leaseTable) remove(id uint64) (*queuedItem, error) {
+	for i, lease := range l.leases {
+		if lease.ID == id {
+			l.leases = append(l.leases[:i], l.leases[i+1:]...)
+			return lease.Item, nil
+		}
+		for _, previous := range lease.Previous {
+			if previous == id {
+				return nil, errors.Errorf("lease %d expired and was redelivered", id)
+			}
+		}
+	}
+	if id > 0 && id < l.nextID {
+		return nil, nil
+	}
+	return nil, errors.Errorf("no lease %d", id)
+}
+
+// release returns a lease to the head of the queue.  Released items keep their original position
+// relative to each other.  Releasing a lease that has already expired is a no-op, but releasing one
+// whose item has since been redelivered is an error.
+func (l *leaseTable) release(id uint64) error {
+	for _, lease := range l.leases {
+		if lease.ID == id {
+			lease.Released = true
+			return nil
+		}
+	}
+	return errors.Errorf("no outstanding lease %d", id)
+}
+
+// wakeAt broadcasts on the table's condition once `deadline` has passed, so that consumers waiting
+// for data notice a lease that expires while they wait.
+func (l *leaseTable) wakeAt(deadline time.Time) {
+	cond := l.expired
+	if cond == nil {
+		return
+	}
+	time.AfterFunc(time.Until(deadline), func() {
+		cond.L.Lock()
+		defer cond.L.Unlock()
+		cond.Broadcast()
+	})
+}
+
+// clear removes all released items, leaving outstanding leases in place so that they can still
+// be acknowledged.
+func (l *leaseTable) clear() {
+	leases := []*leasedItem{}
+	for _, lease := range l.leases {
+		if !lease.Released {
+			leases = append(leases, lease)
+		}
+	}
+	l.leases = leases
+}
+
+// removeReleased deletes the released items that satisfy `match`, returning the removed items.
+func (l *leaseTable) removeReleased(match func(x interface{}) bool) []*queuedItem {
+	removed := []*queuedItem{}
+	leases := []*leasedItem{}
+	for _, lease := range l.leases {
+		if lease.Released && match(lease.Item.Value) {
+			removed = append(removed, lease.Item)
+		} else {
+			leases = append(leases, lease)
+		}
+	}
+	l.leases = leases
+	return removed
+}
+
+// keys returns the set of hash keys for all of the items held in the table.
+func (l *leaseTable) keys() map[int]bool {
+	keys := map[int]bool{}
+	for _, lease := range l.leases {
+		keys[lease.Item.Key] = true
+	}
+	return keys
+}
@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"errors"
 	"sync"
+	"time"
 )
 
 // RequestQueue defines an interface for a request queue that supports enqueuing and dequeuing operations.
@@ -15,6 +16,39 @@ type RequestQueue interface {
 	Close() error
 	Size() int
 	GetAll() ([]interface{}, error)
+	Reserve(visibilityTimeout time.Duration) (*Lease, error)
+	Ack(id uint64) error
+	Nack(id uint64) error
+	Remove(match func(x interface{}) bool) ([]interface{}, error)
+}
+
+// Deduplicator is implemented by queues that report whether a hashed enqueue added its item, or
+// dropped it because an item with the same key was already queued.
+type Deduplicator interface {
+	// EnqueueUnique behaves like EnqueueHashed, and also returns true if the item was dropped as a
+	// duplicate.
+	EnqueueUnique(key int, x interface{}) (bool, bool, error)
+}
+
+// OrderedLister is implemented by queues that don't dequeue their contents in the order GetAll
+// lists them, and can list them in the order they will be dequeued instead.
+type OrderedLister interface {
+	GetOrdered() ([]interface{}, error)
+}
+
+// ListOrdered returns the contents of a queue in the order they will be dequeued, if the queue can
+// list them that way, and in the order returned by GetAll otherwise.
+func ListOrdered(requestQueue RequestQueue) ([]interface{}, error) {
+	if lister, ok := requestQueue.(OrderedLister); ok {
+		return lister.GetOrdered()
+	}
+	return requestQueue.GetAll()
+}
+
+// DuplicateCounter is implemented by queues that count the hashed enqueues that were dropped
+// because an item with the same key was already queued.
+type DuplicateCounter interface {
+	Duplicates() uint64
 }
 
 type queuedItem struct {
@@ -25,25 +59,32 @@ type queuedItem struct {
 // ListFIFOQueue is a FIFO queue implementation based on a doubly linked list.
 type ListFIFOQueue struct {
 	queue  *list.List
+	leases *leaseTable
 	hashes map[int]bool
 	size   int
 	closed bool
 	mutex  *sync.RWMutex
 	cond   *sync.Cond
+	// duplicates counts hashed enqueues of already queued keys
+	duplicates uint64
 }
 
 // NewListFIFOQueue create a new ServiceRequestQueue that is immediately ready to
 // receive enqueue requests.  The size of the queue is limited by the `size` parameter.
 func NewListFIFOQueue(size int) RequestQueue {
 	mutex := &sync.RWMutex{}
+	cond := sync.NewCond(mutex)
+	leases := newLeaseTable()
+	leases.expired = cond
 
 	srQueue := &ListFIFOQueue{
 		queue:  list.New(),
+		leases: leases,
 		hashes: map[int]bool{},
 		size:   size,
 		closed: false,
 		mutex:  mutex,
-		cond:   sync.NewCond(mutex),
+		cond:   cond,
 	}
 
 	return srQueue
@@ -59,7 +100,7 @@ func (r *ListFIFOQueue) Enqueue(x interface{}) (bool, error) {
 		return false, errors.New("no enqueue after close")
 	}
 
-	if r.queue.Len() < r.size {
+	if r.count() < r.size {
 		// add data
 		r.queue.PushBack(&queuedItem{Value: x})
 		r.cond.Signal()
@@ -71,24 +112,32 @@ func (r *ListFIFOQueue) Enqueue(x interface{}) (bool, error) {
 // EnqueueHashed adds a new item to the queue if an item with a similar hash doesn't already exist.
 // If the queue is full, the item will not be added, and the function will return `false`.  If an
 func (r *ListFIFOQueue) EnqueueHashed(key int, x interface{}) (bool, error) {
+	result, _, err := r.EnqueueUnique(key, x)
+	return result, err
+}
+
+// EnqueueUnique adds a new item to the queue like EnqueueHashed, and also returns true if the item
+// wasn't added because an item with the same hash already exists.
+func (r *ListFIFOQueue) EnqueueUnique(key int, x interface{}) (bool, bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	if r.closed {
-		return false, errors.New("no enqueue after close")
+		return false, false, errors.New("no enqueue after close")
 	}
 
 	if !r.hashes[key] {
-		if r.queue.Len() < r.size {
+		if r.count() < r.size {
 			r.queue.PushBack(&queuedItem{Value: x, Key: key})
 			r.hashes[key] = true
 			// signal that there's data available
 			r.cond.Signal()
-			return true, nil
+			return true, false, nil
 		}
-		return false, nil
+		return false, false, nil
 	}
-	return true, nil
+	r.duplicates++
+	return true, true, nil
 }
 
 // Dequeue removes an item from the queue.  If the queue is empty, the operation blocks.
@@ -96,13 +145,22 @@ func (r *ListFIFOQueue) Dequeue() (interface{}, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if r.closed {
-		return false, errors.New("no dequeue after close")
+	// wait until there's data, which includes leases that expire while waiting
+	for {
+		if r.closed {
+			return false, errors.New("no dequeue after close")
+		}
+		r.leases.expire(time.Now())
+		if r.count() > 0 {
+			break
+		}
+		r.cond.Wait()
 	}
 
-	// wait until there's data
-	for r.queue.Len() == 0 {
-		r.cond.Wait()
+	// items returned by a lease are at the head of the queue
+	if item := r.leases.take(); item != nil {
+		delete(r.hashes, item.Key)
+		return item.Value, nil
 	}
 
 	// peek at the data
@@ -122,7 +180,19 @@ func (r *ListFIFOQueue) Dequeue() (interface{}, error) {
 func (r *ListFIFOQueue) Size() int {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
-	return r.queue.Len()
+	return r.count()
+}
+
+// Duplicates returns the number of hashed enqueues that matched an already queued item.
+func (r *ListFIFOQueue) Duplicates() uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.duplicates
+}
+
+// count returns the number of items waiting to be dequeued, including any returned by a lease.
+func (r *ListFIFOQueue) count() int {
+	return r.queue.Len() + r.leases.released()
 }
 
 // Clear clears the queue and request key hash map.
@@ -135,7 +205,8 @@ func (r *ListFIFOQueue) Clear() error {
 	}
 
 	r.queue.Init()
-	r.hashes = map[int]bool{}
+	r.leases.clear()
+	r.hashes = r.leases.keys()
 
 	return nil
 }
@@ -150,6 +221,7 @@ func (r *ListFIFOQueue) Close() error {
 	}
 
 	r.closed = true
+	r.cond.Broadcast()
 	return nil
 }
 
@@ -158,9 +230,14 @@ func (r *ListFIFOQueue) GetAll() ([]interface{}, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	listCopy := make([]interface{}, r.queue.Len())
-	current := r.queue.Front()
+	r.leases.expire(time.Now())
+	listCopy := make([]interface{}, r.count())
 	i := 0
+	for _, item := range r.leases.releasedItems() {
+		listCopy[i] = item.Value
+		i++
+	}
+	current := r.queue.Front()
 	for current != nil {
 		item, ok := current.Value.(*queuedItem)
 		if !ok {
@@ -172,3 +249,81 @@ func (r *ListFIFOQueue) GetAll() ([]interface{}, error) {
 	}
 	return listCopy, nil
 }
+
+// Reserve leases the item at the head of the queue, hiding it from other consumers until it is
+// acknowledged or `visibilityTimeout` passes.  If the queue is empty a nil lease is returned.
+func (r *ListFIFOQueue) Reserve(visibilityTimeout time.Duration) (*Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.New("no reserve after close")
+	}
+
+	now := time.Now()
+	r.leases.expire(now)
+	if lease := r.leases.redeliver(now.Add(visibilityTimeout)); lease != nil {
+		return lease, nil
+	}
+
+	front := r.queue.Front()
+	if front == nil {
+		return nil, nil
+	}
+	r.queue.Remove(front)
+	return r.leases.add(front.Value.(*queuedItem), now.Add(visibilityTimeout)), nil
+}
+
+// Ack permanently removes a leased item from the queue.
+func (r *ListFIFOQueue) Ack(id uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	item, err := r.leases.remove(id)
+	if err != nil || item == nil {
+		return err
+	}
+	delete(r.hashes, item.Key)
+	return nil
+}
+
+// Nack returns a leased item to the head of the queue.
+func (r *ListFIFOQueue) Nack(id uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.leases.release(id); err != nil {
+		return err
+	}
+	r.cond.Signal()
+	return nil
+}
+
+// Remove deletes all queued items that satisfy `match`, returning the removed items.  Items that
+// are currently leased are not removed.
+func (r *ListFIFOQueue) Remove(match func(x interface{}) bool) ([]interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.New("no remove after close")
+	}
+
+	removed := []interface{}{}
+	for _, item := range r.leases.removeReleased(match) {
+		delete(r.hashes, item.Key)
+		removed = append(removed, item.Value)
+	}
+	current := r.queue.Front()
+	for current != nil {
+		next := current.Next()
+		item := current.Value.(*queuedItem)
+		if match(item.Value) {
+			r.queue.Remove(current)
+			delete(r.hashes, item.Key)
+			removed = append(removed, item.Value)
+		}
+		current = next
+	}
+	return removed, nil
+}
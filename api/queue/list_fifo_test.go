@@ -100,6 +100,7 @@ func TestHashedEnqueueDequeue(t *testing.T) {
 
 	count = queue.Size()
 	assert.Equal(t, 1, count)
+	assert.Equal(t, uint64(1), queue.(DuplicateCounter).Duplicates())
 }
 
 func TestListClear(t *testing.T) {
@@ -139,3 +140,105 @@ func TestListClose(t *testing.T) {
 	_, err = queue.Dequeue()
 	assert.Error(t, err)
 }
+
+func TestListReserveAckNack(t *testing.T) {
+	queue := NewListFIFOQueue(3)
+	_, _ = queue.EnqueueHashed(1, 10)
+	_, _ = queue.EnqueueHashed(2, 20)
+
+	lease, err := queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, lease.Value.(int))
+	assert.Equal(t, 1, queue.Size())
+
+	// leased items are still considered duplicates
+	result, err := queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 1, queue.Size())
+
+	// a nack returns the item to the head of the queue
+	err = queue.Nack(lease.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queue.Size())
+	contents, err := queue.GetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{10, 20}, contents)
+
+	lease, err = queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, lease.Value.(int))
+
+	// an ack removes the item permanently, and acking it again is a no-op
+	err = queue.Ack(lease.ID)
+	assert.NoError(t, err)
+	err = queue.Ack(lease.ID)
+	assert.NoError(t, err)
+	err = queue.Ack(lease.ID + 1)
+	assert.Error(t, err)
+	assert.Equal(t, 1, queue.Size())
+
+	result, err = queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 2, queue.Size())
+}
+
+func TestListReserveTimeout(t *testing.T) {
+	queue := NewListFIFOQueue(2)
+	_, _ = queue.Enqueue(10)
+
+	lease, err := queue.Reserve(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, lease.Value.(int))
+
+	empty, err := queue.Reserve(10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, empty)
+
+	// an expired lease is redelivered under a new lease
+	time.Sleep(20 * time.Millisecond)
+	redelivered, err := queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.NotEqual(t, lease.ID, redelivered.ID)
+	assert.Equal(t, 10, redelivered.Value.(int))
+
+	// the original holder can't ack or nack the new delivery
+	assert.Error(t, queue.Ack(lease.ID))
+	assert.Error(t, queue.Nack(lease.ID))
+	empty, err = queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, empty)
+	assert.NoError(t, queue.Ack(redelivered.ID))
+	assert.Equal(t, 0, queue.Size())
+}
+
+func TestListRemove(t *testing.T) {
+	queue := NewListFIFOQueue(5)
+	_, _ = queue.EnqueueHashed(1, 10)
+	_, _ = queue.EnqueueHashed(2, 20)
+	_, _ = queue.EnqueueHashed(3, 30)
+	_, _ = queue.EnqueueHashed(4, 40)
+
+	// released leases can be removed, outstanding ones can't
+	lease, _ := queue.Reserve(time.Minute)
+	_ = queue.Nack(lease.ID)
+	lease, _ = queue.Reserve(time.Minute)
+	assert.Equal(t, 10, lease.Value.(int))
+	_, _ = queue.Reserve(time.Minute)
+	_ = queue.Nack(lease.ID)
+
+	removed, err := queue.Remove(func(x interface{}) bool { return x.(int) != 30 })
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []interface{}{10, 40}, removed)
+
+	contents, err := queue.GetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{30}, contents)
+
+	// keys of removed items can be enqueued again
+	result, err := queue.EnqueueHashed(4, 40)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 2, queue.Size())
+}
@@ -0,0 +1,87 @@
+package queue
+
+// EnqueueNotifier is implemented by queues that signal when items are added to them, so that
+// consumers can wait for work rather than polling.
+type EnqueueNotifier interface {
+	// Enqueued returns a channel that receives a value after items are added to the queue.  Signals
+	// are coalesced, so a single receive may follow several enqueues.
+	Enqueued() <-chan struct{}
+}
+
+// NotifyingQueue wraps a request queue, signalling each time an item is successfully enqueued.
+type NotifyingQueue struct {
+	RequestQueue
+	enqueued chan struct{}
+}
+
+// NewNotifyingQueue creates a queue that signals on enqueue, storing its items in `requestQueue`.
+func NewNotifyingQueue(requestQueue RequestQueue) *NotifyingQueue {
+	return &NotifyingQueue{
+		RequestQueue: requestQueue,
+		enqueued:     make(chan struct{}, 1),
+	}
+}
+
+// Enqueued returns the channel that is signalled after items are added to the queue.
+func (r *NotifyingQueue) Enqueued() <-chan struct{} {
+	return r.enqueued
+}
+
+// Enqueue adds a new item to the wrapped queue, signalling if it was added.
+func (r *NotifyingQueue) Enqueue(x interface{}) (bool, error) {
+	return r.signal(r.RequestQueue.Enqueue(x))
+}
+
+// EnqueueHashed adds a new item to the wrapped queue, signalling if it was added.
+func (r *NotifyingQueue) EnqueueHashed(key int, x interface{}) (bool, error) {
+	result, _, err := r.EnqueueUnique(key, x)
+	return result, err
+}
+
+// EnqueueUnique adds a new item to the wrapped queue like EnqueueHashed, signalling if it was added
+// rather than dropped as a duplicate.  Duplicates are only reported if the wrapped queue reports
+// them.
+func (r *NotifyingQueue) EnqueueUnique(key int, x interface{}) (bool, bool, error) {
+	deduplicator, ok := r.RequestQueue.(Deduplicator)
+	if !ok {
+		result, err := r.signal(r.RequestQueue.EnqueueHashed(key, x))
+		return result, false, err
+	}
+	result, duplicate, err := deduplicator.EnqueueUnique(key, x)
+	if !duplicate {
+		r.signal(result, err)
+	}
+	return result, duplicate, err
+}
+
+// Depths reports the per-partition depths of the wrapped queue, or nil if it isn't partitioned.
+func (r *NotifyingQueue) Depths() map[string]int {
+	if reporter, ok := r.RequestQueue.(DepthReporter); ok {
+		return reporter.Depths()
+	}
+	return nil
+}
+
+// Duplicates reports the duplicate enqueues of the wrapped queue, or 0 if it doesn't count them.
+func (r *NotifyingQueue) Duplicates() uint64 {
+	if counter, ok := r.RequestQueue.(DuplicateCounter); ok {
+		return counter.Duplicates()
+	}
+	return 0
+}
+
+// GetOrdered lists the contents of the wrapped queue in the order they will be dequeued.
+func (r *NotifyingQueue) GetOrdered() ([]interface{}, error) {
+	return ListOrdered(r.RequestQueue)
+}
+
+func (r *NotifyingQueue) signal(added bool, err error) (bool, error) {
+	if added && err == nil {
+		select {
+		case r.enqueued <- struct{}{}:
+		default:
+			// a signal is already pending
+		}
+	}
+	return added, err
+}
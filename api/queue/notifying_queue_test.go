@@ -0,0 +1,60 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pending(queue *NotifyingQueue) bool {
+	select {
+	case <-queue.Enqueued():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestNotifyingEnqueue(t *testing.T) {
+	queue := NewNotifyingQueue(NewListFIFOQueue(2))
+	assert.False(t, pending(queue))
+
+	// signals are coalesced until they are received
+	result, err := queue.Enqueue(10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	result, err = queue.EnqueueHashed(20, 20)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.True(t, pending(queue))
+	assert.False(t, pending(queue))
+
+	// nothing is signalled when an item isn't added
+	result, err = queue.Enqueue(30)
+	assert.NoError(t, err)
+	assert.False(t, result)
+	assert.False(t, pending(queue))
+
+	// nor when it's dropped as a duplicate
+	result, duplicate, err := queue.EnqueueUnique(20, 20)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.True(t, duplicate)
+	assert.False(t, pending(queue))
+
+	// returning a leased item doesn't signal
+	lease, err := queue.Reserve(0)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Nack(lease.ID))
+	assert.False(t, pending(queue))
+	assert.Equal(t, 2, queue.Size())
+}
+
+func TestNotifyingDepths(t *testing.T) {
+	queue := NewNotifyingQueue(NewListFIFOQueue(2))
+	assert.Nil(t, queue.Depths())
+
+	queue = NewNotifyingQueue(NewListFairQueue(2, func(x interface{}) string { return "a" }))
+	_, _ = queue.Enqueue(10)
+	assert.Equal(t, map[string]int{"a": 1}, queue.Depths())
+}
@@ -0,0 +1,217 @@
+package queue
+
+import (
+	"container/list"
+	"os"
+	"path"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/uncharted-causemos/dque"
+)
+
+// partition is a single FIFO sub-queue used by queue implementations that split their contents
+// across multiple FIFOs (ie. one per priority level, or one per model).  Partitions are not thread safe - callers
+// are expected to synchronize access.
+type partition interface {
+	push(item *queuedItem) error
+	pop() (*queuedItem, error)
+	peek() (*queuedItem, error)
+	size() int
+	items() ([]*queuedItem, error)
+	remove(match func(x interface{}) bool) ([]*queuedItem, error)
+	close() error
+	destroy() error
+}
+
+// partitionBuilder creates or re-opens the partition stored under the supplied name.
+type partitionBuilder func(name string) (partition, error)
+
+// listPartition is an in-memory partition based on a doubly linked list.
+type listPartition struct {
+	queue *list.List
+}
+
+func newListPartition(name string) (partition, error) {
+	return &listPartition{queue: list.New()}, nil
+}
+
+func (p *listPartition) push(item *queuedItem) error {
+	p.queue.PushBack(item)
+	return nil
+}
+
+func (p *listPartition) pop() (*queuedItem, error) {
+	front := p.queue.Front()
+	if front == nil {
+		return nil, errors.New("partition is empty")
+	}
+	p.queue.Remove(front)
+	return front.Value.(*queuedItem), nil
+}
+
+func (p *listPartition) peek() (*queuedItem, error) {
+	front := p.queue.Front()
+	if front == nil {
+		return nil, errors.New("partition is empty")
+	}
+	return front.Value.(*queuedItem), nil
+}
+
+func (p *listPartition) size() int {
+	return p.queue.Len()
+}
+
+func (p *listPartition) items() ([]*queuedItem, error) {
+	result := make([]*queuedItem, 0, p.queue.Len())
+	for current := p.queue.Front(); current != nil; current = current.Next() {
+		result = append(result, current.Value.(*queuedItem))
+	}
+	return result, nil
+}
+
+func (p *listPartition) remove(match func(x interface{}) bool) ([]*queuedItem, error) {
+	removed := []*queuedItem{}
+	current := p.queue.Front()
+	for current != nil {
+		next := current.Next()
+		item := current.Value.(*queuedItem)
+		if match(item.Value) {
+			p.queue.Remove(current)
+			removed = append(removed, item)
+		}
+		current = next
+	}
+	return removed, nil
+}
+
+func (p *listPartition) close() error {
+	return nil
+}
+
+func (p *listPartition) destroy() error {
+	return nil
+}
+
+// dquePartition is a partition persisted to disk using a dque.
+type dquePartition struct {
+	queue *dque.DQue
+	path  string
+}
+
+// newDquePartitionBuilder returns a builder that stores each partition as a separate dque
+// in the supplied directory.
+func newDquePartitionBuilder(queueDir string) partitionBuilder {
+	return func(name string) (partition, error) {
+		if err := os.MkdirAll(queueDir, os.ModePerm); err != nil {
+			return nil, errors.Wrapf(err, "failed to create request queue dir %s", queueDir)
+		}
+		queue, err := dque.NewOrOpen(name, queueDir, queueSegmenSize, queuedItemBuilder)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to initialize request queue %s/%s", queueDir, name)
+		}
+		return &dquePartition{queue: queue, path: path.Join(queueDir, name)}, nil
+	}
+}
+
+func (p *dquePartition) push(item *queuedItem) error {
+	return errors.Wrap(p.queue.Enqueue(item), "failed to enqueue")
+}
+
+func (p *dquePartition) pop() (*queuedItem, error) {
+	result, err := p.queue.Dequeue()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dequeue")
+	}
+	return result.(*queuedItem), nil
+}
+
+func (p *dquePartition) peek() (*queuedItem, error) {
+	result, err := p.queue.Peek()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to peek")
+	}
+	return result.(*queuedItem), nil
+}
+
+func (p *dquePartition) size() int {
+	return p.queue.Size()
+}
+
+// itemCollector gathers the items of a dque when applied to it.
+type itemCollector struct {
+	items []*queuedItem
+}
+
+// Apply is called on each element of the queue, storing it in the collector.
+func (c *itemCollector) Apply(entry interface{}) error {
+	item, ok := entry.(*queuedItem)
+	if !ok {
+		return errors.Errorf("unexpected type %s", reflect.TypeOf(entry))
+	}
+	c.items = append(c.items, item)
+	return nil
+}
+
+func (p *dquePartition) items() ([]*queuedItem, error) {
+	collector := itemCollector{items: make([]*queuedItem, 0, p.queue.Size())}
+	if err := p.queue.ApplyToQueue(&collector); err != nil {
+		return nil, err
+	}
+	return collector.items, nil
+}
+
+func (p *dquePartition) remove(match func(x interface{}) bool) ([]*queuedItem, error) {
+	return removeFromDque(p.queue, match)
+}
+
+// removeFromDque deletes the items of a dque that satisfy `match`, returning the removed items.
+// The dque only supports adding to the tail and removing from the head, so each item is cycled
+// from the head to the tail, and matching items are dropped along the way.  Items are copied to
+// the tail before they are removed from the head so that a crash part way through can't lose an
+// item, although it may leave one duplicated.
+func removeFromDque(queue *dque.DQue, match func(x interface{}) bool) ([]*queuedItem, error) {
+	collector := itemCollector{items: make([]*queuedItem, 0, queue.Size())}
+	if err := queue.ApplyToQueue(&collector); err != nil {
+		return nil, err
+	}
+	found := false
+	for _, item := range collector.items {
+		if match(item.Value) {
+			found = true
+			break
+		}
+	}
+	removed := []*queuedItem{}
+	if !found {
+		return removed, nil
+	}
+
+	for range collector.items {
+		result, err := queue.Peek()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to remove from queue")
+		}
+		item := result.(*queuedItem)
+		if match(item.Value) {
+			removed = append(removed, item)
+		} else if err := queue.Enqueue(item); err != nil {
+			return nil, errors.Wrap(err, "failed to remove from queue")
+		}
+		if _, err := queue.Dequeue(); err != nil {
+			return nil, errors.Wrap(err, "failed to remove from queue")
+		}
+	}
+	return removed, nil
+}
+
+func (p *dquePartition) close() error {
+	return errors.Wrap(p.queue.Close(), "failed to close queue")
+}
+
+func (p *dquePartition) destroy() error {
+	if err := p.close(); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.RemoveAll(p.path), "failed to remove queue %s", p.path)
+}
@@ -0,0 +1,509 @@
+package queue
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DepthReporter is implemented by queues that can report the number of queued items
+// for each of their partitions.
+type DepthReporter interface {
+	Depths() map[string]int
+}
+
+// partitionPolicy determines which partition an item is stored in, and the order in which
+// partitions are serviced.  Policies are not thread safe - callers are expected to synchronize
+// access.
+type partitionPolicy interface {
+	// key returns the key of the partition the item belongs to
+	key(x interface{}) string
+	// add registers the key of a newly created partition
+	add(key string)
+	// remove unregisters the key of a partition that has been emptied
+	remove(key string)
+	// order returns the partition keys in the order they should be serviced
+	order() []string
+	// served is called after an item has been dequeued from a partition
+	served(key string)
+	// clone returns a copy of the policy that can be changed without affecting it
+	clone() partitionPolicy
+}
+
+// PartitionedQueue is a queue implementation that splits its contents across multiple FIFO
+// partitions, and uses a policy to determine which partition is serviced on each dequeue.
+// Partitions are created on demand and removed once they are emptied.
+type PartitionedQueue struct {
+	partitions   map[string]partition
+	policy       partitionPolicy
+	newPartition partitionBuilder
+	leases       *leaseTable
+	hashes       map[int]bool
+	size         int
+	closed       bool
+	mutex        *sync.RWMutex
+	cond         *sync.Cond
+	// duplicates counts hashed enqueues of already queued keys
+	duplicates uint64
+}
+
+func newPartitionedQueue(size int, policy partitionPolicy, builder partitionBuilder, leases *leaseTable) *PartitionedQueue {
+	mutex := &sync.RWMutex{}
+	cond := sync.NewCond(mutex)
+	leases.expired = cond
+
+	return &PartitionedQueue{
+		partitions:   map[string]partition{},
+		policy:       policy,
+		newPartition: builder,
+		leases:       leases,
+		hashes:       map[int]bool{},
+		size:         size,
+		closed:       false,
+		mutex:        mutex,
+		cond:         cond,
+	}
+}
+
+// newPersistedPartitionedQueue creates a partitioned queue that stores each partition as a separate
+// dque named `<prefix><hex encoded key>` in `queueDir`, and journals unacknowledged leases to
+// `<prefix>leases`.  Partitions and leases persisted by a previous run are reloaded.
+func newPersistedPartitionedQueue(size int, queueDir string, prefix string, policy partitionPolicy) (*PartitionedQueue, error) {
+	dqueBuilder := newDquePartitionBuilder(queueDir)
+	builder := func(key string) (partition, error) {
+		return dqueBuilder(prefix + hex.EncodeToString([]byte(key)))
+	}
+	leases, err := loadLeaseTable(path.Join(queueDir, prefix+"leases"))
+	if err != nil {
+		return nil, err
+	}
+	queue := newPartitionedQueue(size, policy, builder, leases)
+	queue.hashes = leases.keys()
+
+	entries, err := os.ReadDir(queueDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read request queue dir %s", queueDir)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		key, err := hex.DecodeString(strings.TrimPrefix(entry.Name(), prefix))
+		if err != nil {
+			continue
+		}
+		p, err := queue.getPartition(string(key))
+		if err != nil {
+			return nil, err
+		}
+		items, err := p.items()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed rebuild key set for %s/%s", queueDir, entry.Name())
+		}
+		for _, item := range items {
+			queue.hashes[item.Key] = true
+		}
+		if len(items) == 0 {
+			if err := queue.removePartition(string(key)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return queue, nil
+}
+
+// getPartition returns the partition for a key, creating it if it doesn't exist yet.
+func (r *PartitionedQueue) getPartition(key string) (partition, error) {
+	if p, ok := r.partitions[key]; ok {
+		return p, nil
+	}
+	p, err := r.newPartition(key)
+	if err != nil {
+		return nil, err
+	}
+	r.partitions[key] = p
+	r.policy.add(key)
+	return p, nil
+}
+
+// removePartition removes a partition and any storage associated with it.
+func (r *PartitionedQueue) removePartition(key string) error {
+	p, ok := r.partitions[key]
+	if !ok {
+		return nil
+	}
+	delete(r.partitions, key)
+	r.policy.remove(key)
+	return p.destroy()
+}
+
+// count returns the number of items waiting to be dequeued, including any returned by a lease.
+func (r *PartitionedQueue) count() int {
+	count := r.leases.released()
+	for _, p := range r.partitions {
+		count += p.size()
+	}
+	return count
+}
+
+// next returns the key of the partition selected by the queue's policy to be serviced next, and
+// false if all partitions are empty.
+func (r *PartitionedQueue) next() (string, bool) {
+	for _, key := range r.policy.order() {
+		if r.partitions[key].size() > 0 {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// pop removes the next item from a partition, removing the partition if it is emptied.
+func (r *PartitionedQueue) pop(key string) (*queuedItem, error) {
+	p := r.partitions[key]
+	item, err := p.pop()
+	if err != nil {
+		return nil, err
+	}
+	r.policy.served(key)
+	if p.size() == 0 {
+		if err := r.removePartition(key); err != nil {
+			return nil, err
+		}
+	}
+	return item, nil
+}
+
+func (r *PartitionedQueue) push(item *queuedItem) (bool, error) {
+	if r.count() >= r.size {
+		return false, nil
+	}
+	p, err := r.getPartition(r.policy.key(item.Value))
+	if err != nil {
+		return false, err
+	}
+	if err := p.push(item); err != nil {
+		return false, err
+	}
+	// signal that there's data available
+	r.cond.Signal()
+	return true, nil
+}
+
+// Enqueue adds a new item to the queue.  If the queue is full, the item will not
+// be added, and the function will return `false`.
+func (r *PartitionedQueue) Enqueue(x interface{}) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return false, errors.New("no enqueue after close")
+	}
+
+	return r.push(&queuedItem{Value: x})
+}
+
+// EnqueueHashed adds a new item to the queue if an item with a similar hash doesn't already exist.
+// If the queue is full, the item will not be added, and the function will return `false`.  If an entry
+// already exists, the item won't be added, but true will still be returned.
+func (r *PartitionedQueue) EnqueueHashed(key int, x interface{}) (bool, error) {
+	result, _, err := r.EnqueueUnique(key, x)
+	return result, err
+}
+
+// EnqueueUnique adds a new item to the queue like EnqueueHashed, and also returns true if the item
+// wasn't added because an item with the same hash already exists.
+func (r *PartitionedQueue) EnqueueUnique(key int, x interface{}) (bool, bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return false, false, errors.New("no enqueue after close")
+	}
+
+	if r.hashes[key] {
+		r.duplicates++
+		return true, true, nil
+	}
+	result, err := r.push(&queuedItem{Value: x, Key: key})
+	if result {
+		r.hashes[key] = true
+	}
+	return result, false, err
+}
+
+// Dequeue removes the next item from the partition selected by the queue's policy.  If the queue
+// is empty, the operation blocks.
+func (r *PartitionedQueue) Dequeue() (interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// wait until there's data, which includes leases that expire while waiting
+	for {
+		if r.closed {
+			return false, errors.New("no dequeue after close")
+		}
+		r.leases.expire(time.Now())
+		if r.count() > 0 {
+			break
+		}
+		r.cond.Wait()
+	}
+
+	// items returned by a lease are at the head of the queue
+	if item := r.leases.take(); item != nil {
+		delete(r.hashes, item.Key)
+		return item.Value, r.leases.save()
+	}
+
+	key, ok := r.next()
+	if !ok {
+		return nil, errors.New("no data available")
+	}
+	item, err := r.pop(key)
+	if err != nil {
+		return nil, err
+	}
+	delete(r.hashes, item.Key)
+	return item.Value, nil
+}
+
+// Size returns the curent size of the queue.
+func (r *PartitionedQueue) Size() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.count()
+}
+
+// Depths returns the number of items queued in each partition.
+func (r *PartitionedQueue) Depths() map[string]int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	depths := make(map[string]int, len(r.partitions))
+	for key, p := range r.partitions {
+		depths[key] = p.size()
+	}
+	return depths
+}
+
+// Duplicates returns the number of hashed enqueues that matched an already queued item.
+func (r *PartitionedQueue) Duplicates() uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.duplicates
+}
+
+// Clear clears the queue and request key hash map.
+func (r *PartitionedQueue) Clear() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return errors.New("no queue clear after close")
+	}
+
+	for key := range r.partitions {
+		if err := r.removePartition(key); err != nil {
+			return err
+		}
+	}
+	// clear the key map, keeping the keys of outstanding leases
+	r.leases.clear()
+	r.hashes = r.leases.keys()
+
+	return r.leases.save()
+}
+
+// Close closes the queue, flushes any persisted state to disk, and disallows any further
+// operations.
+func (r *PartitionedQueue) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return errors.New("no close of previously closed queue")
+	}
+
+	r.closed = true
+	r.cond.Broadcast()
+	for _, p := range r.partitions {
+		if err := p.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAll retrieves all the contents in the queue, grouped by partition in the order the
+// partitions will next be serviced.  Items returned by a lease are listed first.
+func (r *PartitionedQueue) GetAll() ([]interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.leases.expire(time.Now())
+	contents := make([]interface{}, 0, r.count())
+	for _, item := range r.leases.releasedItems() {
+		contents = append(contents, item.Value)
+	}
+	for _, key := range r.policy.order() {
+		items, err := r.partitions[key].items()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			contents = append(contents, item.Value)
+		}
+	}
+	return contents, nil
+}
+
+// GetOrdered retrieves all the contents in the queue in the order they will be dequeued, by
+// servicing the partitions with a copy of the queue's policy.  Items returned by a lease are listed
+// first.
+func (r *PartitionedQueue) GetOrdered() ([]interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.leases.expire(time.Now())
+	contents := make([]interface{}, 0, r.count())
+	for _, item := range r.leases.releasedItems() {
+		contents = append(contents, item.Value)
+	}
+
+	remaining := make(map[string][]*queuedItem, len(r.partitions))
+	for key, p := range r.partitions {
+		items, err := p.items()
+		if err != nil {
+			return nil, err
+		}
+		remaining[key] = items
+	}
+
+	// mirror pop, which tells the policy when a partition is serviced and when it is emptied
+	policy := r.policy.clone()
+	for {
+		key, ok := "", false
+		for _, k := range policy.order() {
+			if len(remaining[k]) > 0 {
+				key, ok = k, true
+				break
+			}
+		}
+		if !ok {
+			return contents, nil
+		}
+		contents = append(contents, remaining[key][0].Value)
+		remaining[key] = remaining[key][1:]
+		policy.served(key)
+		if len(remaining[key]) == 0 {
+			policy.remove(key)
+		}
+	}
+}
+
+// Reserve leases the next item selected by the queue's policy, hiding it from other consumers until
+// it is acknowledged or `visibilityTimeout` passes.  For persisted queues the item is journaled
+// before it is removed from its partition, so it will be redelivered if the service stops before it
+// is acknowledged.  If the queue is empty a nil lease is returned.
+func (r *PartitionedQueue) Reserve(visibilityTimeout time.Duration) (*Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.New("no reserve after close")
+	}
+
+	now := time.Now()
+	r.leases.expire(now)
+	if lease := r.leases.redeliver(now.Add(visibilityTimeout)); lease != nil {
+		return lease, nil
+	}
+
+	key, ok := r.next()
+	if !ok {
+		return nil, nil
+	}
+	item, err := r.partitions[key].peek()
+	if err != nil {
+		return nil, err
+	}
+	lease := r.leases.add(item, now.Add(visibilityTimeout))
+	if err := r.leases.save(); err != nil {
+		return nil, err
+	}
+	if _, err := r.pop(key); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Ack permanently removes a leased item from the queue.
+func (r *PartitionedQueue) Ack(id uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	item, err := r.leases.remove(id)
+	if err != nil || item == nil {
+		return err
+	}
+	delete(r.hashes, item.Key)
+	return r.leases.save()
+}
+
+// Nack returns a leased item to the head of the queue.
+func (r *PartitionedQueue) Nack(id uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.leases.release(id); err != nil {
+		return err
+	}
+	r.cond.Signal()
+	return nil
+}
+
+// Remove deletes all queued items that satisfy `match`, returning the removed items.  Items that
+// are currently leased are not removed.
+func (r *PartitionedQueue) Remove(match func(x interface{}) bool) ([]interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.New("no remove after close")
+	}
+
+	removed := []interface{}{}
+	releasedItems := r.leases.removeReleased(match)
+	for _, item := range releasedItems {
+		delete(r.hashes, item.Key)
+		removed = append(removed, item.Value)
+	}
+	if len(releasedItems) > 0 {
+		if err := r.leases.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, p := range r.partitions {
+		items, err := p.remove(match)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			delete(r.hashes, item.Key)
+			removed = append(removed, item.Value)
+		}
+		if p.size() == 0 {
+			if err := r.removePartition(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return removed, nil
+}
@@ -5,6 +5,7 @@ import (
 	"path"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/uncharted-causemos/dque"
@@ -17,9 +18,14 @@ const queueSegmenSize = 50
 type PersistedFIFOQueue struct {
 	config.Config
 	queue  *dque.DQue
+	leases *leaseTable
 	size   int
 	hashes map[int]bool
+	closed bool
 	mutex  *sync.RWMutex
+	cond   *sync.Cond
+	// duplicates counts hashed enqueues of already queued keys
+	duplicates uint64
 }
 
 func queuedItemBuilder() interface{} {
@@ -44,7 +50,9 @@ func (k *KeyMapBuilder) Apply(entry interface{}) error {
 }
 
 // NewPersistedFIFOQueue create a new ServiceRequestQueue that is immediately ready to
-// receive enqueue requests.  The size of the queue is limited by the `size` parameter.
+// receive enqueue requests.  The size of the queue is limited by the `size` parameter.  Reserved
+// items that have not been acknowledged are journaled to `<queueName>.leases` in `queueDir`, and
+// are returned to the head of the queue on reload.
 func NewPersistedFIFOQueue(size int, queueDir string, queueName string) (RequestQueue, error) {
 	mutex := &sync.RWMutex{}
 
@@ -76,11 +84,23 @@ func NewPersistedFIFOQueue(size int, queueDir string, queueName string) (Request
 		return nil, errors.Wrapf(err, "failed rebuild key set for %s/%s", queueDir, queueName)
 	}
 
+	leases, err := loadLeaseTable(path.Join(queueDir, queueName+".leases"))
+	if err != nil {
+		return nil, err
+	}
+	for key := range leases.keys() {
+		mapBuilder.KeyMap[key] = true
+	}
+	cond := sync.NewCond(mutex)
+	leases.expired = cond
+
 	srQueue := &PersistedFIFOQueue{
 		queue:  queue,
+		leases: leases,
 		size:   size,
 		hashes: mapBuilder.KeyMap,
 		mutex:  mutex,
+		cond:   cond,
 	}
 
 	return srQueue, nil
@@ -92,10 +112,11 @@ func (r *PersistedFIFOQueue) Enqueue(x interface{}) (bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if r.queue.Size() < r.size {
+	if r.count() < r.size {
 		if err := r.queue.Enqueue(&queuedItem{Value: x}); err != nil {
 			return false, errors.Wrap(err, "failed to enqueue")
 		}
+		r.cond.Signal()
 		return true, nil
 	}
 	return false, nil
@@ -105,42 +126,78 @@ func (r *PersistedFIFOQueue) Enqueue(x interface{}) (bool, error) {
 // If the queue is full, the item will not be added, and the function will return `false`.  If an entry
 // already exists, the item won't be added, but true will still be returned.
 func (r *PersistedFIFOQueue) EnqueueHashed(key int, x interface{}) (bool, error) {
+	result, _, err := r.EnqueueUnique(key, x)
+	return result, err
+}
+
+// EnqueueUnique adds a new item to the queue like EnqueueHashed, and also returns true if the item
+// wasn't added because an item with the same hash already exists.
+func (r *PersistedFIFOQueue) EnqueueUnique(key int, x interface{}) (bool, bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	if !r.hashes[key] {
-		if r.queue.Size() < r.size {
+		if r.count() < r.size {
 			if err := r.queue.Enqueue(&queuedItem{Value: x, Key: key}); err != nil {
-				return false, errors.Wrap(err, "failed to enqueue with hash key")
+				return false, false, errors.Wrap(err, "failed to enqueue with hash key")
 			}
 			r.hashes[key] = true
-			return true, nil
+			r.cond.Signal()
+			return true, false, nil
 		}
-		return false, nil
+		return false, false, nil
 	}
-	return true, nil
+	r.duplicates++
+	return true, true, nil
 }
 
 // Dequeue removes an item from the queue.  If the queue is empty, the operation blocks.
 func (r *PersistedFIFOQueue) Dequeue() (interface{}, error) {
-	result, err := r.queue.DequeueBlock()
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to dequeue")
-	}
-
-	value := result.(*queuedItem)
+	// wait until there's data, which includes leases that are released or expire while waiting
+	for {
+		if r.closed {
+			return nil, errors.New("no dequeue after close")
+		}
 
-	delete(r.hashes, value.Key)
+		// items returned by a lease are at the head of the queue
+		r.leases.expire(time.Now())
+		if item := r.leases.take(); item != nil {
+			delete(r.hashes, item.Key)
+			return item.Value, r.leases.save()
+		}
 
-	return value.Value, nil
+		result, err := r.queue.Dequeue()
+		if err == nil {
+			value := result.(*queuedItem)
+			delete(r.hashes, value.Key)
+			return value.Value, nil
+		} else if err != dque.ErrEmpty {
+			return nil, errors.Wrap(err, "failed to dequeue")
+		}
+		r.cond.Wait()
+	}
 }
 
 // Size returns the curent size of the queue.
 func (r *PersistedFIFOQueue) Size() int {
-	return r.queue.Size()
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.count()
+}
+
+// Duplicates returns the number of hashed enqueues that matched an already queued item.
+func (r *PersistedFIFOQueue) Duplicates() uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.duplicates
+}
+
+// count returns the number of items waiting to be dequeued, including any returned by a lease.
+func (r *PersistedFIFOQueue) count() int {
+	return r.queue.Size() + r.leases.released()
 }
 
 // Clear clears the queue
@@ -150,8 +207,12 @@ func (r *PersistedFIFOQueue) Clear() error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	// clear the key map
-	r.hashes = map[int]bool{}
+	// clear the key map, keeping the keys of outstanding leases
+	r.leases.clear()
+	r.hashes = r.leases.keys()
+	if err := r.leases.save(); err != nil {
+		return err
+	}
 
 	count := r.queue.Size()
 	for i := 0; i < count; i++ {
@@ -166,6 +227,11 @@ func (r *PersistedFIFOQueue) Clear() error {
 
 // Close closes the queue, flushes state to disk, and disallows any further operations.
 func (r *PersistedFIFOQueue) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+	r.cond.Broadcast()
 	return errors.Wrap(r.queue.Close(), "failed to close queue")
 }
 
@@ -193,10 +259,116 @@ func (r *PersistedFIFOQueue) GetAll() ([]interface{}, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	queueContents := Contents{Jobs: make([]interface{}, r.queue.Size()), Index: 0}
+	r.leases.expire(time.Now())
+	queueContents := Contents{Jobs: make([]interface{}, r.count()), Index: 0}
+	for _, item := range r.leases.releasedItems() {
+		queueContents.Jobs[queueContents.Index] = item.Value
+		queueContents.Index++
+	}
 	err := r.queue.ApplyToQueue(&queueContents)
 	if err != nil {
 		return nil, err
 	}
 	return queueContents.Jobs, nil
 }
+
+// Reserve leases the item at the head of the queue, hiding it from other consumers until it is
+// acknowledged or `visibilityTimeout` passes.  The item is journaled before it is removed from the
+// underlying queue, so it will be redelivered if the service stops before it is acknowledged.  If
+// the queue is empty a nil lease is returned.
+func (r *PersistedFIFOQueue) Reserve(visibilityTimeout time.Duration) (*Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.New("no reserve after close")
+	}
+
+	now := time.Now()
+	r.leases.expire(now)
+	if lease := r.leases.redeliver(now.Add(visibilityTimeout)); lease != nil {
+		return lease, nil
+	}
+
+	result, err := r.queue.Peek()
+	if err == dque.ErrEmpty {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to reserve")
+	}
+
+	lease := r.leases.add(result.(*queuedItem), now.Add(visibilityTimeout))
+	if err := r.leases.save(); err != nil {
+		return nil, err
+	}
+	if _, err := r.queue.Dequeue(); err != nil {
+		return nil, errors.Wrap(err, "failed to reserve")
+	}
+	return lease, nil
+}
+
+// Ack permanently removes a leased item from the queue.
+func (r *PersistedFIFOQueue) Ack(id uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return errors.New("no ack after close")
+	}
+
+	item, err := r.leases.remove(id)
+	if err != nil || item == nil {
+		return err
+	}
+	delete(r.hashes, item.Key)
+	return r.leases.save()
+}
+
+// Nack returns a leased item to the head of the queue.
+func (r *PersistedFIFOQueue) Nack(id uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return errors.New("no nack after close")
+	}
+
+	if err := r.leases.release(id); err != nil {
+		return err
+	}
+	r.cond.Signal()
+	return nil
+}
+
+// Remove deletes all queued items that satisfy `match`, returning the removed items.  Items that
+// are currently leased are not removed.
+func (r *PersistedFIFOQueue) Remove(match func(x interface{}) bool) ([]interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.New("no remove after close")
+	}
+
+	removed := []interface{}{}
+	releasedItems := r.leases.removeReleased(match)
+	for _, item := range releasedItems {
+		delete(r.hashes, item.Key)
+		removed = append(removed, item.Value)
+	}
+	if len(releasedItems) > 0 {
+		if err := r.leases.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	items, err := removeFromDque(r.queue, match)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		delete(r.hashes, item.Key)
+		removed = append(removed, item.Value)
+	}
+	return removed, nil
+}
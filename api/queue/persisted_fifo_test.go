@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -130,6 +131,8 @@ func TestPersistedListClear(t *testing.T) {
 	t.Cleanup(func() {
 		err := os.RemoveAll(path.Join("test_data", "q4"))
 		assert.NoError(t, err)
+		err = os.Remove(path.Join("test_data", "q4.leases"))
+		assert.NoError(t, err)
 	})
 
 	queue, err := NewPersistedFIFOQueue(3, "test_data", "q4")
@@ -172,6 +175,13 @@ func TestPersistedListLoad(t *testing.T) {
 }
 
 func TestPersistedListClose(t *testing.T) {
+	t.Cleanup(func() {
+		err := os.RemoveAll(path.Join("test_data", "q6"))
+		assert.NoError(t, err)
+		err = os.Remove(path.Join("test_data", "q6.leases"))
+		assert.NoError(t, err)
+	})
+
 	queue, _ := NewPersistedFIFOQueue(3, "test_data", "q6")
 	_, _ = queue.Enqueue(10)
 	_, _ = queue.Enqueue(20)
@@ -194,6 +204,15 @@ func TestPersistedListClose(t *testing.T) {
 
 	_, err = queue.Dequeue()
 	assert.Error(t, err)
+
+	_, err = queue.Reserve(time.Minute)
+	assert.Error(t, err)
+
+	assert.Error(t, queue.Ack(1))
+	assert.Error(t, queue.Nack(1))
+
+	_, err = queue.Remove(func(x interface{}) bool { return true })
+	assert.Error(t, err)
 }
 
 type testObject struct {
@@ -222,3 +241,144 @@ func TestPersistedInterfaceEnqueue(t *testing.T) {
 	count := queue.Size()
 	assert.Equal(t, 2, count)
 }
+
+func TestPersistedReserveReload(t *testing.T) {
+	t.Cleanup(func() {
+		err := os.RemoveAll(path.Join("test_data", "q7"))
+		assert.NoError(t, err)
+		err = os.Remove(path.Join("test_data", "q7.leases"))
+		assert.NoError(t, err)
+	})
+
+	queue, err := NewPersistedFIFOQueue(3, "test_data", "q7")
+	assert.NoError(t, err)
+	_, _ = queue.EnqueueHashed(1, 10)
+	_, _ = queue.EnqueueHashed(2, 20)
+	_, _ = queue.EnqueueHashed(3, 30)
+
+	acked, err := queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, acked.Value.(int))
+	err = queue.Ack(acked.ID)
+	assert.NoError(t, err)
+
+	// simulate a stop part way through a submission
+	lease, err := queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, lease.Value.(int))
+	assert.Equal(t, 1, queue.Size())
+	queue.Close()
+
+	queue, err = NewPersistedFIFOQueue(3, "test_data", "q7")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queue.Size())
+
+	// the unacknowledged item is still considered a duplicate
+	result, err := queue.EnqueueHashed(2, 20)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 2, queue.Size())
+
+	// and is returned to the head of the queue
+	lease, err = queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, lease.Value.(int))
+	err = queue.Nack(lease.ID)
+	assert.NoError(t, err)
+
+	dequeueResult, err := queue.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, dequeueResult.(int))
+	dequeueResult, err = queue.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, 30, dequeueResult.(int))
+	queue.Close()
+}
+
+func TestPersistedRemove(t *testing.T) {
+	t.Cleanup(func() {
+		err := os.RemoveAll(path.Join("test_data", "q8"))
+		assert.NoError(t, err)
+		err = os.Remove(path.Join("test_data", "q8.leases"))
+		assert.NoError(t, err)
+	})
+
+	queue, err := NewPersistedFIFOQueue(5, "test_data", "q8")
+	assert.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		_, _ = queue.EnqueueHashed(i, i*10)
+	}
+	lease, _ := queue.Reserve(time.Minute)
+	_ = queue.Nack(lease.ID)
+
+	removed, err := queue.Remove(func(x interface{}) bool { return x.(int) == 10 || x.(int) == 30 })
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []interface{}{10, 30}, removed)
+
+	removed, err = queue.Remove(func(x interface{}) bool { return x.(int) == 30 })
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+
+	// order is preserved, and the removal is persisted
+	queue.Close()
+	queue, err = NewPersistedFIFOQueue(5, "test_data", "q8")
+	assert.NoError(t, err)
+	contents, err := queue.GetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{20, 40, 50}, contents)
+
+	result, err := queue.EnqueueHashed(3, 30)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 4, queue.Size())
+	queue.Close()
+}
+
+func TestPersistedLeaseWakesDequeue(t *testing.T) {
+	t.Cleanup(func() {
+		err := os.RemoveAll(path.Join("test_data", "q9"))
+		assert.NoError(t, err)
+		err = os.Remove(path.Join("test_data", "q9.leases"))
+		assert.NoError(t, err)
+	})
+
+	queue, err := NewPersistedFIFOQueue(3, "test_data", "q9")
+	assert.NoError(t, err)
+	dequeued := make(chan interface{})
+	dequeue := func() {
+		value, err := queue.Dequeue()
+		assert.NoError(t, err)
+		dequeued <- value
+	}
+
+	// a nack wakes a blocked dequeue
+	_, _ = queue.EnqueueHashed(1, 10)
+	lease, err := queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	go dequeue()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, queue.Nack(lease.ID))
+	assert.Equal(t, 10, <-dequeued)
+
+	// so does a lease expiring
+	_, _ = queue.EnqueueHashed(2, 20)
+	_, err = queue.Reserve(100 * time.Millisecond)
+	assert.NoError(t, err)
+	go dequeue()
+	assert.Equal(t, 20, <-dequeued)
+
+	// an ack after the lease expires removes the released copy, and acking again is a no-op
+	_, _ = queue.EnqueueHashed(3, 30)
+	lease, err = queue.Reserve(time.Millisecond)
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, queue.Ack(lease.ID))
+	assert.NoError(t, queue.Ack(lease.ID))
+	assert.Equal(t, 0, queue.Size())
+	result, err := queue.EnqueueHashed(3, 30)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 1, queue.Size())
+	assert.Error(t, queue.Ack(1000))
+	queue.Close()
+}
@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"sort"
+	"strconv"
+)
+
+// PriorityFunc returns the priority of an item being enqueued.  Items with a higher priority
+// are dequeued first.
+type PriorityFunc func(x interface{}) int
+
+// priorityPolicy services the partition with the highest priority first.  Partition keys are
+// the string representation of the priority.
+type priorityPolicy struct {
+	priorityOf PriorityFunc
+	keys       []string
+}
+
+func (p *priorityPolicy) key(x interface{}) string {
+	return strconv.Itoa(p.priorityOf(x))
+}
+
+func (p *priorityPolicy) add(key string) {
+	p.keys = append(p.keys, key)
+	// keep keys sorted from highest to lowest priority
+	sort.Slice(p.keys, func(i, j int) bool {
+		left, _ := strconv.Atoi(p.keys[i])
+		right, _ := strconv.Atoi(p.keys[j])
+		return left > right
+	})
+}
+
+func (p *priorityPolicy) remove(key string) {
+	for i, k := range p.keys {
+		if k == key {
+			p.keys = append(p.keys[:i], p.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *priorityPolicy) order() []string {
+	return p.keys
+}
+
+func (p *priorityPolicy) served(key string) {}
+
+func (p *priorityPolicy) clone() partitionPolicy {
+	return &priorityPolicy{priorityOf: p.priorityOf, keys: append([]string{}, p.keys...)}
+}
+
+// NewListPriorityQueue creates a new in-memory priority queue that is immediately ready to
+// receive enqueue requests.  Items with the highest priority are dequeued first, and items that
+// share a priority are dequeued in FIFO order.  The size of the queue is limited by the `size`
+// parameter, and the priority of each item is determined by the `priorityOf` function.
+func NewListPriorityQueue(size int, priorityOf PriorityFunc) RequestQueue {
+	return newPartitionedQueue(size, &priorityPolicy{priorityOf: priorityOf}, newListPartition, newLeaseTable())
+}
+
+// NewPersistedPriorityQueue creates a new priority queue that persists its contents to disk.  Each
+// priority level is stored as a separate dque prefixed with `<queueName>.priority.` in `queueDir`,
+// and any existing levels are reloaded.  The size of the queue is limited by the `size` parameter,
+// and the priority of each item is determined by the `priorityOf` function.
+func NewPersistedPriorityQueue(size int, queueDir string, queueName string, priorityOf PriorityFunc) (RequestQueue, error) {
+	return newPersistedPartitionedQueue(size, queueDir, queueName+".priority.", &priorityPolicy{priorityOf: priorityOf})
+}
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPriority uses the hundreds digit of an int value as its priority
+func testPriority(x interface{}) int {
+	return x.(int) / 100
+}
+
+func TestListPriorityEnqueueDequeue(t *testing.T) {
+	queue := NewListPriorityQueue(5, testPriority)
+
+	for _, value := range []int{10, 20, 110, 30, 120} {
+		result, err := queue.Enqueue(value)
+		assert.NoError(t, err)
+		assert.True(t, result)
+	}
+	result, err := queue.Enqueue(40)
+	assert.NoError(t, err)
+	assert.False(t, result)
+
+	contents, err := queue.GetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{110, 120, 10, 20, 30}, contents)
+
+	// higher priority first, FIFO within a priority
+	for _, expected := range []int{110, 120, 10, 20, 30} {
+		dequeueResult, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dequeueResult.(int))
+	}
+	assert.Equal(t, 0, queue.Size())
+}
+
+func TestListPriorityHashedEnqueueDequeue(t *testing.T) {
+	queue := NewListPriorityQueue(3, testPriority)
+
+	// ensure request with identical keys are only added once, regardless of priority
+	result, err := queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	result, err = queue.EnqueueHashed(1, 110)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 1, queue.Size())
+
+	result, err = queue.EnqueueHashed(2, 120)
+	assert.NoError(t, err)
+	assert.True(t, result)
+
+	dequeueResult, err := queue.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, 120, dequeueResult.(int))
+
+	// ensure that dequeing requests will allow a follow on request
+	// with the same key to be added
+	result, err = queue.EnqueueHashed(2, 120)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 2, queue.Size())
+}
+
+func TestListPriorityClose(t *testing.T) {
+	queue := NewListPriorityQueue(2, testPriority)
+	_, _ = queue.Enqueue(10)
+
+	err := queue.Close()
+	assert.NoError(t, err)
+
+	err = queue.Close()
+	assert.Error(t, err)
+
+	err = queue.Clear()
+	assert.Error(t, err)
+
+	_, err = queue.Enqueue(10)
+	assert.Error(t, err)
+
+	_, err = queue.EnqueueHashed(10, 100)
+	assert.Error(t, err)
+
+	_, err = queue.Dequeue()
+	assert.Error(t, err)
+}
+
+func TestPersistedPriorityLoad(t *testing.T) {
+	dir := path.Join("test_data", "pq1")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	queue, err := NewPersistedPriorityQueue(4, dir, "pq", testPriority)
+	assert.NoError(t, err)
+	_, _ = queue.EnqueueHashed(1, 10)
+	_, _ = queue.EnqueueHashed(2, 210)
+	_, _ = queue.EnqueueHashed(3, 20)
+	_, _ = queue.EnqueueHashed(4, 220)
+	err = queue.Close()
+	assert.NoError(t, err)
+
+	queue, err = NewPersistedPriorityQueue(4, dir, "pq", testPriority)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, queue.Size())
+
+	// keys are restored
+	result, err := queue.EnqueueHashed(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, result)
+	assert.Equal(t, 4, queue.Size())
+
+	for _, expected := range []int{210, 220, 10, 20} {
+		dequeueResult, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dequeueResult.(int))
+	}
+
+	err = queue.Clear()
+	assert.NoError(t, err)
+	err = queue.Close()
+	assert.NoError(t, err)
+}
+
+func TestPersistedPriorityReserveReload(t *testing.T) {
+	dir := path.Join("test_data", "pq2")
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+
+	queue, err := NewPersistedPriorityQueue(4, dir, "pq", testPriority)
+	assert.NoError(t, err)
+	_, _ = queue.EnqueueHashed(1, 10)
+	_, _ = queue.EnqueueHashed(2, 110)
+
+	lease, err := queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 110, lease.Value.(int))
+	assert.Equal(t, 1, queue.Size())
+	err = queue.Close()
+	assert.NoError(t, err)
+
+	queue, err = NewPersistedPriorityQueue(4, dir, "pq", testPriority)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queue.Size())
+
+	// the unacknowledged item is returned to the head of the queue
+	_, _ = queue.EnqueueHashed(3, 120)
+	contents, err := queue.GetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{110, 120, 10}, contents)
+
+	lease, err = queue.Reserve(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 110, lease.Value.(int))
+	err = queue.Ack(lease.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queue.Size())
+
+	err = queue.Close()
+	assert.NoError(t, err)
+}
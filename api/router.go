@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/render"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/metrics"
 	api_middleware "gitlab.uncharted.software/WM/wm-request-queue/api/middleware"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
@@ -15,12 +16,21 @@ import (
 )
 
 // NewRouter returns a chi router with endpoints registered.
-func NewRouter(cfg config.Config, queue queue.RequestQueue, runner *pipeline.DataPipelineRunner) (chi.Router, error) {
+func NewRouter(cfg config.Config, queue queue.RequestQueue, runner *pipeline.DataPipelineRunner, deadLetters *pipeline.DeadLetterStore, outbox *pipeline.Outbox, jobs *pipeline.JobStore, history *pipeline.HistoryStore, notifier pipeline.Notifier, serviceMetrics *metrics.Metrics, healthChecks []pipeline.HealthCheck, scheduler *pipeline.Scheduler) (chi.Router, error) {
+
+	// Setup authentication of the data pipeline routes
+	auth, err := api_middleware.NewAuthenticator(cfg.Environment)
+	if err != nil {
+		return nil, err
+	}
+	if !auth.Enabled() {
+		cfg.Logger.Warn("No API credentials are configured, the data pipeline routes are open to everyone")
+	}
 
 	// Setup the router and configure baseline middleware
 	r := chi.NewRouter()
 
-	r.Use(api_middleware.Logger(cfg.Logger))
+	r.Use(api_middleware.Logger(cfg.Logger, serviceMetrics))
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Recoverer)
@@ -35,17 +45,50 @@ func NewRouter(cfg config.Config, queue queue.RequestQueue, runner *pipeline.Dat
 	})
 	r.Use(c.Handler)
 
+	// Metrics and health checks are left open for scrapers and probes
+	r.Method("GET", "/metrics", serviceMetrics.Handler())
+	r.Get("/healthz", routes.HealthzRequest(&cfg))
+	r.Get("/readyz", routes.ReadyzRequest(&cfg, healthChecks))
+
 	r.Route("/data-pipeline", func(r chi.Router) {
 		r.Use(render.SetContentType(render.ContentTypeJSON))
-		r.Put("/enqueue", routes.EnqueueRequest(&cfg, queue)) // PUT instead of POST due to idempotency
-		r.Put("/bulk-enqueue", routes.BulkEnqueueRequest(&cfg, queue))
-		r.Get("/status", routes.StatusRequest(&cfg, queue, runner))
-		r.Put("/start", routes.StartRequest(&cfg, runner))
-		r.Put("/stop", routes.StopRequest(&cfg, runner))
-		r.Put("/clear", routes.ClearRequest(&cfg, queue))
-		r.Put("/force-flow", routes.ForceDispatchRequest(&cfg, queue, runner))
-		r.Get("/jobs", routes.JobsRequest(&cfg, queue))
-		r.Put("/retry-flow/{run_id}", routes.RetryFlowRequest(&cfg, queue, runner))
+
+		// Submitters can queue requests and follow their progress
+		r.Group(func(r chi.Router) {
+			r.Use(auth.Require(api_middleware.RoleSubmitter))
+			r.Put("/enqueue", routes.EnqueueRequest(&cfg, queue, notifier, runner, history, scheduler)) // PUT instead of POST due to idempotency
+			r.Put("/bulk-enqueue", routes.BulkEnqueueRequest(&cfg, queue, notifier))
+			r.Get("/status", routes.StatusRequest(&cfg, queue, runner, scheduler))
+			r.Get("/jobs", routes.JobsRequest(&cfg, queue, runner, history, scheduler))
+			r.Get("/jobs/{run_id}", routes.JobRequest(&cfg, jobs))
+		})
+
+		// Operators can also control the runner and manage the queue
+		r.Group(func(r chi.Router) {
+			r.Use(auth.Require(api_middleware.RoleOperator))
+			r.Put("/start", routes.StartRequest(&cfg, runner))
+			r.Put("/stop", routes.StopRequest(&cfg, runner, scheduler))
+			r.Put("/clear", routes.ClearRequest(&cfg, runner))
+			r.Get("/schedule", routes.ScheduleRequest(&cfg, scheduler))
+			r.Put("/schedule", routes.UpdateScheduleRequest(&cfg, scheduler))
+			r.Put("/force-flow", routes.ForceDispatchRequest(&cfg, queue, runner))
+			r.Delete("/jobs/{run_id}", routes.CancelJobRequest(&cfg, runner))
+			r.Put("/retry-flow/{run_id}", routes.RetryFlowRequest(&cfg, queue, runner, notifier))
+			r.Put("/reconcile", routes.ReconcileRequest(&cfg, runner))
+			r.Get("/history", routes.HistoryRequest(&cfg, history))
+			r.Get("/stats", routes.StatsRequest(&cfg, history))
+			r.Route("/dead-letter", func(r chi.Router) {
+				r.Get("/", routes.DeadLetterListRequest(&cfg, deadLetters))
+				r.Delete("/", routes.DeadLetterPurgeRequest(&cfg, deadLetters))
+				r.Get("/{run_id}", routes.DeadLetterGetRequest(&cfg, deadLetters))
+				r.Delete("/{run_id}", routes.DeadLetterDeleteRequest(&cfg, deadLetters))
+				r.Put("/{run_id}/requeue", routes.DeadLetterRequeueRequest(&cfg, queue, deadLetters, notifier))
+			})
+			r.Route("/outbox", func(r chi.Router) {
+				r.Get("/", routes.OutboxListRequest(&cfg, outbox))
+				r.Put("/{id}/retry", routes.OutboxRetryRequest(&cfg, outbox))
+			})
+		})
 	})
 
 	return r, nil
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/metrics"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+	"go.uber.org/zap"
+)
+
+func TestRouterAuth(t *testing.T) {
+	dir := path.Join("test_data", "router1")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	t.Cleanup(func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	})
+	usersFile := path.Join(dir, "users.json")
+	assert.NoError(t, os.WriteFile(usersFile, []byte(`{"submitters": {"causemos": "submit:pass"}, "operators": {"admin": "operate,pass"}}`), 0644))
+
+	env := &config.Environment{
+		DataPipelineQueueDir:     dir,
+		DataPipelineFlowsName:    "flows",
+		DataPipelineRetriesName:  "retries",
+		DataPipelineOutboxName:   "outbox",
+		DataPipelineJobsName:     "jobs",
+		DataPipelineHistoryName:  "history",
+		DataPipelineScheduleName: "schedule",
+		DataPipelineLocalCommand: "true",
+		DataPipelineLocalInput:   config.LocalInputStdin,
+		AuthSubmitterTokens:      []string{"submit-token"},
+		AuthOperatorTokens:       []string{"operate-token"},
+		AuthUsersFile:            usersFile,
+	}
+	cfg := config.Config{Logger: zap.NewNop().Sugar(), Environment: env}
+
+	requestQueue := queue.NewListFIFOQueue(5)
+	deadLetters, err := pipeline.NewDeadLetterStore(dir, "dead_letter", 3)
+	assert.NoError(t, err)
+	outbox, err := pipeline.NewOutbox(env)
+	assert.NoError(t, err)
+	jobs, err := pipeline.NewJobStore(&cfg)
+	assert.NoError(t, err)
+	history, err := pipeline.NewHistoryStore(&cfg)
+	assert.NoError(t, err)
+	executor, err := pipeline.NewLocalExecutor(env)
+	assert.NoError(t, err)
+	notifier := pipeline.Notifiers{jobs, history}
+	runner, err := pipeline.NewDataPipelineRunner(&cfg, requestQueue, deadLetters, jobs, notifier, executor)
+	assert.NoError(t, err)
+	scheduler, err := pipeline.NewScheduler(&cfg, runner.Running, runner.Stop, runner.Start)
+	assert.NoError(t, err)
+	defer scheduler.Close()
+
+	r, err := NewRouter(cfg, requestQueue, runner, deadLetters, outbox, jobs, history, notifier, metrics.NewMetrics(), []pipeline.HealthCheck{}, scheduler)
+	assert.NoError(t, err)
+
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(user string, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	none := func(r *http.Request) {}
+
+	tests := []struct {
+		name   string
+		route  string
+		setup  func(r *http.Request)
+		status int
+	}{
+		// metrics and health checks are open to everyone
+		{"metrics", "/metrics", none, http.StatusOK},
+		{"healthz", "/healthz", none, http.StatusOK},
+		{"readyz", "/readyz", none, http.StatusOK},
+		{"readyz with bad credentials", "/readyz", bearer("wrong"), http.StatusOK},
+
+		// submitter routes need submitter or operator credentials
+		{"status without credentials", "/data-pipeline/status", none, http.StatusUnauthorized},
+		{"status with a bad token", "/data-pipeline/status", bearer("wrong"), http.StatusUnauthorized},
+		{"status with a bad password", "/data-pipeline/status", basic("causemos", "submit"), http.StatusUnauthorized},
+		{"status as a submitter", "/data-pipeline/status", bearer("submit-token"), http.StatusOK},
+		{"jobs as a submitter", "/data-pipeline/jobs", basic("causemos", "submit:pass"), http.StatusOK},
+		{"jobs as an operator", "/data-pipeline/jobs", basic("admin", "operate,pass"), http.StatusOK},
+
+		// operator routes need operator credentials
+		{"schedule without credentials", "/data-pipeline/schedule", none, http.StatusUnauthorized},
+		{"schedule as a submitter", "/data-pipeline/schedule", bearer("submit-token"), http.StatusForbidden},
+		{"history as a submitter", "/data-pipeline/history", basic("causemos", "submit:pass"), http.StatusForbidden},
+		{"schedule as an operator", "/data-pipeline/schedule", bearer("operate-token"), http.StatusOK},
+		{"history as an operator", "/data-pipeline/history", basic("admin", "operate,pass"), http.StatusOK},
+		{"dead letters as an operator", "/data-pipeline/dead-letter/", bearer("operate-token"), http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, test.route, nil)
+		test.setup(request)
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, request)
+		assert.Equal(t, test.status, recorder.Code, test.name)
+	}
+}
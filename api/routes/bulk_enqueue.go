@@ -14,7 +14,7 @@ import (
 
 // BulkEnqueueRequest adds a list of requests to the queue if there is space, or returns an error if
 // the queue is currently at maximum capacity. Will add until reaching capacity.
-func BulkEnqueueRequest(cfg *config.Config, requestQueue queue.RequestQueue) func(http.ResponseWriter, *http.Request) {
+func BulkEnqueueRequest(cfg *config.Config, requestQueue queue.RequestQueue, notifier pipeline.Notifier) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Read the body into a byte array
 		body, err := ioutil.ReadAll(r.Body)
@@ -52,9 +52,10 @@ func BulkEnqueueRequest(cfg *config.Config, requestQueue queue.RequestQueue) fun
 			err = helpers.CheckEnqueueParams(enqueueMsg)
 			if err != nil {
 				handleErrorType(w, err, http.StatusBadRequest, cfg.Logger)
+				return
 			}
 
-			result, err := helpers.AddToQueue(enqueueMsg, *cfg, requestQueue, make([]string, 0))
+			result, err := helpers.AddToQueue(enqueueMsg, *cfg, requestQueue, notifier, make([]string, 0))
 			if err != nil {
 				handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
 				return
@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// CancelJobRequest removes a job from the queue given its run_id, or cancels its flow run in prefect
+// if it has already been submitted.
+func CancelJobRequest(cfg *config.Config, runner *pipeline.DataPipelineRunner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := chi.URLParam(r, "run_id")
+		result, err := runner.Cancel(runID)
+		if err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+			return
+		}
+		if !result.Found() {
+			handleErrorType(w, errors.Errorf("run %s not found", runID), http.StatusNotFound, cfg.Logger)
+			return
+		}
+		if err := handleJSON(w, result); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
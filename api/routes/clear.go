@@ -3,13 +3,16 @@ package routes
 import (
 	"net/http"
 
-	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
 	"gitlab.uncharted.software/WM/wm-request-queue/config"
 )
 
-// ClearRequest clears the request queue.
-func ClearRequest(cfg *config.Config, requestQueue queue.RequestQueue) func(http.ResponseWriter, *http.Request) {
+// ClearRequest clears the request queue and pending retries, cancelling the jobs that were in them
+// and discarding their failure histories.
+func ClearRequest(cfg *config.Config, runner *pipeline.DataPipelineRunner) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		requestQueue.Clear()
+		if _, err := runner.Clear(); err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+		}
 	}
 }
@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/helpers"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// DeadLetterResponse describes a request that has been moved to the dead letter store.
+type DeadLetterResponse struct {
+	RunID          string                   `json:"run_id"`
+	ModelID        string                   `json:"model_id"`
+	Request        map[string]interface{}   `json:"request"`
+	Labels         []string                 `json:"labels"`
+	Failures       []pipeline.FailureRecord `json:"failures"`
+	DeadLetteredAt time.Time                `json:"dead_lettered_at"`
+}
+
+func newDeadLetterResponse(entry pipeline.DeadLetterEntry) (DeadLetterResponse, error) {
+	response := DeadLetterResponse{
+		RunID:          entry.Request.RunID,
+		ModelID:        entry.Request.ModelID,
+		Labels:         entry.Labels,
+		Failures:       entry.Failures,
+		DeadLetteredAt: entry.DeadLetteredAt,
+	}
+	err := json.Unmarshal(entry.Request.RequestData, &response.Request)
+	return response, err
+}
+
+// DeadLetterListRequest returns the requests in the dead letter store.
+func DeadLetterListRequest(cfg *config.Config, deadLetters *pipeline.DeadLetterStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries := deadLetters.List()
+		responses := make([]DeadLetterResponse, len(entries))
+		for i, entry := range entries {
+			response, err := newDeadLetterResponse(entry)
+			if err != nil {
+				handleErrorType(w, errors.Wrap(err, "failed to unmarshal response"), http.StatusInternalServerError, cfg.Logger)
+				return
+			}
+			responses[i] = response
+		}
+		if err := handleJSON(w, responses); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
+
+// DeadLetterGetRequest returns a single request from the dead letter store given its run_id.
+func DeadLetterGetRequest(cfg *config.Config, deadLetters *pipeline.DeadLetterStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := chi.URLParam(r, "run_id")
+		entry, ok := deadLetters.Get(runID)
+		if !ok {
+			handleErrorType(w, errors.Errorf("run %s not found in dead letter store", runID), http.StatusNotFound, cfg.Logger)
+			return
+		}
+		response, err := newDeadLetterResponse(entry)
+		if err != nil {
+			handleErrorType(w, errors.Wrap(err, "failed to unmarshal response"), http.StatusInternalServerError, cfg.Logger)
+			return
+		}
+		if err := handleJSON(w, response); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
+
+// DeadLetterRequeueRequest moves a request from the dead letter store back onto the request queue,
+// with its failure history reset.
+func DeadLetterRequeueRequest(cfg *config.Config, requestQueue queue.RequestQueue, deadLetters *pipeline.DeadLetterStore, notifier pipeline.Notifier) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := chi.URLParam(r, "run_id")
+		entry, ok := deadLetters.Get(runID)
+		if !ok {
+			handleErrorType(w, errors.Errorf("run %s not found in dead letter store", runID), http.StatusNotFound, cfg.Logger)
+			return
+		}
+
+		// the requeued run gets its own idempotency key, so that prefect doesn't skip it as a
+		// repeat of the run that failed
+		request := entry.Request
+		request.Requeues++
+		result, err := helpers.AddToQueue(request, *cfg, requestQueue, notifier, entry.Labels)
+		if err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+			return
+		} else if !result {
+			handleErrorType(w, err, http.StatusServiceUnavailable, cfg.Logger)
+			return
+		}
+
+		if _, err := deadLetters.Remove(runID); err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
+
+// DeadLetterDeleteRequest removes a single request from the dead letter store given its run_id.
+func DeadLetterDeleteRequest(cfg *config.Config, deadLetters *pipeline.DeadLetterStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := chi.URLParam(r, "run_id")
+		found, err := deadLetters.Remove(runID)
+		if err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+			return
+		}
+		if !found {
+			handleErrorType(w, errors.Errorf("run %s not found in dead letter store", runID), http.StatusNotFound, cfg.Logger)
+		}
+	}
+}
+
+// DeadLetterPurgeRequest removes all requests from the dead letter store.
+func DeadLetterPurgeRequest(cfg *config.Config, deadLetters *pipeline.DeadLetterStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := deadLetters.Purge(); err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
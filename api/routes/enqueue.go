@@ -13,8 +13,9 @@ import (
 )
 
 // EnqueueRequest adds a request to the queue if there is space, or returns an error if
-// the queue is currently at maximum capacity.
-func EnqueueRequest(cfg *config.Config, requestQueue queue.RequestQueue) func(http.ResponseWriter, *http.Request) {
+// the queue is currently at maximum capacity.  Accepted requests are told their position in the
+// queue and estimated dispatch time.
+func EnqueueRequest(cfg *config.Config, requestQueue queue.RequestQueue, notifier pipeline.Notifier, runner *pipeline.DataPipelineRunner, history *pipeline.HistoryStore, scheduler *pipeline.Scheduler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var enqueueMsg pipeline.EnqueueRequestData
 
@@ -39,9 +40,10 @@ func EnqueueRequest(cfg *config.Config, requestQueue queue.RequestQueue) func(ht
 		err = helpers.CheckEnqueueParams(enqueueMsg)
 		if err != nil {
 			handleErrorType(w, err, http.StatusBadRequest, cfg.Logger)
+			return
 		}
 
-		result, err := helpers.AddToQueue(enqueueMsg, *cfg, requestQueue, make([]string, 0))
+		result, err := helpers.AddToQueue(enqueueMsg, *cfg, requestQueue, notifier, make([]string, 0))
 		if err != nil {
 			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
 			return
@@ -49,5 +51,23 @@ func EnqueueRequest(cfg *config.Config, requestQueue queue.RequestQueue) func(ht
 			handleErrorType(w, err, http.StatusServiceUnavailable, cfg.Logger)
 			return
 		}
+
+		queueContents, err := queue.ListOrdered(requestQueue)
+		if err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+			return
+		}
+		// the job may already have been dispatched, in which case it has no position
+		response := DispatchEstimate{RunID: enqueueMsg.RunID}
+		for i := len(queueContents) - 1; i >= 0; i-- {
+			if request, ok := queueContents[i].(pipeline.KeyedEnqueueRequestData); ok && request.RunID == enqueueMsg.RunID {
+				response.QueuePosition = i + 1
+				response.EstimatedDispatchTime = estimateDispatchTimes(cfg, runner, history, scheduler, i+1)[i]
+				break
+			}
+		}
+		if err := handleJSON(w, response); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
 	}
 }
@@ -0,0 +1,38 @@
+package routes
+
+import (
+	"time"
+
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// DispatchEstimate describes where a job is in the queue, and when it is expected to be
+// dispatched.  The estimate is empty while the runner is stopped, unless it is paused for a
+// maintenance window, or if the job can't be dispatched before the maintenance schedule runs out.
+type DispatchEstimate struct {
+	RunID                 string     `json:"run_id"`
+	QueuePosition         int        `json:"queue_position"`
+	EstimatedDispatchTime *time.Time `json:"estimated_dispatch_time"`
+}
+
+// estimateDispatchTimes estimates when each of the first `queued` jobs in the queue will be
+// dispatched, from the typical duration of recent flow runs, the flows that are running now and
+// the maintenance windows that hold up dispatching.
+func estimateDispatchTimes(cfg *config.Config, runner *pipeline.DataPipelineRunner, history *pipeline.HistoryStore, scheduler *pipeline.Scheduler, queued int) []*time.Time {
+	estimates := make([]*time.Time, queued)
+	now := time.Now()
+	// a runner paused for maintenance resumes when the window ends
+	if !runner.Running() && !scheduler.Paused() {
+		return estimates
+	}
+	runDuration, ok := history.TypicalRunDuration()
+	if !ok {
+		runDuration = time.Duration(cfg.Environment.DataPipelineDefaultRunDurationSec) * time.Second
+	}
+	times := pipeline.EstimateDispatchTimes(now, queued, runner.FlowStartTimes(), cfg.Environment.DataPipelineParallelism, runDuration, scheduler.ResumeAt)
+	for i := range times {
+		estimates[i] = &times[i]
+	}
+	return estimates
+}
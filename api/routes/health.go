@@ -0,0 +1,54 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// Health statuses.
+const (
+	healthOK      = "ok"
+	healthUnready = "unready"
+)
+
+// HealthResponse reports whether the service is healthy, and the result of each dependency
+// check for readiness.
+type HealthResponse struct {
+	Status string                  `json:"status"`
+	Checks []pipeline.HealthResult `json:"checks,omitempty"`
+}
+
+// HealthzRequest creates a liveness handler, which succeeds whenever the service can respond.
+// Dependencies aren't checked, so that an outage elsewhere doesn't get the service restarted.
+func HealthzRequest(cfg *config.Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := handleJSON(w, HealthResponse{Status: healthOK}); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
+
+// ReadyzRequest creates a readiness handler that runs the dependency checks, responding with 503
+// if any critical dependency is unavailable.
+func ReadyzRequest(cfg *config.Config, checks []pipeline.HealthCheck) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, ready := pipeline.RunHealthChecks(checks)
+		response := HealthResponse{Status: healthOK, Checks: results}
+		code := http.StatusOK
+		if !ready {
+			response.Status = healthUnready
+			code = http.StatusServiceUnavailable
+			for _, result := range results {
+				if !result.Healthy {
+					cfg.Logger.Warnf("Readiness check %s failed: %s", result.Name, result.Error)
+				}
+			}
+		}
+		if err := handleJSONStatus(w, code, response); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
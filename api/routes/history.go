@@ -0,0 +1,39 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// HistoryRequest returns the finished jobs in the history, optionally filtered by the `model_id`
+// and final `state` query parameters, and by the time they finished with the RFC3339 `from` and
+// `to` query parameters.
+func HistoryRequest(cfg *config.Config, history *pipeline.HistoryStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := pipeline.HistoryFilter{
+			ModelID: query.Get("model_id"),
+			State:   query.Get("state"),
+		}
+		var err error
+		if from := query.Get("from"); from != "" {
+			if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+				handleErrorType(w, errors.Wrap(err, "invalid from time"), http.StatusBadRequest, cfg.Logger)
+				return
+			}
+		}
+		if to := query.Get("to"); to != "" {
+			if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+				handleErrorType(w, errors.Wrap(err, "invalid to time"), http.StatusBadRequest, cfg.Logger)
+				return
+			}
+		}
+		if err := handleJSON(w, history.List(filter)); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
@@ -4,34 +4,59 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
 	"gitlab.uncharted.software/WM/wm-request-queue/config"
 )
 
-// JobsRequest returns the contents in the queue.
-func JobsRequest(cfg *config.Config, queue queue.RequestQueue) func(http.ResponseWriter, *http.Request) {
+// JobsRequest returns the contents in the queue in the order they will be dispatched, with each
+// job's position in the queue and its estimated dispatch time.
+func JobsRequest(cfg *config.Config, requestQueue queue.RequestQueue, runner *pipeline.DataPipelineRunner, history *pipeline.HistoryStore, scheduler *pipeline.Scheduler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		queueContents, err := queue.GetAll()
+		queueContents, err := queue.ListOrdered(requestQueue)
 		if err != nil {
 			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
 			return
 		}
+		estimates := estimateDispatchTimes(cfg, runner, history, scheduler, len(queueContents))
 		jobData := make([]map[string]interface{}, len(queueContents))
 		for i := 0; i < len(queueContents); i++ {
 			request, ok := queueContents[i].(pipeline.KeyedEnqueueRequestData)
 			if !ok {
 				handleErrorType(w, errors.New("failed to generate response, unexpected datatype found"), http.StatusBadRequest, cfg.Logger)
+				return
 			}
 
 			err = json.Unmarshal(request.EnqueueRequestData.RequestData, &jobData[i])
 			if err != nil {
 				handleErrorType(w, errors.New("failed to unmarshal response"), http.StatusInternalServerError, cfg.Logger)
+				return
 			}
+			if jobData[i] == nil {
+				jobData[i] = map[string]interface{}{}
+			}
+			jobData[i]["queue_position"] = i + 1
+			jobData[i]["estimated_dispatch_time"] = estimates[i]
 		}
 		if err := handleJSON(w, jobData); err != nil {
 			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
 		}
 	}
 }
+
+// JobRequest returns the current state of a job and its transition history, given its run_id.
+func JobRequest(cfg *config.Config, jobs *pipeline.JobStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := chi.URLParam(r, "run_id")
+		job, ok := jobs.Get(runID)
+		if !ok {
+			handleErrorType(w, errors.Errorf("run %s not found", runID), http.StatusNotFound, cfg.Logger)
+			return
+		}
+		if err := handleJSON(w, job); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// OutboxResponse lists the notifications that are still waiting to be delivered, and
+// those that have used all of their delivery attempts.
+type OutboxResponse struct {
+	Pending []pipeline.OutboxEntry `json:"pending"`
+	Failed  []pipeline.OutboxEntry `json:"failed"`
+}
+
+// OutboxListRequest returns the contents of the notification outbox.
+func OutboxListRequest(cfg *config.Config, outbox *pipeline.Outbox) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := OutboxResponse{
+			Pending: []pipeline.OutboxEntry{},
+			Failed:  []pipeline.OutboxEntry{},
+		}
+		for _, entry := range outbox.List() {
+			if entry.Failed {
+				response.Failed = append(response.Failed, entry)
+			} else {
+				response.Pending = append(response.Pending, entry)
+			}
+		}
+		if err := handleJSON(w, response); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
+
+// OutboxRetryRequest returns a failed notification to the outbox to be delivered again, given
+// its id.
+func OutboxRetryRequest(cfg *config.Config, outbox *pipeline.Outbox) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			handleErrorType(w, errors.Wrap(err, "invalid outbox id"), http.StatusBadRequest, cfg.Logger)
+			return
+		}
+		found, err := outbox.Retry(id)
+		if err != nil {
+			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
+			return
+		}
+		if !found {
+			handleErrorType(w, errors.Errorf("failed notification %d not found in outbox", id), http.StatusNotFound, cfg.Logger)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// ReconcileRequest matches prefect's active flow runs against the flows being tracked, adopting any
+// that were lost, and returns the flows that were adopted, unknown or duplicated.
+func ReconcileRequest(cfg *config.Config, runner *pipeline.DataPipelineRunner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := runner.Reconcile()
+		if err != nil {
+			handleErrorType(w, err, http.StatusBadGateway, cfg.Logger)
+			return
+		}
+		if err := handleJSON(w, result); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
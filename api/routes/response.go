@@ -8,6 +8,10 @@ import (
 )
 
 func handleJSON(w http.ResponseWriter, data interface{}) error {
+	return handleJSONStatus(w, http.StatusOK, data)
+}
+
+func handleJSONStatus(w http.ResponseWriter, code int, data interface{}) error {
 	// marshal data
 	bytes, err := json.Marshal(data)
 	if err != nil {
@@ -15,6 +19,7 @@ func handleJSON(w http.ResponseWriter, data interface{}) error {
 	}
 	// write response
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 	_, err = w.Write(bytes)
 	if err != nil {
 		return err
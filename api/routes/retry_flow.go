@@ -14,7 +14,7 @@ import (
 )
 
 // RetryFlowRequest resubmits a flow given it's run_id in prefect
-func RetryFlowRequest(cfg *config.Config, requestQueue queue.RequestQueue, runner *pipeline.DataPipelineRunner) func(http.ResponseWriter, *http.Request) {
+func RetryFlowRequest(cfg *config.Config, requestQueue queue.RequestQueue, runner *pipeline.DataPipelineRunner, notifier pipeline.Notifier) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		labelsParam := r.URL.Query().Get("labels")
 		var labels []string
@@ -81,9 +81,10 @@ func RetryFlowRequest(cfg *config.Config, requestQueue queue.RequestQueue, runne
 		err = helpers.CheckEnqueueParams(enqueueMsg)
 		if err != nil {
 			handleErrorType(w, err, http.StatusBadRequest, cfg.Logger)
+			return
 		}
 
-		result, err := helpers.AddToQueue(enqueueMsg, *cfg, requestQueue, labels)
+		result, err := helpers.AddToQueue(enqueueMsg, *cfg, requestQueue, notifier, labels)
 		if err != nil {
 			handleErrorType(w, err, http.StatusInternalServerError, cfg.Logger)
 			return
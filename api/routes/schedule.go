@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// ScheduleResponse provides the maintenance schedule, the window currently in effect if there is
+// one, and when the next window starts or ends.
+type ScheduleResponse struct {
+	pipeline.Schedule
+	Current    *pipeline.ActiveWindow `json:"current"`
+	NextChange *time.Time             `json:"next_change"`
+}
+
+func newScheduleResponse(scheduler *pipeline.Scheduler) ScheduleResponse {
+	now := time.Now()
+	response := ScheduleResponse{Schedule: scheduler.Schedule(), Current: scheduler.Current(now)}
+	if next := scheduler.NextChange(now); !next.IsZero() {
+		response.NextChange = &next
+	}
+	return response
+}
+
+// ScheduleRequest creates a get request handler that returns the maintenance schedule.
+func ScheduleRequest(cfg *config.Config, scheduler *pipeline.Scheduler) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := handleJSON(w, newScheduleResponse(scheduler)); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
+
+// UpdateScheduleRequest creates a put request handler that replaces the maintenance schedule,
+// responding with a 400 if the schedule is invalid.  The runner is paused or resumed straight away
+// if the new schedule calls for it.
+func UpdateScheduleRequest(cfg *config.Config, scheduler *pipeline.Scheduler) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var schedule pipeline.Schedule
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+			handleErrorType(w, errors.Wrap(err, "failed to unmarshal request body"), http.StatusBadRequest, cfg.Logger)
+			return
+		}
+		if err := scheduler.SetSchedule(schedule); err != nil {
+			handleErrorType(w, err, http.StatusBadRequest, cfg.Logger)
+			return
+		}
+		if err := handleJSON(w, newScheduleResponse(scheduler)); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
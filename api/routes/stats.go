@@ -0,0 +1,31 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
+	"gitlab.uncharted.software/WM/wm-request-queue/config"
+)
+
+// StatsResponse summarizes the jobs that finished over each of the configured windows.
+type StatsResponse struct {
+	GeneratedAt time.Time              `json:"generated_at"`
+	Windows     []pipeline.WindowStats `json:"windows"`
+}
+
+// StatsRequest returns throughput, success and failure ratios, and queue wait and flow duration
+// percentiles per model and agent, computed from the job history.
+func StatsRequest(cfg *config.Config, history *pipeline.HistoryStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		response := StatsResponse{
+			GeneratedAt: now,
+			Windows:     pipeline.ComputeStats(history.List(pipeline.HistoryFilter{}), now, cfg.Environment.DataPipelineStatsWindowsHours),
+		}
+		if err := handleJSON(w, response); err != nil {
+			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
+		}
+	}
+}
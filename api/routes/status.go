@@ -2,6 +2,7 @@ package routes
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
@@ -12,21 +13,30 @@ import (
 // StatusResponse provides the number of items currently queued, and whether or not the
 // the pipeline runner routine has been stopped, or is running.
 type StatusResponse struct {
-	Count     int  `json:"count"`
-	IsRunning bool `json:"is_running"`
-	Running   int  `json:"running"`
+	Count     int            `json:"count"`
+	IsRunning bool           `json:"is_running"`
+	Running   int            `json:"running"`
+	Depths    map[string]int `json:"depths,omitempty"`
+	// MaintenanceWindow is the maintenance window or blackout in effect, if there is one.
+	MaintenanceWindow *pipeline.ActiveWindow `json:"maintenance_window"`
 }
 
 // StatusRequest creates a get request handler that will return status info for the request queue and pipeline runner.
-func StatusRequest(cfg *config.Config, queue queue.RequestQueue, runner *pipeline.DataPipelineRunner) func(http.ResponseWriter, *http.Request) {
+func StatusRequest(cfg *config.Config, requestQueue queue.RequestQueue, runner *pipeline.DataPipelineRunner, scheduler *pipeline.Scheduler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		Count := queue.Size()
+		Count := requestQueue.Size()
 		IsRunning := runner.Running()
 		Running, err := runner.GetAmountOfRunningFlows()
 		if err != nil {
 			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
 		}
-		if err := handleJSON(w, StatusResponse{Count, IsRunning, Running}); err != nil {
+		// per-partition counts are only available for partitioned queues
+		var Depths map[string]int
+		if reporter, ok := requestQueue.(queue.DepthReporter); ok {
+			Depths = reporter.Depths()
+		}
+		MaintenanceWindow := scheduler.Current(time.Now())
+		if err := handleJSON(w, StatusResponse{Count, IsRunning, Running, Depths, MaintenanceWindow}); err != nil {
 			handleErrorType(w, errors.New("failed to generate response"), http.StatusInternalServerError, cfg.Logger)
 		}
 	}
@@ -8,8 +8,10 @@ import (
 )
 
 // StopRequest stops datapipeline runner.  Requests can still be enqueued, but the queue will not be serviced.
-func StopRequest(cfg *config.Config, runner *pipeline.DataPipelineRunner) func(http.ResponseWriter, *http.Request) {
+// The runner stays stopped after any maintenance window in effect ends.
+func StopRequest(cfg *config.Config, runner *pipeline.DataPipelineRunner, scheduler *pipeline.Scheduler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		scheduler.Stopped()
 		runner.Stop()
 	}
 }
@@ -16,41 +16,130 @@ type Environment struct {
 	Mode string `default:"dev"`
 	// Port to listen on
 	Addr string `default:":4040"`
-	// Prefect server address including port
+	// Time allowed on SIGINT or SIGTERM for in-flight requests and any submission in progress to
+	// finish, and for state to be flushed and the queue closed, before the service exits anyway
+	ShutdownTimeoutSec int `default:"30" split_words:"true"`
+	// Executor used to run the data pipeline - "prefect" (Prefect Server 1.x), "prefect2" (Prefect 2
+	// REST API) or "local" (a local command)
+	DataPipelineExecutor string `default:"prefect" split_words:"true"`
+	// Prefect server address including port.  For prefect 2 this is the address of the REST API
+	// (ie. http://localhost:4200/api).
 	DataPipelineAddr string `default:"http://localhost:4200" split_words:"true"`
+	// Prefect 2 API key, sent as a bearer token when set.  It is left out of the logged settings.
+	DataPipelineAPIKey string `split_words:"true" json:"-"`
 	// Prefect server request timeout
 	DataPipelineTimeoutSec int `default:"10" split_words:"true"`
 	// Data pipeline queue request size
 	DataPipelineQueueSize int `default:"100" split_words:"true"`
-	// Prefect polling interaval
+	// Interval between polls of the status of submitted flows.  Queued requests are dispatched as
+	// soon as they are enqueued or a flow finishes, and dispatch is also retried on each poll.
 	DataPipelinePollIntervalSec int `default:"5" split_words:"true"`
 	// Prefect project name for the project of the flow
 	DataPipelineProjectName string `default:"Development" split_words:"true"`
 	// Prefect flow name of the data pipeline
 	DataPipelineFlowName string `default:"Data Pipeline" split_words:"true"`
+	// Prefect 2 deployment of the data pipeline flow
+	DataPipelineDeploymentName string `default:"default" split_words:"true"`
+	// Prefect 2 work pool whose queues flow runs are dispatched to.  When empty the work queues
+	// outside of any pool are used.
+	DataPipelineWorkPool string `split_words:"true"`
 	// Enable idempotency checks on prefect
 	DataPipelineIdempotencyChecks string `default:"all" split_words:"true"`
 	// Maximum number of flows to run in parallel
 	DataPipelineParallelism int `default:"1" split_words:"true"`
+	// Command run for each request by the local executor, with its arguments separated by spaces
+	DataPipelineLocalCommand string `split_words:"true"`
+	// How the local executor passes the request data to the command - "stdin", or "file" to write
+	// it to a temporary file whose path is given as the last argument
+	DataPipelineLocalInput string `default:"stdin" split_words:"true"`
 	// Use persisted queue or default (memory only) queue.
 	DataPipelinePersistedQueue bool `default:"true" split_workds:"true"`
+	// Queue ordering to use - "fifo", "priority" or "fair".
+	DataPipelineQueueType string `default:"fifo" split_words:"true"`
+	// Request field used to group requests when the fair queue is used.
+	DataPipelineFairShareKey string `default:"model_id" split_words:"true"`
+	// Time a dequeued request stays hidden while it is submitted to prefect.  Requests that aren't
+	// confirmed as submitted within this time are returned to the head of the queue.
+	DataPipelineLeaseTimeoutSec int `default:"60" split_words:"true"`
 	// Directory to store the queue data in when persisted queue is used.
 	DataPipelineQueueDir string `default:"./" split_words:"true"`
 	// Name of queue when persisted queue is used.
 	DataPipelineQueueName string `default:"request_queue" split_words:"true"`
-	// The time to pause sending jobs to prefect
-	// old dates will cause time configuration to be ignored
-	PauseTime string `default:"2021-09-24T19:10:36-04:00" split_words:"true"`
-	// The time to resume sending jobs to prefect
-	ResumeTime string `default:"2021-09-24T19:10:36-04:00" split_words:"true"`
-	// Server address for causemos
+	// Name of the file used to persist the flows being tracked, which is kept in the queue directory.
+	DataPipelineFlowsName string `default:"current_flows" split_words:"true"`
+	// Maximum number of times a request is run, including the first attempt, before a failed flow
+	// run is reported to causemos.  When retries are enabled, a request that uses up its attempts
+	// is also moved to the dead letter store.
+	DataPipelineRetryMaxAttempts int `default:"3" split_words:"true"`
+	// Delay before the first retry of a failed flow run.  The delay doubles on each following retry.
+	DataPipelineRetryBackoffBaseSec int `default:"30" split_words:"true"`
+	// Maximum delay between retries of a failed flow run.
+	DataPipelineRetryBackoffMaxSec int `default:"600" split_words:"true"`
+	// Comma separated prefect flow run states that are retried.
+	DataPipelineRetryStates []string `default:"Failed" split_words:"true"`
+	// Name of the file used to persist retries waiting on their backoff, which is kept in the queue directory.
+	DataPipelineRetriesName string `default:"pending_retries" split_words:"true"`
+	// Number of failed submissions or failed flow runs before a request is moved to the dead letter store
+	DataPipelineMaxFailures int `default:"3" split_words:"true"`
+	// Name of the dead letter store, which is kept in the queue directory.
+	DataPipelineDeadLetterName string `default:"dead_letter" split_words:"true"`
+	// Name of the outbox that holds causemos and webhook notifications until they are delivered,
+	// which is kept in the queue directory.
+	DataPipelineOutboxName string `default:"outbox" split_words:"true"`
+	// Maximum number of attempts to deliver a notification before it is marked as failed, and its
+	// fallback (ie. processing-failed in place of processing-succeeded) is sent instead.  With the
+	// default backoff, 20 attempts span a little over an hour.  Notifications are retried until they
+	// are delivered when this is 0.
+	DataPipelineOutboxMaxAttempts int `default:"20" split_words:"true"`
+	// Delay before the first retry of a notification.  The delay doubles on each following retry.
+	DataPipelineOutboxBackoffBaseSec int `default:"5" split_words:"true"`
+	// Maximum delay between retries of a notification.
+	DataPipelineOutboxBackoffMaxSec int `default:"300" split_words:"true"`
+	// Number of hours a notification that failed to be delivered is kept in the outbox, where it can
+	// be inspected and retried.  Failed notifications are kept until they are retried when this is 0.
+	DataPipelineOutboxFailedRetentionHours int `default:"168" split_words:"true"`
+	// Name of the file used to persist the state of each job, which is kept in the queue directory.
+	DataPipelineJobsName string `default:"jobs" split_words:"true"`
+	// Number of hours a finished job's state is kept for lookup by run ID.
+	DataPipelineJobRetentionHours int `default:"24" split_words:"true"`
+	// Number of hours an unfinished job can go without changing before it is assumed lost, such as
+	// when the service stopped while it was being dispatched, and is dropped from the job store.
+	// Zero keeps unfinished jobs until they finish.
+	DataPipelineJobStaleHours int `default:"168" split_words:"true"`
+	// Name of the file used to persist the history of finished jobs, which is kept in the queue directory.
+	DataPipelineHistoryName string `default:"history" split_words:"true"`
+	// Number of hours finished jobs are kept in the history.
+	DataPipelineHistoryRetentionHours int `default:"720" split_words:"true"`
+	// Name of the file used to persist the maintenance schedule, which is kept in the queue
+	// directory.  The schedule is edited through /data-pipeline/schedule.
+	DataPipelineScheduleName string `default:"schedule" split_words:"true"`
+	// Flow run duration used to estimate when queued jobs will be dispatched, until the job
+	// history has finished flow runs to base estimates on.
+	DataPipelineDefaultRunDurationSec int `default:"300" split_words:"true"`
+	// Rolling windows, in hours, that job statistics are reported over.
+	DataPipelineStatsWindowsHours []int `default:"1,24,168" split_words:"true"`
+	// Path to a JSON file listing webhooks to notify of job lifecycle events.  Each webhook has a
+	// name, url, and optionally the events it is sent, headers to add and a secret used to sign
+	// requests.  No webhooks are notified when this is empty.
+	DataPipelineWebhooksFile string `default:"" split_words:"true"`
+	// Server address for causemos.  Causemos isn't notified of job lifecycle events when this is empty.
 	CausemosAddr string `default:"http://localhost:3000" split_words:"true"`
-	// The label used to filter out prefect agents to track
+	// The label used to filter out prefect agents to track.  For prefect 2, work queues whose name
+	// contains the label are not tracked.
 	AgentLabelToIgnore string `default:"non-dask" split_words:"true"`
 	// The username needed to make API calls to causemos
 	Username string `default:"worldmodelers" split_words:"true"`
 	// The password needed to make API calls to causemos
 	Password string `default:"world!" split_words:"true"`
+	// Bearer tokens accepted from submitters, who may enqueue requests and view jobs and status.
+	// The API is open to everyone when no tokens or users are configured for either role.
+	AuthSubmitterTokens []string `split_words:"true" json:"-"`
+	// Bearer tokens accepted from operators, who may also control the runner and manage the queue.
+	AuthOperatorTokens []string `split_words:"true" json:"-"`
+	// JSON file of the basic auth users accepted for each role, as an object whose `submitters` and
+	// `operators` fields map user names to passwords.  No basic auth users are accepted when this is
+	// empty.
+	AuthUsersFile string `default:"" split_words:"true"`
 }
 
 const (
@@ -93,6 +182,33 @@ func Load(envFile string) (*Environment, error) {
 	return &env, err
 }
 
+const (
+	// QueueFIFO dequeues requests in the order they were received
+	QueueFIFO = "fifo"
+	// QueuePriority dequeues requests with the highest priority first, and in the order they were
+	// received within a priority
+	QueuePriority = "priority"
+	// QueueFair rotates between requests grouped by a request field (ie. model_id), and
+	// dequeues requests in the order they were received within a group
+	QueueFair = "fair"
+)
+
+const (
+	// ExecutorPrefect runs the data pipeline on Prefect Server 1.x through its GraphQL API
+	ExecutorPrefect = "prefect"
+	// ExecutorPrefect2 runs the data pipeline from a Prefect 2 deployment through its REST API
+	ExecutorPrefect2 = "prefect2"
+	// ExecutorLocal runs the data pipeline as a local command
+	ExecutorLocal = "local"
+)
+
+const (
+	// LocalInputStdin passes request data to the local command on stdin
+	LocalInputStdin = "stdin"
+	// LocalInputFile passes request data to the local command in a temporary file
+	LocalInputFile = "file"
+)
+
 // UsePrefectIdempotency checks if the supplied arg calls for the use of prefect's idempotency
 // functionalty, which skips execution of a previously run request.
 func UsePrefectIdempotency(idempotencyType string) bool {
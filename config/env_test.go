@@ -0,0 +1,22 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironmentStringHidesSecrets(t *testing.T) {
+	env := Environment{
+		DataPipelineAddr:    "http://prefect:4200",
+		DataPipelineAPIKey:  "prefect-api-key",
+		AuthSubmitterTokens: []string{"submitter-token"},
+		AuthOperatorTokens:  []string{"operator-token"},
+	}
+
+	settings := env.String()
+	assert.Contains(t, settings, "http://prefect:4200")
+	for _, secret := range []string{"prefect-api-key", "submitter-token", "operator-token"} {
+		assert.NotContains(t, settings, secret)
+	}
+}
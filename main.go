@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"log"
 	"net/http"
+	"os/signal"
+	"syscall"
 	"time"
+	// embedded time zone database for maintenance windows, since the image has none
+	_ "time/tzdata"
 
+	"github.com/pkg/errors"
 	"gitlab.uncharted.software/WM/wm-request-queue/api"
+	"gitlab.uncharted.software/WM/wm-request-queue/api/metrics"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/pipeline"
 	"gitlab.uncharted.software/WM/wm-request-queue/api/queue"
 	"gitlab.uncharted.software/WM/wm-request-queue/config"
@@ -49,7 +56,7 @@ func main() {
 	}()
 	sugar := logger.Sugar()
 
-	config := config.Config{
+	cfg := config.Config{
 		Logger:      sugar,
 		Environment: env,
 	}
@@ -67,66 +74,190 @@ func main() {
 		// of any structures that it stores.  TODO: Could be added to the params of the New call below.
 		gob.Register(pipeline.EnqueueRequestData{})
 		gob.Register(pipeline.KeyedEnqueueRequestData{})
-		requestQueue, err = queue.NewPersistedFIFOQueue(env.DataPipelineQueueSize, env.DataPipelineQueueDir, env.DataPipelineQueueName)
-		sugar.Infof("Loaded queue with %d entries from %s%s", requestQueue.Size(), env.DataPipelineQueueDir, env.DataPipelineQueueName)
+		switch env.DataPipelineQueueType {
+		case config.QueueFIFO:
+			requestQueue, err = queue.NewPersistedFIFOQueue(env.DataPipelineQueueSize, env.DataPipelineQueueDir, env.DataPipelineQueueName)
+		case config.QueuePriority:
+			requestQueue, err = queue.NewPersistedPriorityQueue(env.DataPipelineQueueSize, env.DataPipelineQueueDir, env.DataPipelineQueueName, pipeline.RequestPriority)
+		case config.QueueFair:
+			requestQueue, err = queue.NewPersistedFairQueue(env.DataPipelineQueueSize, env.DataPipelineQueueDir, env.DataPipelineQueueName, pipeline.RequestPartitionKey(env.DataPipelineFairShareKey))
+		default:
+			err = fmt.Errorf("Invalid queue type: %s", env.DataPipelineQueueType)
+		}
 		if err != nil {
 			sugar.Fatal(err)
 		}
+		sugar.Infof("Loaded queue with %d entries from %s%s", requestQueue.Size(), env.DataPipelineQueueDir, env.DataPipelineQueueName)
 	} else {
 		// in-memory queue, data does not survive a restart
-		requestQueue = queue.NewListFIFOQueue(env.DataPipelineQueueSize)
+		switch env.DataPipelineQueueType {
+		case config.QueueFIFO:
+			requestQueue = queue.NewListFIFOQueue(env.DataPipelineQueueSize)
+		case config.QueuePriority:
+			requestQueue = queue.NewListPriorityQueue(env.DataPipelineQueueSize, pipeline.RequestPriority)
+		case config.QueueFair:
+			requestQueue = queue.NewListFairQueue(env.DataPipelineQueueSize, pipeline.RequestPartitionKey(env.DataPipelineFairShareKey))
+		default:
+			sugar.Fatalf("Invalid queue type: %s", env.DataPipelineQueueType)
+		}
 	}
 
-	currentTime := time.Now()
-	// Setup the prefect mediator
-	dataPipelineRunner := pipeline.NewDataPipelineRunner(&config, requestQueue)
-	go pauseAndResume(&currentTime, dataPipelineRunner.SetAgents)
+	// Signal enqueues so that the runner dispatches new requests without waiting to poll
+	requestQueue = queue.NewNotifyingQueue(requestQueue)
 
-	// Setup router
-	r, err := api.NewRouter(config, requestQueue, dataPipelineRunner)
+	// Setup the metrics served from /metrics
+	serviceMetrics := metrics.NewMetrics()
+	serviceMetrics.WatchQueue(requestQueue)
+
+	// Setup the dead letter store for requests that repeatedly fail
+	deadLetters, err := pipeline.NewDeadLetterStore(env.DataPipelineQueueDir, env.DataPipelineDeadLetterName, env.DataPipelineMaxFailures)
 	if err != nil {
 		sugar.Fatal(err)
 	}
 
-	// Start listening for updates
-	dataPipelineRunner.Start()
+	// Setup the outbox that holds causemos notifications until they are delivered
+	outbox, err := pipeline.NewOutbox(env)
+	if err != nil {
+		sugar.Fatal(err)
+	}
 
-	pauseTime, err := time.Parse(time.RFC3339, env.PauseTime)
+	// Setup notification of job lifecycle events to causemos and any configured webhooks
+	subscribers, err := pipeline.NewSubscribers(env)
 	if err != nil {
 		sugar.Fatal(err)
 	}
-	// ignores time configuration if given pause time date is before when code is ran
-	if currentTime.Before(pauseTime) {
-		sugar.Info("Datapipeline pause time: %s", pauseTime)
-		go pauseAndResume(&pauseTime, dataPipelineRunner.Stop)
+	outboxNotifier := pipeline.NewOutboxNotifier(&cfg, outbox, subscribers)
 
-		resumeTime, err := time.Parse(time.RFC3339, env.ResumeTime)
+	// Track each job's lifecycle, which follows the same events as the subscribers
+	jobs, err := pipeline.NewJobStore(&cfg)
+	if err != nil {
+		sugar.Fatal(err)
+	}
+	// Keep a history of finished jobs, including the outcome of notifying subscribers
+	history, err := pipeline.NewHistoryStore(&cfg)
+	if err != nil {
+		sugar.Fatal(err)
+	}
+	outboxNotifier.Observe(history)
+	outboxNotifier.Observe(serviceMetrics)
+	notifier := pipeline.Notifiers{jobs, history, serviceMetrics, outboxNotifier}
+
+	// Setup the executor that runs the data pipeline
+	var executor pipeline.Executor
+	switch env.DataPipelineExecutor {
+	case config.ExecutorPrefect:
+		executor = pipeline.NewPrefectExecutor(env)
+	case config.ExecutorPrefect2:
+		executor = pipeline.NewPrefect2Executor(env)
+	case config.ExecutorLocal:
+		executor, err = pipeline.NewLocalExecutor(env)
 		if err != nil {
 			sugar.Fatal(err)
 		}
-		sugar.Info("Datapipeline resume time: %s", resumeTime)
-		go pauseAndResume(&resumeTime, dataPipelineRunner.Start)
+	default:
+		sugar.Fatalf("Invalid executor: %s", env.DataPipelineExecutor)
+	}
+	// Readiness checks use the executor before it's instrumented, since the wrapper hides its flow
+	// check and probes shouldn't be counted as pipeline requests
+	healthChecks := pipeline.NewHealthChecks(env, executor)
+	executor = serviceMetrics.InstrumentExecutor(executor)
+
+	// Setup the prefect mediator
+	dataPipelineRunner, err := pipeline.NewDataPipelineRunner(&cfg, requestQueue, deadLetters, jobs, notifier, executor)
+	if err != nil {
+		sugar.Fatal(err)
+	}
+	sugar.Infof("Loaded %d tracked flows", dataPipelineRunner.TrackedFlowCount())
+	serviceMetrics.WatchFlows(dataPipelineRunner.TrackedFlowCount)
+
+	// Pick up any flows that were submitted but not saved before the last shutdown
+	reconciled, err := dataPipelineRunner.Reconcile()
+	if err != nil {
+		sugar.Error(err)
+	} else {
+		sugar.Infof("Reconciled flows with prefect: %d adopted, %d unknown, %d duplicated",
+			len(reconciled.Adopted), len(reconciled.Unknown), len(reconciled.Duplicated))
+	}
+
+	// Pause the runner during maintenance windows, then start listening for updates, waiting for the
+	// end of any window that's already in effect
+	scheduler, err := pipeline.NewScheduler(&cfg, dataPipelineRunner.Running, dataPipelineRunner.Stop, dataPipelineRunner.Start)
+	if err != nil {
+		sugar.Fatal(err)
+	}
+	scheduler.Resume()
+
+	// Setup router
+	r, err := api.NewRouter(cfg, requestQueue, dataPipelineRunner, deadLetters, outbox, jobs, history, notifier, serviceMetrics, healthChecks, scheduler)
+	if err != nil {
+		sugar.Fatal(err)
 	}
 
 	// Start listening
-	sugar.Infof("Listening on %s", env.Addr)
-	sugar.Fatal(http.ListenAndServe(env.Addr, r))
+	server := &http.Server{Addr: env.Addr, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		sugar.Infof("Listening on %s", env.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
 
-}
+	// Wait for a shutdown signal, or the server to fail
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErr:
+		sugar.Fatal(err)
+	case <-signals.Done():
+	}
+	stop()
 
-func pauseAndResume(triggerTime *time.Time, dataPipelineOperation func()) {
-	currentTime := time.Now()
-	resumeHour := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), triggerTime.Hour(), triggerTime.Minute(), triggerTime.Second(), 0, triggerTime.Location())
-	difference := resumeHour.Sub(currentTime)
+	sugar.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(env.ShutdownTimeoutSec)*time.Second)
+	defer cancel()
 
-	if difference < 0 {
-		resumeHour = resumeHour.Add(24 * time.Hour)
-		difference = resumeHour.Sub(currentTime)
+	// Stop accepting requests and let in-flight handlers finish
+	if err := server.Shutdown(ctx); err != nil {
+		sugar.Error(errors.Wrap(err, "failed to drain http requests"))
+	}
+	// Stop the scheduler first so that it can't restart the runner
+	if !waitFor(ctx, scheduler.Close) {
+		sugar.Error("Scheduler did not close before the shutdown deadline")
+	}
+	// Stop dispatching once any submission in progress is done, and flush the tracked flows
+	if err := dataPipelineRunner.Shutdown(ctx); err != nil {
+		sugar.Error(err)
+	}
+	// Stop delivering notifications - anything undelivered stays in the outbox
+	if !waitFor(ctx, outboxNotifier.Close) {
+		sugar.Error("Notifier did not close before the shutdown deadline")
 	}
-	for {
-		time.Sleep(difference)
-		difference = 24 * time.Hour
-		dataPipelineOperation()
+	if err := outbox.Close(); err != nil {
+		sugar.Error(err)
+	}
+	if err := jobs.Close(); err != nil {
+		sugar.Error(err)
+	}
+	if err := history.Close(); err != nil {
+		sugar.Error(err)
+	}
+	// Close the queue last so that nothing writes to it after its segments are flushed
+	if err := requestQueue.Close(); err != nil {
+		sugar.Error(errors.Wrap(err, "failed to close queue"))
+	}
+	sugar.Info("Shutdown complete")
+}
 
+// waitFor runs fn, returning false if it hasn't finished by the context's deadline.
+func waitFor(ctx context.Context, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }